@@ -0,0 +1,162 @@
+package masque
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// Close reasons reported in FlowRecord.CloseReason.
+// If the flow was terminated by an error, the error message is used instead.
+const (
+	// CloseReasonClient is used when the client closed the request stream.
+	CloseReasonClient = "client closed"
+	// CloseReasonProxy is used when the flow was terminated because the Proxy was closed.
+	CloseReasonProxy = "proxy closed"
+	// CloseReasonTarget is used when the target closed the TCP connection of a CONNECT-TCP flow
+	// before the client closed the request stream.
+	CloseReasonTarget = "target closed"
+)
+
+// A FlowRecord is the accounting record of a proxied flow.
+// It is passed to Proxy.AccessLog when the flow ends.
+// Requests that were rejected by the Proxy or the Handler are logged as well, with the status code of the response.
+type FlowRecord struct {
+	// ClientAddr is the address of the client.
+	ClientAddr net.Addr
+	// Identity is the identity of the client, as set in ProxyRequest.Identity.
+	Identity string
+	// Template is the URI template that the request was matched against.
+	Template *uritemplate.Template
+	// Protocol is the protocol of the request: ProtocolConnectUDP, ProtocolConnectTCP or ProtocolConnectEthernet.
+	Protocol string
+	// Target is the target requested by the client.
+	Target string
+	// NextHop is the address of the target that the datagrams were sent to, or that the TCP connection was established to.
+	// If the proxy failed over to a different address, this is the last address used.
+	// It is the zero value if the request was rejected before a socket was created.
+	NextHop netip.AddrPort
+
+	Start time.Time
+	End   time.Time
+
+	// BytesToTarget and DatagramsToTarget count the UDP payloads sent to the target.
+	// For CONNECT-TCP flows, BytesToTarget counts the bytes of the stream, and no datagrams are counted.
+	BytesToTarget     uint64
+	DatagramsToTarget uint64
+	// BytesFromTarget and DatagramsFromTarget count the UDP payloads received from the target.
+	// For CONNECT-TCP flows, BytesFromTarget counts the bytes of the stream, and no datagrams are counted.
+	BytesFromTarget     uint64
+	DatagramsFromTarget uint64
+	// DroppedToTarget is the number of datagrams received from the client that were not sent to the target,
+	// for example because they used an unknown context ID, or were larger than the MTU.
+	DroppedToTarget uint64
+	// DroppedFromTarget is the number of UDP packets received from the target that were not sent to the client.
+	DroppedFromTarget uint64
+
+	// Status is the status code of the response.
+	Status int
+	// CloseReason describes why the flow ended, or why the request was rejected.
+	CloseReason string
+}
+
+func newFlowRecord(r *ProxyRequest) *FlowRecord {
+	return &FlowRecord{
+		ClientAddr: r.RemoteAddr(),
+		Identity:   r.Identity,
+		Template:   r.Template,
+		Protocol:   r.Protocol,
+		Target:     r.Target,
+		Start:      time.Now(),
+	}
+}
+
+// reject records that the request was rejected, and writes the status code.
+func (rec *FlowRecord) reject(w http.ResponseWriter, status int, err error) error {
+	rec.Status = status
+	rec.CloseReason = err.Error()
+	w.WriteHeader(status)
+	return err
+}
+
+// A JSONAccessLog writes FlowRecords as JSON lines, i.e. one JSON object per line.
+// It is safe for concurrent use.
+type JSONAccessLog struct {
+	mx sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAccessLog creates a new JSONAccessLog writing to w.
+// Its Log method can be used as Proxy.AccessLog.
+func NewJSONAccessLog(w io.Writer) *JSONAccessLog {
+	return &JSONAccessLog{w: w}
+}
+
+type jsonFlowRecord struct {
+	ClientAddr          string    `json:"client_addr,omitempty"`
+	Identity            string    `json:"identity,omitempty"`
+	Template            string    `json:"template,omitempty"`
+	Protocol            string    `json:"protocol,omitempty"`
+	Target              string    `json:"target"`
+	NextHop             string    `json:"next_hop,omitempty"`
+	Start               time.Time `json:"start"`
+	End                 time.Time `json:"end"`
+	BytesToTarget       uint64    `json:"bytes_to_target"`
+	BytesFromTarget     uint64    `json:"bytes_from_target"`
+	DatagramsToTarget   uint64    `json:"datagrams_to_target"`
+	DatagramsFromTarget uint64    `json:"datagrams_from_target"`
+	DroppedToTarget     uint64    `json:"dropped_to_target"`
+	DroppedFromTarget   uint64    `json:"dropped_from_target"`
+	Status              int       `json:"status"`
+	CloseReason         string    `json:"close_reason,omitempty"`
+}
+
+// Log writes the record.
+// Errors are logged, since there's no way to return them to the Proxy.
+func (l *JSONAccessLog) Log(rec *FlowRecord) {
+	r := jsonFlowRecord{
+		Identity:            rec.Identity,
+		Protocol:            rec.Protocol,
+		Target:              rec.Target,
+		Start:               rec.Start,
+		End:                 rec.End,
+		BytesToTarget:       rec.BytesToTarget,
+		BytesFromTarget:     rec.BytesFromTarget,
+		DatagramsToTarget:   rec.DatagramsToTarget,
+		DatagramsFromTarget: rec.DatagramsFromTarget,
+		DroppedToTarget:     rec.DroppedToTarget,
+		DroppedFromTarget:   rec.DroppedFromTarget,
+		Status:              rec.Status,
+		CloseReason:         rec.CloseReason,
+	}
+	if rec.ClientAddr != nil {
+		r.ClientAddr = rec.ClientAddr.String()
+	}
+	if rec.Template != nil {
+		r.Template = rec.Template.Raw()
+	}
+	if rec.NextHop.IsValid() {
+		r.NextHop = rec.NextHop.String()
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // URI templates contain &
+	if err := enc.Encode(&r); err != nil {
+		log.Printf("failed to encode flow record: %v", err)
+		return
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if _, err := l.w.Write(buf.Bytes()); err != nil {
+		log.Printf("failed to write flow record: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package masque_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+func TestAccessLog(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	records := make(chan *masque.FlowRecord, 10)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{
+			Resolver:  fakeResolver{},
+			AccessLog: func(rec *masque.FlowRecord) { records <- rec },
+		},
+		Authorize: func(_ http.ResponseWriter, r *masque.ProxyRequest) bool {
+			r.Identity = "alice"
+			return true
+		},
+	})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+
+	t.Run("proxied flow", func(t *testing.T) {
+		req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+		require.NoError(t, err)
+		conn, _, err := tr.Dial(req)
+		require.NoError(t, err)
+		b := make([]byte, 1500)
+		for _, msg := range []string{"foo", "foobar"} {
+			_, err = conn.WriteTo([]byte(msg), nil)
+			require.NoError(t, err)
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+			n, _, err := conn.ReadFrom(b)
+			require.NoError(t, err)
+			require.Equal(t, msg, string(b[:n]))
+		}
+		require.NoError(t, conn.Close())
+
+		var rec *masque.FlowRecord
+		select {
+		case rec = <-records:
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+		require.Equal(t, http.StatusOK, rec.Status)
+		require.Equal(t, "alice", rec.Identity)
+		require.Equal(t, template.Raw(), rec.Template.Raw())
+		require.Equal(t, remoteServerConn.LocalAddr().String(), rec.Target)
+		require.Equal(t, remoteServerConn.LocalAddr().(*net.UDPAddr).AddrPort(), rec.NextHop)
+		require.NotNil(t, rec.ClientAddr)
+		require.Equal(t, uint64(2), rec.DatagramsToTarget)
+		require.Equal(t, uint64(2), rec.DatagramsFromTarget)
+		require.Equal(t, uint64(9), rec.BytesToTarget)
+		require.Equal(t, uint64(9), rec.BytesFromTarget)
+		require.Zero(t, rec.DroppedToTarget)
+		require.Zero(t, rec.DroppedFromTarget)
+		require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+		require.False(t, rec.End.Before(rec.Start))
+	})
+
+	t.Run("rejected request", func(t *testing.T) {
+		req, err := masque.NewRequest(context.Background(), template, "quic-go.net:1234")
+		require.NoError(t, err)
+		_, rsp, err := tr.Dial(req)
+		require.Error(t, err)
+		require.Equal(t, http.StatusBadGateway, rsp.StatusCode)
+
+		var rec *masque.FlowRecord
+		select {
+		case rec = <-records:
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+		require.Equal(t, http.StatusBadGateway, rec.Status)
+		require.Equal(t, "quic-go.net:1234", rec.Target)
+		require.False(t, rec.NextHop.IsValid())
+		require.Contains(t, rec.CloseReason, "no such host")
+	})
+}
+
+func TestAccessLogProxyClosed(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	records := make(chan *masque.FlowRecord, 1)
+	proxy := &masque.Proxy{AccessLog: func(rec *masque.FlowRecord) { records <- rec }}
+	conn, _ := dialProxy(t, proxy, remoteServerConn.LocalAddr().String())
+	defer conn.Close()
+	checkEcho(t, conn, "foo")
+
+	// Close waits for the flow to be logged.
+	require.NoError(t, proxy.Close())
+	select {
+	case rec := <-records:
+		require.Equal(t, http.StatusOK, rec.Status)
+		require.Equal(t, masque.CloseReasonProxy, rec.CloseReason)
+	default:
+		t.Fatal("flow not logged")
+	}
+}
+
+func TestJSONAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := masque.NewJSONAccessLog(&buf)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.Log(&masque.FlowRecord{
+		ClientAddr:          &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4321},
+		Identity:            "alice",
+		Template:            uritemplate.MustNew("https://localhost:1234/masque?h={target_host}&p={target_port}"),
+		Target:              "example.com:443",
+		NextHop:             netip.MustParseAddrPort("198.51.100.1:443"),
+		Start:               start,
+		End:                 start.Add(time.Minute),
+		BytesToTarget:       100,
+		BytesFromTarget:     200,
+		DatagramsToTarget:   1,
+		DatagramsFromTarget: 2,
+		DroppedToTarget:     3,
+		DroppedFromTarget:   4,
+		Status:              http.StatusOK,
+		CloseReason:         masque.CloseReasonClient,
+	})
+	l.Log(&masque.FlowRecord{Target: "example.com:443", Status: http.StatusBadGateway, CloseReason: "no such host"})
+
+	require.NotContains(t, buf.String(), `\u0026`)
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	require.Len(t, lines, 2)
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal(lines[0], &rec))
+	require.Equal(t, map[string]any{
+		"client_addr":           "192.0.2.1:4321",
+		"identity":              "alice",
+		"template":              "https://localhost:1234/masque?h={target_host}&p={target_port}",
+		"target":                "example.com:443",
+		"next_hop":              "198.51.100.1:443",
+		"start":                 "2024-01-02T03:04:05Z",
+		"end":                   "2024-01-02T03:05:05Z",
+		"bytes_to_target":       float64(100),
+		"bytes_from_target":     float64(200),
+		"datagrams_to_target":   float64(1),
+		"datagrams_from_target": float64(2),
+		"dropped_to_target":     float64(3),
+		"dropped_from_target":   float64(4),
+		"status":                float64(http.StatusOK),
+		"close_reason":          "client closed",
+	}, rec)
+
+	rec = nil
+	require.NoError(t, json.Unmarshal(lines[1], &rec))
+	require.NotContains(t, rec, "client_addr")
+	require.NotContains(t, rec, "next_hop")
+	require.Equal(t, float64(http.StatusBadGateway), rec["status"])
+}
@@ -0,0 +1,321 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Authentication schemes used with proxies.
+const (
+	// AuthSchemeBasic is the Basic authentication scheme (RFC 7617).
+	AuthSchemeBasic = "Basic"
+	// AuthSchemeBearer is the Bearer authentication scheme (RFC 6750).
+	AuthSchemeBearer = "Bearer"
+	// AuthSchemePrivateToken is used for Privacy Pass tokens (RFC 9577).
+	AuthSchemePrivateToken = "PrivateToken"
+	// AuthSchemeConcealed is the Concealed HTTP authentication scheme,
+	// which binds a signature to the TLS connection to the proxy.
+	AuthSchemeConcealed = "Concealed"
+)
+
+// A Challenge is an authentication challenge sent by the proxy in the Proxy-Authenticate header field
+// of a 407 (Proxy Authentication Required) response (RFC 9110, Section 11.6.1).
+type Challenge struct {
+	// Scheme is the authentication scheme, for example [AuthSchemeBasic].
+	// Schemes are case-insensitive.
+	Scheme string
+	// Params are the authentication parameters, for example the realm.
+	// Parameter names are converted to lowercase.
+	Params map[string]string
+	// Token68 is set if the challenge carries a token68 instead of parameters.
+	Token68 string
+}
+
+// ParseProxyAuthenticate parses the challenges of the Proxy-Authenticate header field.
+// The header field can contain multiple challenges, and it can be sent multiple times.
+func ParseProxyAuthenticate(h http.Header) ([]Challenge, error) {
+	var challenges []Challenge
+	for _, v := range h.Values("Proxy-Authenticate") {
+		c, err := parseChallenges(v)
+		if err != nil {
+			return nil, fmt.Errorf("masque: invalid Proxy-Authenticate header field: %w", err)
+		}
+		challenges = append(challenges, c...)
+	}
+	return challenges, nil
+}
+
+// ParseProxyAuthorization parses the credentials of the Proxy-Authorization header field sent by the client.
+// Credentials use the same syntax as challenges (RFC 9110, Section 11.4), and are therefore returned as a Challenge.
+func ParseProxyAuthorization(h http.Header) (Challenge, error) {
+	v := h.Get("Proxy-Authorization")
+	if v == "" {
+		return Challenge{}, errors.New("masque: missing Proxy-Authorization header field")
+	}
+	c, err := parseChallenges(v)
+	if err != nil {
+		return Challenge{}, fmt.Errorf("masque: invalid Proxy-Authorization header field: %w", err)
+	}
+	if len(c) != 1 {
+		return Challenge{}, errors.New("masque: invalid Proxy-Authorization header field: expected exactly one set of credentials")
+	}
+	return c[0], nil
+}
+
+// parseChallenges parses a comma-separated list of challenges:
+//
+//	challenge  = auth-scheme [ 1*SP ( token68 / #auth-param ) ]
+//	auth-param = token BWS "=" BWS ( token / quoted-string )
+//
+// Since commas separate both challenges and parameters,
+// a token that is not followed by "=" starts the next challenge.
+func parseChallenges(s string) ([]Challenge, error) {
+	p := &headerParser{s: s}
+	var challenges []Challenge
+	for {
+		p.skip(func(c byte) bool { return c == ',' || isWhitespace(c) })
+		if p.done() {
+			return challenges, nil
+		}
+		scheme := p.token()
+		if scheme == "" {
+			return nil, fmt.Errorf("expected auth-scheme at position %d", p.pos)
+		}
+		c := Challenge{Scheme: scheme}
+		hasSpace := p.skip(isWhitespace)
+		if hasSpace && !p.done() && p.peek() != ',' {
+			if t, ok := p.token68(); ok {
+				c.Token68 = t
+			} else if err := p.params(&c); err != nil {
+				return nil, err
+			}
+		}
+		challenges = append(challenges, c)
+	}
+}
+
+type headerParser struct {
+	s   string
+	pos int
+}
+
+func (p *headerParser) done() bool { return p.pos >= len(p.s) }
+func (p *headerParser) peek() byte { return p.s[p.pos] }
+
+// skip skips all bytes matching f, and reports whether any byte was skipped.
+func (p *headerParser) skip(f func(byte) bool) bool {
+	start := p.pos
+	for !p.done() && f(p.peek()) {
+		p.pos++
+	}
+	return p.pos > start
+}
+
+func (p *headerParser) token() string {
+	start := p.pos
+	p.skip(isTokenChar)
+	return p.s[start:p.pos]
+}
+
+// token68 parses a token68, if the challenge carries one.
+// Otherwise, the position is not changed.
+func (p *headerParser) token68() (string, bool) {
+	start := p.pos
+	p.skip(isToken68Char)
+	if p.pos == start {
+		return "", false
+	}
+	p.skip(func(c byte) bool { return c == '=' })
+	end := p.pos
+	p.skip(isWhitespace)
+	if !p.done() && p.peek() != ',' {
+		p.pos = start
+		return "", false
+	}
+	return p.s[start:end], true
+}
+
+// params parses the auth-params of a challenge, until the next challenge starts.
+func (p *headerParser) params(c *Challenge) error {
+	c.Params = make(map[string]string)
+	for {
+		p.skip(isWhitespace)
+		start := p.pos
+		name := p.token()
+		if name == "" {
+			return fmt.Errorf("expected auth-param at position %d", p.pos)
+		}
+		p.skip(isWhitespace)
+		if p.done() || p.peek() != '=' {
+			// This is the scheme of the next challenge.
+			p.pos = start
+			return nil
+		}
+		p.pos++
+		p.skip(isWhitespace)
+		var value string
+		if !p.done() && p.peek() == '"' {
+			var err error
+			if value, err = p.quotedString(); err != nil {
+				return err
+			}
+		} else if value = p.token(); value == "" {
+			return fmt.Errorf("expected value for auth-param %s", name)
+		}
+		c.Params[strings.ToLower(name)] = value
+		p.skip(isWhitespace)
+		if p.done() {
+			return nil
+		}
+		if p.peek() != ',' {
+			return fmt.Errorf("unexpected character %q at position %d", p.peek(), p.pos)
+		}
+		p.skip(func(c byte) bool { return c == ',' || isWhitespace(c) })
+		if p.done() {
+			return nil
+		}
+	}
+}
+
+func (p *headerParser) quotedString() (string, error) {
+	p.pos++ // opening quote
+	var b strings.Builder
+	for !p.done() {
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.done() {
+				return "", errors.New("unterminated quoted-string")
+			}
+			b.WriteByte(p.peek())
+			p.pos++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated quoted-string")
+}
+
+func isWhitespace(c byte) bool { return c == ' ' || c == '\t' }
+
+// isTokenChar checks for a tchar (RFC 9110, Section 5.6.2).
+func isTokenChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func isToken68Char(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("-._~+/", c) >= 0
+}
+
+// An AuthRequest is passed to the [CredentialsProvider] when the proxy requires authentication.
+type AuthRequest struct {
+	// Proxy is the authority (host:port) of the proxy.
+	Proxy string
+	// Challenges are the challenges sent by the proxy.
+	Challenges []Challenge
+	// Response is the 407 response.
+	Response *http.Response
+	// TLS is the state of the TLS connection to the proxy.
+	// It can be used to export keying material, as required by the Concealed authentication scheme.
+	TLS tls.ConnectionState
+}
+
+// Challenge returns the first challenge using the scheme, if any.
+func (r *AuthRequest) Challenge(scheme string) (Challenge, bool) {
+	for _, c := range r.Challenges {
+		if strings.EqualFold(c.Scheme, scheme) {
+			return c, true
+		}
+	}
+	return Challenge{}, false
+}
+
+// A CredentialsProvider provides credentials when the proxy answers a request with a 407 response.
+type CredentialsProvider interface {
+	// ProxyCredentials returns the value of the Proxy-Authorization header field for the challenges sent by the proxy.
+	// The request is then sent again, on the same connection to the proxy.
+	// If the credentials are reusable, they are cached, and sent with all subsequent requests to the same proxy,
+	// until the proxy rejects them. Single-use credentials, like Privacy Pass tokens, must not be reusable.
+	// If it returns an error, dialing fails with this error.
+	ProxyCredentials(ctx context.Context, req *AuthRequest) (authorization string, reusable bool, err error)
+}
+
+// BasicCredentials is a [CredentialsProvider] for the Basic authentication scheme.
+type BasicCredentials struct {
+	Username, Password string
+}
+
+var _ CredentialsProvider = &BasicCredentials{}
+
+// ProxyCredentials returns the credentials, if the proxy offered the Basic authentication scheme.
+func (c *BasicCredentials) ProxyCredentials(_ context.Context, req *AuthRequest) (string, bool, error) {
+	if _, ok := req.Challenge(AuthSchemeBasic); !ok {
+		return "", false, errNoMatchingChallenge(AuthSchemeBasic)
+	}
+	return AuthSchemeBasic + " " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)), true, nil
+}
+
+// BearerCredentials is a [CredentialsProvider] for the Bearer authentication scheme.
+type BearerCredentials struct {
+	Token string
+}
+
+var _ CredentialsProvider = &BearerCredentials{}
+
+// ProxyCredentials returns the token, if the proxy offered the Bearer authentication scheme.
+func (c *BearerCredentials) ProxyCredentials(_ context.Context, req *AuthRequest) (string, bool, error) {
+	if _, ok := req.Challenge(AuthSchemeBearer); !ok {
+		return "", false, errNoMatchingChallenge(AuthSchemeBearer)
+	}
+	return AuthSchemeBearer + " " + c.Token, true, nil
+}
+
+func errNoMatchingChallenge(scheme string) error {
+	return fmt.Errorf("masque: proxy didn't offer the %s authentication scheme", scheme)
+}
+
+// authCache caches reusable credentials per proxy.
+type authCache struct {
+	mx    sync.Mutex
+	creds map[string]string // by proxy authority
+}
+
+func (c *authCache) get(proxy string) string {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.creds[proxy]
+}
+
+func (c *authCache) set(proxy, authorization string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.creds == nil {
+		c.creds = make(map[string]string)
+	}
+	c.creds[proxy] = authorization
+}
+
+// remove removes credentials that were rejected by the proxy,
+// unless they were already replaced.
+func (c *authCache) remove(proxy, authorization string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.creds[proxy] == authorization {
+		delete(c.creds, proxy)
+	}
+}
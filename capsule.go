@@ -0,0 +1,115 @@
+package masque
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// A CapsuleHandler handles a capsule received on the request stream (RFC 9297).
+// The capsule value is read from r, which is only valid until the handler returns.
+// Handlers are called sequentially, in the order the capsules were received.
+// If the handler returns an error, the request stream is aborted,
+// and the error is reported as a [CapsuleError].
+type CapsuleHandler func(ct http3.CapsuleType, r io.Reader) error
+
+// ErrUnknownCapsule can be returned by the handler for unknown capsules,
+// if receiving an unknown capsule should abort the request stream.
+// By default, unknown capsules are skipped, as required by RFC 9297.
+var ErrUnknownCapsule = errors.New("unknown capsule type")
+
+// A CapsuleError is the error that caused the request stream to be aborted while processing a capsule.
+// This happens if a CapsuleHandler returned an error, or if a capsule used by this package was malformed.
+type CapsuleError struct {
+	Type http3.CapsuleType
+	Err  error
+}
+
+func (e *CapsuleError) Error() string {
+	return fmt.Sprintf("masque: processing capsule of type %#x failed: %v", uint64(e.Type), e.Err)
+}
+
+func (e *CapsuleError) Unwrap() error { return e.Err }
+
+// capsuleHandlers are the handlers registered for a request stream.
+type capsuleHandlers struct {
+	handlers map[http3.CapsuleType]CapsuleHandler
+	unknown  CapsuleHandler
+}
+
+func (h *capsuleHandlers) handle(ct http3.CapsuleType, handler CapsuleHandler) {
+	if h.handlers == nil {
+		h.handlers = make(map[http3.CapsuleType]CapsuleHandler)
+	}
+	h.handlers[ct] = handler
+}
+
+func (h *capsuleHandlers) clone() capsuleHandlers {
+	return capsuleHandlers{handlers: maps.Clone(h.handlers), unknown: h.unknown}
+}
+
+// readCapsules reads capsules from the request stream until it is closed, or a handler fails.
+// Capsules without a handler are skipped.
+func (h *capsuleHandlers) readCapsules(str io.Reader) error {
+	parser := http3.NewCapsuleParser(str)
+	for {
+		ct, r, err := parser.Next()
+		if err != nil {
+			return err
+		}
+		handler, ok := h.handlers[ct]
+		if !ok {
+			handler = h.unknown
+		}
+		if handler == nil {
+			log.Printf("skipping capsule of type %d", ct)
+		} else if err := handler(ct, r); err != nil {
+			return &CapsuleError{Type: ct, Err: err}
+		}
+		// discard the part of the capsule value that the handler didn't read
+		if err := r.Discard(); err != nil {
+			return err
+		}
+	}
+}
+
+// abortOnCapsuleError aborts the request stream if reading capsules failed because of a CapsuleError.
+func abortOnCapsuleError(str interface {
+	CancelRead(quic.StreamErrorCode)
+	CancelWrite(quic.StreamErrorCode)
+}, err error,
+) {
+	var capsuleErr *CapsuleError
+	if errors.As(err, &capsuleErr) {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeMessageError))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeMessageError))
+	}
+}
+
+// A capsuleWriter serializes writing capsules to the request stream.
+type capsuleWriter struct {
+	mx sync.Mutex
+	w  io.Writer
+}
+
+func (w *capsuleWriter) writeCapsule(ct http3.CapsuleType, value []byte) error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return writeCapsule(w.w, ct, value)
+}
+
+func writeCapsule(w io.Writer, ct http3.CapsuleType, value []byte) error {
+	var buf bytes.Buffer
+	if err := http3.WriteCapsule(&buf, ct, value); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
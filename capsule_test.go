@@ -0,0 +1,160 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	capsuleTypePing http3.CapsuleType = 0x1337
+	capsuleTypePong http3.CapsuleType = 0x1338
+)
+
+// pongHandler returns a handler that responds to every ping capsule with a pong capsule of the same value.
+func pongHandler(proxy *masque.Proxy, pongType http3.CapsuleType) *masque.Handler {
+	return &masque.Handler{
+		Proxy: proxy,
+		Authorize: func(_ http.ResponseWriter, r *masque.ProxyRequest) bool {
+			r.HandleCapsule(capsuleTypePing, func(_ http3.CapsuleType, rd io.Reader) error {
+				value, err := io.ReadAll(rd)
+				if err != nil {
+					return err
+				}
+				return r.SendCapsule(pongType, value)
+			})
+			return true
+		},
+	}
+}
+
+func TestCapsules(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	template := runHandler(t, pongHandler(&masque.Proxy{}, capsuleTypePong))
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+	require.NoError(t, err)
+	pongs := make(chan string, 2)
+	req.HandleCapsule(capsuleTypePong, func(_ http3.CapsuleType, r io.Reader) error {
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		pongs <- string(value)
+		return nil
+	})
+	conn, _, err := tr.Dial(req)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, msg := range []string{"foo", "bar"} {
+		require.NoError(t, conn.SendCapsule(capsuleTypePing, []byte(msg)))
+		select {
+		case pong := <-pongs:
+			require.Equal(t, msg, pong)
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	}
+	// sending capsules doesn't interfere with sending datagrams
+	checkEcho(t, conn, "baz")
+}
+
+func TestInvalidNextHop(t *testing.T) {
+	// the type of the next-hop capsule sent by the proxy when failing over
+	const capsuleTypeNextHop http3.CapsuleType = 0x2b7a4c0f
+
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	template := runHandler(t, pongHandler(&masque.Proxy{}, capsuleTypeNextHop))
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+	require.NoError(t, err)
+	conn, _, err := tr.Dial(req)
+	require.NoError(t, err)
+	defer conn.Close()
+	raddr := conn.RemoteAddr().String()
+
+	require.NoError(t, conn.SendCapsule(capsuleTypePing, []byte("foobar")))
+	require.NoError(t, conn.SendCapsule(capsuleTypePing, make([]byte, 100)))
+	// Capsules are processed in order, so once the valid next-hop is applied,
+	// the invalid ones were ignored without closing the flow.
+	require.NoError(t, conn.SendCapsule(capsuleTypePing, []byte("192.0.2.1:443")))
+	require.Eventually(t, func() bool {
+		return conn.RemoteAddr().String() != raddr
+	}, scaleDuration(time.Second), scaleDuration(5*time.Millisecond))
+	require.Equal(t, "192.0.2.1:443", conn.RemoteAddr().String())
+}
+
+func TestUnknownCapsules(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+
+	t.Run("rejected by the client", func(t *testing.T) {
+		const unknownType http3.CapsuleType = 0x42
+		template := runHandler(t, pongHandler(&masque.Proxy{}, unknownType))
+		req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+		require.NoError(t, err)
+		req.HandleUnknownCapsules(func(http3.CapsuleType, io.Reader) error { return masque.ErrUnknownCapsule })
+		conn, _, err := tr.Dial(req)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.SendCapsule(capsuleTypePing, []byte("foo")))
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+		_, _, err = conn.ReadFrom(make([]byte, 100))
+		var capsuleErr *masque.CapsuleError
+		require.ErrorAs(t, err, &capsuleErr)
+		require.Equal(t, unknownType, capsuleErr.Type)
+		require.ErrorIs(t, err, masque.ErrUnknownCapsule)
+	})
+
+	t.Run("rejected by the proxy", func(t *testing.T) {
+		records := make(chan *masque.FlowRecord, 1)
+		template := runHandler(t, &masque.Handler{
+			Proxy: &masque.Proxy{AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+			Authorize: func(_ http.ResponseWriter, r *masque.ProxyRequest) bool {
+				r.HandleUnknownCapsules(func(http3.CapsuleType, io.Reader) error { return masque.ErrUnknownCapsule })
+				return true
+			},
+		})
+		req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+		require.NoError(t, err)
+		conn, _, err := tr.Dial(req)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.SendCapsule(capsuleTypePing, []byte("foo")))
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+		_, _, err = conn.ReadFrom(make([]byte, 100))
+		var streamErr *quic.StreamError
+		require.ErrorAs(t, err, &streamErr)
+		require.Equal(t, quic.StreamErrorCode(http3.ErrCodeMessageError), streamErr.ErrorCode)
+
+		select {
+		case rec := <-records:
+			require.Equal(t, "masque: processing capsule of type 0x1337 failed: unknown capsule type", rec.CloseReason)
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	})
+}
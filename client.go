@@ -1,24 +1,228 @@
 package masque
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"slices"
+	"sync"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
-
-	"github.com/dunglas/httpsfv"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrClientConnClosed is returned when dialing on a [ClientConn] that was closed, or that is shutting down.
+var ErrClientConnClosed = errors.New("masque: client connection closed")
+
+// ErrGoAway is returned when dialing on a [ClientConn] after the proxy started a graceful shutdown by sending a GOAWAY frame.
+// Existing proxied connections continue to work.
+// The request can be retried on a new connection to the proxy.
+var ErrGoAway = errors.New("masque: proxy is going away")
+
+// FlowInfo describes a proxied connection dialed on a [ClientConn].
+type FlowInfo struct {
+	// Protocol is the protocol of the Extended CONNECT request, for example [ProtocolConnectUDP].
+	Protocol string
+	// Target is the target of the request. It is empty for CONNECT-ETHERNET.
+	Target string
+	// StreamID is the ID of the request stream.
+	StreamID quic.StreamID
+}
+
 // A ClientConn represents a connection to a single proxy server.
 // Multiple proxied connections can be established over a single ClientConn.
 type ClientConn struct {
 	conn       *quic.Conn
 	clientConn *http3.ClientConn
+
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+
+	counters connCounters // aggregated over all proxied connections
+
+	// initialMaxDatagramSize is the maximum QUIC datagram payload size when the ClientConn was created,
+	// before Path MTU Discovery increased the packet size.
+	initialMaxDatagramSize int
+
+	credentials CredentialsProvider
+	authCache   *authCache // shared by all ClientConns created by the same Transport
+
+	mx      sync.Mutex
+	closing bool // set by Close and Shutdown
+	goAway  bool // set once the proxy sent a GOAWAY frame
+	flows   map[quic.StreamID]FlowInfo
+	drained chan struct{} // closed once closing is set and no flows are left
+}
+
+func newClientConn(conn *quic.Conn, clientConn *http3.ClientConn, tracer trace.Tracer, propagator propagation.TextMapPropagator) *ClientConn {
+	c := &ClientConn{
+		conn:       conn,
+		clientConn: clientConn,
+		tracer:     tracer,
+		propagator: propagator,
+		flows:      make(map[quic.StreamID]FlowInfo),
+		drained:    make(chan struct{}),
+
+		initialMaxDatagramSize: maxDatagramSize(conn),
+	}
+	// Once the QUIC connection is closed, no proxied connection is active anymore.
+	context.AfterFunc(conn.Context(), func() {
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		clear(c.flows)
+		c.maybeDrainedLocked()
+	})
+	return c
+}
+
+// Context returns a context that is cancelled when the QUIC connection to the proxy is closed.
+// The reason is available using [context.Cause].
+func (c *ClientConn) Context() context.Context {
+	return c.conn.Context()
+}
+
+// Done returns a channel that is closed when the QUIC connection to the proxy is closed.
+func (c *ClientConn) Done() <-chan struct{} {
+	return c.conn.Context().Done()
+}
+
+// Flows returns the active proxied connections, ordered by stream ID.
+// A proxied connection is active until it is closed, or (for CONNECT-UDP and CONNECT-ETHERNET)
+// until the proxy closes the request stream.
+func (c *ClientConn) Flows() []FlowInfo {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	flows := make([]FlowInfo, 0, len(c.flows))
+	for _, f := range c.flows {
+		flows = append(flows, f)
+	}
+	slices.SortFunc(flows, func(a, b FlowInfo) int { return cmp.Compare(a.StreamID, b.StreamID) })
+	return flows
+}
+
+// Close closes the QUIC connection to the proxy, and with it all proxied connections.
+// Dialing fails with [ErrClientConnClosed] afterwards.
+func (c *ClientConn) Close() error {
+	c.mx.Lock()
+	c.closing = true
+	c.mx.Unlock()
+	return c.conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+}
+
+// Shutdown gracefully closes the connection to the proxy.
+// Dialing fails with [ErrClientConnClosed] once Shutdown was called.
+// Shutdown waits until all proxied connections are closed, and then closes the QUIC connection.
+// If the context is cancelled first, the QUIC connection is closed immediately,
+// terminating the remaining proxied connections, and the context's error is returned.
+func (c *ClientConn) Shutdown(ctx context.Context) error {
+	c.mx.Lock()
+	c.closing = true
+	c.maybeDrainedLocked()
+	c.mx.Unlock()
+
+	select {
+	case <-c.drained:
+		return c.Close()
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
+
+// dialErr returns the error for dial attempts, if new proxied connections can't be dialed.
+func (c *ClientConn) dialErr() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closing {
+		return ErrClientConnClosed
+	}
+	if c.goAway {
+		return ErrGoAway
+	}
+	return nil
+}
+
+// addFlow tracks a new proxied connection.
+// It fails if the ClientConn was closed while the request was sent.
+func (c *ClientConn) addFlow(info FlowInfo) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closing {
+		return ErrClientConnClosed
+	}
+	c.flows[info.StreamID] = info
+	return nil
+}
+
+func (c *ClientConn) removeFlow(id quic.StreamID) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	delete(c.flows, id)
+	c.maybeDrainedLocked()
+}
+
+func (c *ClientConn) maybeDrainedLocked() {
+	if !c.closing || len(c.flows) > 0 {
+		return
+	}
+	select {
+	case <-c.drained:
+	default:
+		close(c.drained)
+	}
+}
+
+// goingAway says if opening a request stream failed because the proxy sent a GOAWAY frame.
+// The http3 package doesn't export the error it returns in that case.
+// Other than that, opening a request stream only fails if the context is done,
+// or if the QUIC connection was closed, and all QUIC connection errors wrap net.ErrClosed.
+// Once a GOAWAY frame was received, http3 returns its error for all new request streams,
+// even after it closed the QUIC connection (which it does as soon as there are no active requests).
+func goingAway(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == nil && !errors.Is(err, net.ErrClosed)
+}
+
+// handleGoAway is called when opening a request stream failed because of a GOAWAY frame.
+// All further dial attempts fail with ErrGoAway.
+func (c *ClientConn) handleGoAway() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closing {
+		return ErrClientConnClosed
+	}
+	c.goAway = true
+	return ErrGoAway
+}
+
+// Migrate migrates the connection to the proxy to a new network path, using QUIC connection migration.
+// This is useful when the client's network changes, for example when a mobile client switches from Wi-Fi to cellular.
+// The transport is used to send and receive packets on the new path, usually bound to the new network interface.
+// The new path is probed before switching to it.
+// All proxied connections continue to work after the migration.
+// The proxy only switches to the new path after validating it, so the old path should
+// remain usable for a short while after Migrate returns.
+//
+// The returned path can be closed after migrating to another path.
+func (c *ClientConn) Migrate(ctx context.Context, tr *quic.Transport) (*quic.Path, error) {
+	path, err := c.conn.AddPath(tr)
+	if err != nil {
+		return nil, fmt.Errorf("masque: failed to add path: %w", err)
+	}
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		return nil, fmt.Errorf("masque: probing path failed: %w", err)
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		return nil, fmt.Errorf("masque: switching path failed: %w", err)
+	}
+	return path, nil
 }
 
 // Dial dials a proxied connection to a target server over the proxy connection.
@@ -27,6 +231,26 @@ func (c *ClientConn) Dial(req *Request) (*Conn, *http.Response, error) {
 }
 
 func (c *ClientConn) dial(req *Request, closeConn func() error) (*Conn, *http.Response, error) {
+	if req.req.Proto != requestProtocol {
+		return nil, nil, errors.New("masque: not a CONNECT-UDP request")
+	}
+	rstr, rsp, err := c.connect(req)
+	if err != nil {
+		return nil, rsp, err
+	}
+	var raddr net.Addr
+	if udpAddr := nextHopAddr(rsp); udpAddr != nil {
+		raddr = udpAddr
+	} else {
+		raddr = net.Addr(masqueAddr{req.target})
+	}
+	return newProxiedConn(c, rstr, masqueAddr{c.conn.LocalAddr().String()}, raddr, req.capsuleHandlers, closeConn), rsp, nil
+}
+
+// connect sends the Extended CONNECT request, and reads the response.
+// The returned stream is only valid if the proxy accepted the request.
+// The proxied connection is then tracked until it is removed using removeFlow.
+func (c *ClientConn) connect(req *Request) (*http3.RequestStream, *http.Response, error) {
 	httpReq := req.req
 	if httpReq.URL == nil {
 		return nil, nil, errors.New("masque: request URL is nil")
@@ -34,23 +258,113 @@ func (c *ClientConn) dial(req *Request, closeConn func() error) (*Conn, *http.Re
 	if httpReq.Host == "" && httpReq.URL.Host == "" {
 		return nil, nil, errors.New("masque: request needs a host")
 	}
+	if err := c.dialErr(); err != nil {
+		return nil, nil, err
+	}
+
+	ctx, span := c.tracer.Start(httpReq.Context(), spanNameDial,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attrTarget.String(req.target),
+			attrURL.String(httpReq.URL.String()),
+			attrServerAddress.String(httpReq.Host),
+		),
+	)
+	// The trace context is added to a copy of the request, so that it can be dialed again.
+	httpReq = httpReq.Clone(ctx)
+	c.propagator.Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
+	rstr, rsp, err := c.sendAuthorizedRequest(ctx, httpReq)
+	if rsp != nil {
+		span.SetAttributes(attrStatusCode.Int(rsp.StatusCode))
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, rsp, err
+	}
+	if err := c.addFlow(FlowInfo{Protocol: httpReq.Proto, Target: req.target, StreamID: rstr.StreamID()}); err != nil {
+		rstr.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		rstr.CancelWrite(quic.StreamErrorCode(http3.ErrCodeNoError))
+		return nil, rsp, err
+	}
+	return rstr, rsp, nil
+}
+
+// sendAuthorizedRequest sends the request, adding cached credentials.
+// If the proxy requires authentication, the request is sent again, using credentials from the CredentialsProvider.
+func (c *ClientConn) sendAuthorizedRequest(ctx context.Context, httpReq *http.Request) (*http3.RequestStream, *http.Response, error) {
+	if c.credentials == nil {
+		return c.sendRequest(ctx, httpReq)
+	}
+	proxy := httpReq.URL.Host
+	cached := c.authCache.get(proxy)
+	if cached != "" && httpReq.Header.Get("Proxy-Authorization") == "" {
+		httpReq.Header.Set("Proxy-Authorization", cached)
+	} else {
+		cached = ""
+	}
+	rstr, rsp, err := c.sendRequest(ctx, httpReq)
+	if rsp == nil || rsp.StatusCode != http.StatusProxyAuthRequired {
+		return rstr, rsp, err
+	}
+	if cached != "" {
+		c.authCache.remove(proxy, cached)
+	}
+	challenges, parseErr := ParseProxyAuthenticate(rsp.Header)
+	if parseErr != nil {
+		return nil, rsp, errors.Join(err, parseErr)
+	}
+	credCtx, span := c.tracer.Start(ctx, spanNameGetCredentials)
+	authorization, reusable, credErr := c.credentials.ProxyCredentials(credCtx, &AuthRequest{
+		Proxy:      proxy,
+		Challenges: challenges,
+		Response:   rsp,
+		TLS:        c.conn.ConnectionState().TLS,
+	})
+	endSpan(span, credErr)
+	if credErr != nil {
+		return nil, rsp, errors.Join(err, fmt.Errorf("masque: obtaining credentials failed: %w", credErr))
+	}
 
+	httpReq = httpReq.Clone(ctx)
+	httpReq.Header.Set("Proxy-Authorization", authorization)
+	rstr, rsp, err = c.sendRequest(ctx, httpReq)
+	if err == nil && reusable {
+		c.authCache.set(proxy, authorization)
+	}
+	return rstr, rsp, err
+}
+
+func (c *ClientConn) sendRequest(ctx context.Context, httpReq *http.Request) (*http3.RequestStream, *http.Response, error) {
+	_, span := c.tracer.Start(ctx, spanNameWaitForSettings)
 	select {
 	case <-httpReq.Context().Done():
-		return nil, nil, context.Cause(httpReq.Context())
+		err := context.Cause(httpReq.Context())
+		endSpan(span, err)
+		return nil, nil, err
 	case <-c.clientConn.Context().Done():
-		return nil, nil, context.Cause(c.clientConn.Context())
+		err := context.Cause(c.clientConn.Context())
+		endSpan(span, err)
+		return nil, nil, err
 	case <-c.clientConn.ReceivedSettings():
 	}
+	span.End()
 	settings := c.clientConn.Settings()
 	if !settings.EnableExtendedConnect {
 		return nil, nil, errors.New("masque: server didn't enable Extended CONNECT")
 	}
-	if !settings.EnableDatagrams {
+	// CONNECT-TCP doesn't use HTTP Datagrams.
+	if httpReq.Proto != ProtocolConnectTCP && !settings.EnableDatagrams {
 		return nil, nil, errors.New("masque: server didn't enable Datagrams")
 	}
 
+	_, span = c.tracer.Start(ctx, spanNameOpenStream)
 	rstr, err := c.clientConn.OpenRequestStream(httpReq.Context())
+	if goingAway(httpReq.Context(), err) {
+		err = c.handleGoAway()
+		endSpan(span, err)
+		return nil, nil, err
+	}
+	endSpan(span, err)
 	if err != nil {
 		return nil, nil, fmt.Errorf("masque: failed to open request stream: %w", err)
 	}
@@ -62,52 +376,53 @@ func (c *ClientConn) dial(req *Request, closeConn func() error) (*Conn, *http.Re
 			rstr.CancelWrite(quic.StreamErrorCode(http3.ErrCodeNoError))
 		}
 	}()
-	if err := rstr.SendRequestHeader(httpReq); err != nil {
+	_, span = c.tracer.Start(ctx, spanNameSendRequest)
+	err = rstr.SendRequestHeader(httpReq)
+	endSpan(span, err)
+	if err != nil {
 		return nil, nil, fmt.Errorf("masque: failed to send request: %w", err)
 	}
 	// TODO: optimistically return the connection
+	_, span = c.tracer.Start(ctx, spanNameReadResponse)
 	rsp, err := rstr.ReadResponse()
+	endSpan(span, err)
 	if err != nil {
 		return nil, nil, fmt.Errorf("masque: failed to read response: %w", err)
 	}
 	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
-		return nil, rsp, fmt.Errorf("masque: server responded with %d", rsp.StatusCode)
-	}
-
-	var raddr net.Addr
-	if udpAddr := nextHopAddr(rsp); udpAddr != nil {
-		raddr = udpAddr
-	} else {
-		raddr = net.Addr(masqueAddr{req.target})
+		proxyStatus, err := ParseProxyStatus(rsp.Header)
+		if err != nil {
+			log.Printf("bad Proxy-Status: %v", err)
+		}
+		return nil, rsp, &ProxyError{StatusCode: rsp.StatusCode, ProxyStatus: proxyStatus}
 	}
-
 	keepStream = true
-	return newProxiedConn(rstr, masqueAddr{c.conn.LocalAddr().String()}, raddr, closeConn), rsp, nil
+	return rstr, rsp, nil
 }
 
 // Extract the Proxy-Status next-hop value as a UDPAddr.
+// The next-hop is reported by the intermediary closest to the target.
 func nextHopAddr(rsp *http.Response) *net.UDPAddr {
-	proxyStatusVals := rsp.Header.Values("Proxy-Status")
-	if len(proxyStatusVals) == 0 {
-		return nil
-	}
-	proxyStatus, err := httpsfv.UnmarshalItem(proxyStatusVals)
+	proxyStatus, err := ParseProxyStatus(rsp.Header)
 	if err != nil {
 		log.Printf("bad Proxy-Status: %v", err)
 		return nil
 	}
-	nextHop, ok := proxyStatus.Params.Get("next-hop")
-	if !ok {
-		return nil
-	}
-	nextHopStr, ok := nextHop.(string)
-	if !ok {
-		log.Printf("non-string nextHop value")
-		return nil
+	var nextHopStr string
+	for _, s := range proxyStatus {
+		if s.NextHop != "" {
+			nextHopStr = s.NextHop
+			break
+		}
 	}
 	if nextHopStr == "" {
 		return nil
 	}
+	return parseNextHop(nextHopStr)
+}
+
+// parseNextHop parses a next-hop value, as sent in the Proxy-Status header field and in the next-hop capsule.
+func parseNextHop(nextHopStr string) *net.UDPAddr {
 	host, port, err := net.SplitHostPort(nextHopStr)
 	if err != nil {
 		log.Printf("bad next-hop value: %v", err)
@@ -0,0 +1,275 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+func dialClientConn(t *testing.T, template *uritemplate.Template) *masque.ClientConn {
+	t.Helper()
+	qconn, err := quic.DialAddr(
+		context.Background(),
+		proxyAddr(t, template).String(),
+		&tls.Config{ServerName: "localhost", RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true},
+	)
+	require.NoError(t, err)
+	cconn, err := (&masque.Transport{}).NewClientConn(qconn)
+	require.NoError(t, err)
+	t.Cleanup(func() { cconn.Close() })
+	return cconn
+}
+
+func dialUDP(t *testing.T, cconn *masque.ClientConn, template *uritemplate.Template, target string) (*masque.Conn, error) {
+	t.Helper()
+	req, err := masque.NewRequest(context.Background(), template, target)
+	require.NoError(t, err)
+	conn, _, err := cconn.Dial(req)
+	return conn, err
+}
+
+func TestClientConnFlows(t *testing.T) {
+	udpServer := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer udpServer.Close()
+	tcpServer := runTCPEchoServer(t)
+
+	template := runHandler(t, &masque.Handler{Proxy: &masque.Proxy{AllowTCP: true}})
+	cconn := dialClientConn(t, template)
+	require.Empty(t, cconn.Flows())
+
+	udpConn, err := dialUDP(t, cconn, template, udpServer.LocalAddr().String())
+	require.NoError(t, err)
+	defer udpConn.Close()
+	req, err := masque.NewTCPRequest(context.Background(), template, tcpServer.Addr().String())
+	require.NoError(t, err)
+	tcpConn, _, err := cconn.DialTCP(req)
+	require.NoError(t, err)
+	defer tcpConn.Close()
+
+	flows := cconn.Flows()
+	require.Len(t, flows, 2)
+	require.Equal(t, masque.ProtocolConnectUDP, flows[0].Protocol)
+	require.Equal(t, udpServer.LocalAddr().String(), flows[0].Target)
+	require.Equal(t, masque.ProtocolConnectTCP, flows[1].Protocol)
+	require.Equal(t, tcpServer.Addr().String(), flows[1].Target)
+	require.NotEqual(t, flows[0].StreamID, flows[1].StreamID)
+
+	require.NoError(t, udpConn.Close())
+	require.Equal(t, []masque.FlowInfo{flows[1]}, cconn.Flows())
+	require.NoError(t, tcpConn.Close())
+	require.Empty(t, cconn.Flows())
+
+	select {
+	case <-cconn.Done():
+		t.Fatal("connection unexpectedly closed")
+	default:
+	}
+	require.NoError(t, cconn.Close())
+	select {
+	case <-cconn.Done():
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+	require.Error(t, context.Cause(cconn.Context()))
+	_, err = dialUDP(t, cconn, template, udpServer.LocalAddr().String())
+	require.ErrorIs(t, err, masque.ErrClientConnClosed)
+}
+
+func TestClientConnShutdown(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	target := remoteServerConn.LocalAddr().String()
+	template := runHandler(t, &masque.Handler{})
+
+	t.Run("waiting for flows", func(t *testing.T) {
+		cconn := dialClientConn(t, template)
+		conn, err := dialUDP(t, cconn, template, target)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		errChan := make(chan error, 1)
+		go func() { errChan <- cconn.Shutdown(context.Background()) }()
+		require.Eventually(t, func() bool {
+			_, err := dialUDP(t, cconn, template, target)
+			return err == masque.ErrClientConnClosed
+		}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+		// existing flows continue to work
+		checkEcho(t, conn, "foobar")
+		select {
+		case <-errChan:
+			t.Fatal("Shutdown returned before the flow was closed")
+		case <-time.After(scaleDuration(50 * time.Millisecond)):
+		}
+
+		require.NoError(t, conn.Close())
+		select {
+		case err := <-errChan:
+			require.NoError(t, err)
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+		select {
+		case <-cconn.Done():
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		cconn := dialClientConn(t, template)
+		conn, err := dialUDP(t, cconn, template, target)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+		defer cancel()
+		require.ErrorIs(t, cconn.Shutdown(ctx), context.DeadlineExceeded)
+		select {
+		case <-cconn.Done():
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+		_, _, err = conn.ReadFrom(make([]byte, 1500))
+		require.Error(t, err)
+	})
+}
+
+func TestClientConnGoAway(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	target := remoteServerConn.LocalAddr().String()
+
+	serverConn := newUDPConnLocalhost(t)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", serverConn.LocalAddr().(*net.UDPAddr).Port))
+	router, err := masque.NewTemplateRouter(template)
+	require.NoError(t, err)
+	handler := &masque.Handler{Router: router}
+	defer handler.Close()
+	server := &http3.Server{TLSConfig: tlsConf, EnableDatagrams: true, Handler: handler}
+	defer server.Close()
+	go server.Serve(serverConn)
+
+	cconn := dialClientConn(t, template)
+	conn, err := dialUDP(t, cconn, template, target)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The server sends a GOAWAY frame, and waits for the client to close the connection.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		server.Shutdown(context.Background())
+	}()
+	require.Eventually(t, func() bool {
+		_, err := dialUDP(t, cconn, template, target)
+		return err == masque.ErrGoAway
+	}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+	// existing flows continue to work
+	checkEcho(t, conn, "foobar")
+
+	require.NoError(t, conn.Close())
+	select {
+	case <-cconn.Done():
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+	_, err = dialUDP(t, cconn, template, target)
+	require.ErrorIs(t, err, masque.ErrGoAway)
+	select {
+	case <-shutdownDone:
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+}
+
+// When the proxy's stream limit is reached, opening the request stream blocks until the context is done.
+// This is not the same as receiving a GOAWAY frame.
+func TestClientConnStreamLimit(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	target := remoteServerConn.LocalAddr().String()
+
+	serverConn := newUDPConnLocalhost(t)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", serverConn.LocalAddr().(*net.UDPAddr).Port))
+	router, err := masque.NewTemplateRouter(template)
+	require.NoError(t, err)
+	handler := &masque.Handler{Router: router}
+	defer handler.Close()
+	server := &http3.Server{
+		TLSConfig:       tlsConf,
+		EnableDatagrams: true,
+		QUICConfig:      &quic.Config{MaxIncomingStreams: 1},
+		Handler:         handler,
+	}
+	defer server.Close()
+	go server.Serve(serverConn)
+
+	cconn := dialClientConn(t, template)
+	conn, err := dialUDP(t, cconn, template, target)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+	defer cancel()
+	req, err := masque.NewRequest(ctx, template, target)
+	require.NoError(t, err)
+	_, _, err = cconn.Dial(req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotErrorIs(t, err, masque.ErrGoAway)
+
+	// once the first flow is closed, the stream limit is increased
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		conn, err := dialUDP(t, cconn, template, target)
+		if err != nil {
+			require.NotErrorIs(t, err, masque.ErrGoAway)
+			return false
+		}
+		conn.Close()
+		return true
+	}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+}
+
+func TestClientConnLocalClose(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	target := remoteServerConn.LocalAddr().String()
+
+	template := runHandler(t, &masque.Handler{})
+	qconn, err := quic.DialAddr(
+		context.Background(),
+		proxyAddr(t, template).String(),
+		&tls.Config{ServerName: "localhost", RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true},
+	)
+	require.NoError(t, err)
+	cconn, err := (&masque.Transport{}).NewClientConn(qconn)
+	require.NoError(t, err)
+	defer cconn.Close()
+	conn, err := dialUDP(t, cconn, template, target)
+	require.NoError(t, err)
+	conn.Close()
+
+	// Closing the QUIC connection using H3_NO_ERROR is not the same as receiving a GOAWAY frame.
+	require.NoError(t, qconn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), ""))
+	for range 2 {
+		_, err = dialUDP(t, cconn, template, target)
+		require.Error(t, err)
+		require.NotErrorIs(t, err, masque.ErrGoAway)
+		var appErr *quic.ApplicationError
+		require.ErrorAs(t, err, &appErr)
+		require.False(t, appErr.Remote)
+		require.Equal(t, quic.ApplicationErrorCode(http3.ErrCodeNoError), appErr.ErrorCode)
+	}
+}
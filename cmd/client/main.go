@@ -9,9 +9,11 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/quic-go/masque-go"
 
@@ -21,8 +23,13 @@ import (
 )
 
 func main() {
-	var proxyURITemplate string
+	var proxyURITemplate, dnsServer, proxyUser, proxyToken string
+	var useTCP bool
 	flag.StringVar(&proxyURITemplate, "t", "", "URI template")
+	flag.StringVar(&proxyUser, "proxy-user", "", "user:password, used if the proxy requires Basic authentication")
+	flag.StringVar(&proxyToken, "proxy-token", "", "token, used if the proxy requires Bearer authentication")
+	flag.StringVar(&dnsServer, "dns", "", "DNS server (ip:port) used to resolve the target through the proxy. If unset, the proxy resolves the target.")
+	flag.BoolVar(&useTCP, "tcp", false, "use CONNECT-TCP, and fetch the URL using HTTP/1.1 or HTTP/2 instead of HTTP/3")
 	flag.Parse()
 	if proxyURITemplate == "" {
 		flag.Usage()
@@ -33,38 +40,85 @@ func main() {
 		log.Fatal("usage: client -t <template> <url>")
 	}
 
-	tr := masque.Transport{
-		QUICConfig: &quic.Config{
-			EnableDatagrams:   true,
-			InitialPacketSize: 1350,
-		},
-	}
+	template := uritemplate.MustNew(proxyURITemplate)
 	host, port, err := extractHostAndPort(urls[0])
 	if err != nil {
 		log.Fatalf("failed to parse url: %v", err)
 	}
 
-	hcl := &http.Client{
-		Transport: &http3.Transport{
-			Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
-				raddr, err := net.ResolveUDPAddr("udp", host+":"+strconv.Itoa(int(port)))
+	// All proxied connections, including those used for DNS, share a single connection to the proxy.
+	proxyURL, err := url.Parse(proxyURITemplate)
+	if err != nil {
+		log.Fatalf("failed to parse URI template: %v", err)
+	}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+	}
+	qconn, err := quic.DialAddr(
+		context.Background(),
+		proxyAddr,
+		&tls.Config{NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true, InitialPacketSize: 1350},
+	)
+	if err != nil {
+		log.Fatalf("dialing the proxy failed: %v", err)
+	}
+	tr := &masque.Transport{}
+	switch {
+	case proxyUser != "":
+		user, password, _ := strings.Cut(proxyUser, ":")
+		tr.CredentialsProvider = &masque.BasicCredentials{Username: user, Password: password}
+	case proxyToken != "":
+		tr.CredentialsProvider = &masque.BearerCredentials{Token: proxyToken}
+	}
+	cc, err := tr.NewClientConn(qconn)
+	if err != nil {
+		qconn.CloseWithError(0, "")
+		log.Fatalf("creating the client connection failed: %v", err)
+	}
+	defer cc.Close()
+
+	// Unless a DNS server is configured, the host name is sent to the proxy,
+	// and no DNS queries are sent outside of the tunnel.
+	dialer := &masque.QUICDialer{ClientConn: cc, Template: template}
+	if dnsServer != "" {
+		resolver := &masque.DNSResolver{ClientConn: cc, Template: template, Server: dnsServer}
+		defer resolver.Close()
+		dialer.Resolver = resolver
+	}
+	resolveTarget := func(ctx context.Context) (string, error) {
+		if dialer.Resolver == nil {
+			return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+		}
+		ips, err := dialer.Resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return "", err
+		}
+		return netip.AddrPortFrom(ips[0], port).String(), nil
+	}
+
+	hcl := &http.Client{Transport: &http3.Transport{Dial: dialer.DialEarly}}
+	if useTCP {
+		hcl.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				target, err := resolveTarget(ctx)
 				if err != nil {
 					return nil, err
 				}
-				req, err := masque.NewRequest(ctx, uritemplate.MustNew(proxyURITemplate), raddr.String())
+				req, err := masque.NewTCPRequest(ctx, template, target)
 				if err != nil {
 					return nil, err
 				}
-				pconn, _, err := tr.Dial(req)
+				conn, _, err := cc.DialTCP(req)
 				if err != nil {
-					log.Fatal("dialing MASQUE failed:", err)
+					return nil, fmt.Errorf("dialing CONNECT-TCP failed: %w", err)
 				}
-				log.Printf("dialed connection: %s <-> %s", pconn.LocalAddr(), raddr)
-				quicConf = quicConf.Clone()
-				quicConf.DisablePathMTUDiscovery = true
-				return quic.DialEarly(ctx, pconn, raddr, tlsConf, quicConf)
+				log.Printf("dialed TCP connection: %s <-> %s", conn.LocalAddr(), conn.RemoteAddr())
+				return conn, nil
 			},
-		},
+			ForceAttemptHTTP2: true,
+		}
 	}
 	rsp, err := hcl.Get(urls[0])
 	if err != nil {
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCertReloadInterval = 10 * time.Second
+
+// certManager serves TLS certificates, selected by SNI.
+// It watches the certificate and key files, and atomically swaps certificates when the files change.
+// Connections that were established with the old certificate are not affected.
+type certManager struct {
+	mx      sync.Mutex
+	entries []*certEntry
+
+	certs atomic.Pointer[certSet]
+}
+
+type certEntry struct {
+	conf     certConfig
+	modTimes [2]time.Time // of the certificate and the key file
+	cert     *tls.Certificate
+}
+
+// certSet is immutable.
+type certSet struct {
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// loadCertificates loads the certificates, so that they can be passed to certManager.Set.
+func loadCertificates(confs []certConfig) ([]*certEntry, error) {
+	if len(confs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	entries := make([]*certEntry, 0, len(confs))
+	for _, conf := range confs {
+		e := &certEntry{conf: conf}
+		if err := e.load(); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Set replaces all previously loaded certificates.
+// The first certificate is used if no certificate matches the SNI.
+func (m *certManager) Set(entries []*certEntry) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.entries = entries
+	m.update()
+}
+
+// Watch checks the certificate files for changes until stop is closed.
+func (m *certManager) Watch(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = defaultCertReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.reloadChanged()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (m *certManager) reloadChanged() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	var changed bool
+	for _, e := range m.entries {
+		modTimes, err := e.stat()
+		if err != nil {
+			slog.Error("failed to check certificate", "cert", e.conf.Cert, "error", err)
+			continue
+		}
+		if modTimes == e.modTimes {
+			continue
+		}
+		// The certificate and the key might not have been updated at the same time.
+		// If they don't match, we'll retry when checking the next time.
+		if err := e.load(); err != nil {
+			slog.Error("failed to reload certificate, keeping the current certificate", "cert", e.conf.Cert, "error", err)
+			continue
+		}
+		slog.Info("reloaded certificate", "cert", e.conf.Cert, "not_after", e.cert.Leaf.NotAfter)
+		changed = true
+	}
+	if changed {
+		m.update()
+	}
+}
+
+// update must be called with mx held.
+func (m *certManager) update() {
+	set := &certSet{byName: make(map[string]*tls.Certificate)}
+	for _, e := range m.entries {
+		if set.fallback == nil {
+			set.fallback = e.cert
+		}
+		names := e.conf.ServerNames
+		if len(names) == 0 {
+			names = e.cert.Leaf.DNSNames
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// If multiple certificates are configured for the same name, the first one wins.
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = e.cert
+			}
+		}
+	}
+	m.certs.Store(set)
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (m *certManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := m.certs.Load()
+	if set == nil {
+		return nil, errors.New("no certificates loaded")
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := set.byName[name]; ok {
+		return cert, nil
+	}
+	// try a wildcard certificate
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := set.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return set.fallback, nil
+}
+
+func (e *certEntry) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, f := range []string{e.conf.Cert, e.conf.Key} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (e *certEntry) load() error {
+	modTimes, err := e.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(e.conf.Cert, e.conf.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %w", e.conf.Cert, err)
+	}
+	e.cert = &cert
+	e.modTimes = modTimes
+	return nil
+}
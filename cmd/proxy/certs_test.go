@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateSelection(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert := writeCert(t, dir, "default", "proxy.example")
+	wildcardCert := writeCert(t, dir, "wildcard", "*.example.com")
+	exactCert := writeCert(t, dir, "exact", "www.example.com")
+	namedCert := writeCert(t, dir, "named", "unused.example")
+	namedCert.ServerNames = []string{"proxy.other.example"}
+
+	entries, err := loadCertificates([]certConfig{defaultCert, wildcardCert, exactCert, namedCert})
+	require.NoError(t, err)
+	var m certManager
+	m.Set(entries)
+
+	for _, tc := range []struct {
+		serverName string
+		expected   certConfig
+	}{
+		{serverName: "proxy.example", expected: defaultCert},
+		{serverName: "www.example.com", expected: exactCert},
+		{serverName: "WWW.Example.COM.", expected: exactCert},
+		{serverName: "foo.example.com", expected: wildcardCert},
+		{serverName: "foo.bar.example.com", expected: defaultCert}, // wildcards only match a single label
+		{serverName: "example.com", expected: defaultCert},
+		{serverName: "proxy.other.example", expected: namedCert},
+		{serverName: "unused.example", expected: defaultCert}, // ServerNames take precedence over the DNS names
+		{serverName: "", expected: defaultCert},
+	} {
+		t.Run(tc.serverName, func(t *testing.T) {
+			cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: tc.serverName})
+			require.NoError(t, err)
+			expected, err := tls.LoadX509KeyPair(tc.expected.Cert, tc.expected.Key)
+			require.NoError(t, err)
+			require.Equal(t, expected.Certificate, cert.Certificate)
+		})
+	}
+}
+
+func TestCertificateSelectionNoCertificates(t *testing.T) {
+	var m certManager
+	_, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "proxy.example"})
+	require.EqualError(t, err, "no certificates loaded")
+
+	_, err = loadCertificates(nil)
+	require.EqualError(t, err, "no certificates")
+	_, err = loadCertificates([]certConfig{{Cert: "missing.pem", Key: "missing-key.pem"}})
+	require.Error(t, err)
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	conf := writeCert(t, dir, "cert", "proxy.example")
+	entries, err := loadCertificates([]certConfig{conf})
+	require.NoError(t, err)
+	var m certManager
+	m.Set(entries)
+	hello := &tls.ClientHelloInfo{ServerName: "proxy.example"}
+	oldCert, err := m.GetCertificate(hello)
+	require.NoError(t, err)
+
+	// nothing changed
+	m.reloadChanged()
+	cert, err := m.GetCertificate(hello)
+	require.NoError(t, err)
+	require.Same(t, oldCert, cert)
+
+	// The certificate was renewed.
+	// Make sure that the modification time changes, even on file systems with a coarse resolution.
+	writeCert(t, dir, "cert", "proxy.example")
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(conf.Cert, future, future))
+	require.NoError(t, os.Chtimes(conf.Key, future, future))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Watch(10*time.Millisecond, stop)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	require.Eventually(t, func() bool {
+		cert, err := m.GetCertificate(hello)
+		require.NoError(t, err)
+		return cert != oldCert
+	}, time.Second, 10*time.Millisecond)
+	cert, err = m.GetCertificate(hello)
+	require.NoError(t, err)
+	expected, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	require.NoError(t, err)
+	require.Equal(t, expected.Certificate, cert.Certificate)
+}
+
+func TestCertificateReloadMismatchedKey(t *testing.T) {
+	dir := t.TempDir()
+	conf := writeCert(t, dir, "cert", "proxy.example")
+	entries, err := loadCertificates([]certConfig{conf})
+	require.NoError(t, err)
+	var m certManager
+	m.Set(entries)
+	hello := &tls.ClientHelloInfo{ServerName: "proxy.example"}
+	oldCert, err := m.GetCertificate(hello)
+	require.NoError(t, err)
+
+	// Only the certificate was updated so far, the key doesn't match.
+	// The current certificate is kept, and the files are loaded again once the key was updated.
+	newConf := writeCert(t, dir, "new", "proxy.example")
+	certPEM, err := os.ReadFile(newConf.Cert)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(conf.Cert, certPEM, 0o600))
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(conf.Cert, future, future))
+	m.reloadChanged()
+	cert, err := m.GetCertificate(hello)
+	require.NoError(t, err)
+	require.Same(t, oldCert, cert)
+
+	keyPEM, err := os.ReadFile(newConf.Key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(conf.Key, keyPEM, 0o600))
+	require.NoError(t, os.Chtimes(conf.Key, future, future))
+	m.reloadChanged()
+	cert, err = m.GetCertificate(hello)
+	require.NoError(t, err)
+	expected, err := tls.LoadX509KeyPair(newConf.Cert, newConf.Key)
+	require.NoError(t, err)
+	require.Equal(t, expected.Certificate, cert.Certificate)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// config is the configuration file of the proxy.
+//
+//	{
+//	  "listeners": [{"addr": "0.0.0.0:443"}, {"addr": "[::]:443"}],
+//	  "templates": ["https://proxy.example:443/masque?h={target_host}&p={target_port}"],
+//	  "tls": {
+//	    "cert": "cert.pem", "key": "key.pem",
+//	    "certificates": [{"cert": "other.pem", "key": "other-key.pem", "server_names": ["proxy.other.example"]}],
+//	    "reload_interval": "30s"
+//	  },
+//	  "acl": {"allow": ["0.0.0.0/0", "::/0"], "deny": ["10.0.0.0/8"], "ports": ["53", "443", "1024-65535"]},
+//	  "allow_tcp": true,
+//	  "auth": {"type": "bearer", "tokens": ["secret"]},
+//	  "limits": {"max_flows": 10000, "max_flows_per_client": 100},
+//	  "log": {"level": "info", "format": "json"},
+//	  "metrics": {"addr": "127.0.0.1:9090"},
+//	  "access_log": {"path": "access.log"}
+//	}
+//
+// Only CONNECT-UDP requests are proxied, unless allow_tcp is set.
+// Certificate files are watched for changes, and reloaded automatically.
+// On SIGHUP, the configuration file is reloaded. Changes to the templates, the TLS certificate,
+// the ACL, the authentication settings, the limits and the log level apply to new requests.
+// Existing flows are not affected. Changes to the listeners, the metrics address, the
+// certificate reload interval, the access log and allow_tcp require a restart.
+type config struct {
+	Listeners []listenerConfig `json:"listeners"`
+	Templates []string         `json:"templates"`
+	TLS       tlsConfig        `json:"tls"`
+	ACL       aclConfig        `json:"acl"`
+	AllowTCP  bool             `json:"allow_tcp"`
+	Auth      authConfig       `json:"auth"`
+	Limits    limitsConfig     `json:"limits"`
+	Log       logConfig        `json:"log"`
+	Metrics   metricsConfig    `json:"metrics"`
+	AccessLog accessLogConfig  `json:"access_log"`
+}
+
+type listenerConfig struct {
+	Addr string `json:"addr"`
+}
+
+type tlsConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// Certificates are additional certificates, selected by SNI.
+	Certificates []certConfig `json:"certificates"`
+	// ReloadInterval is the interval in which the certificate files are checked for changes.
+	ReloadInterval duration `json:"reload_interval"`
+}
+
+type certConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// ServerNames are the server names that the certificate is used for.
+	// Wildcards like *.example.com are supported.
+	// If empty, the DNS names of the certificate are used.
+	ServerNames []string `json:"server_names"`
+}
+
+// certificates returns all certificates. The first certificate is the default certificate.
+func (c *tlsConfig) certificates() []certConfig {
+	var certs []certConfig
+	if c.Cert != "" || c.Key != "" {
+		certs = append(certs, certConfig{Cert: c.Cert, Key: c.Key})
+	}
+	return append(certs, c.Certificates...)
+}
+
+// duration is a time.Duration that is encoded as a string in JSON, e.g. "30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+type aclConfig struct {
+	// Allow contains the prefixes that targets may be in. If empty, all addresses are allowed.
+	Allow []string `json:"allow"`
+	// Deny contains the prefixes that targets may not be in. It takes precedence over Allow.
+	Deny []string `json:"deny"`
+	// Ports contains the allowed target ports and port ranges (e.g. "1024-65535").
+	// If empty, all ports are allowed.
+	Ports []string `json:"ports"`
+}
+
+type authConfig struct {
+	// Type is "none", "bearer" or "basic".
+	Type string `json:"type"`
+	// Tokens are the bearer tokens, used for "bearer".
+	Tokens []string `json:"tokens"`
+	// Users maps user names to passwords, used for "basic".
+	Users map[string]string `json:"users"`
+}
+
+type limitsConfig struct {
+	MaxFlows          int `json:"max_flows"`
+	MaxFlowsPerClient int `json:"max_flows_per_client"`
+}
+
+type logConfig struct {
+	// Level is "debug", "info", "warn" or "error".
+	Level string `json:"level"`
+	// Format is "text" or "json".
+	Format string `json:"format"`
+}
+
+type metricsConfig struct {
+	// Addr is the address of the HTTP server serving metrics in the Prometheus text format on /metrics.
+	Addr string `json:"addr"`
+}
+
+type accessLogConfig struct {
+	// Path is the file that a JSON line is appended to for every flow. Use "-" for stdout.
+	Path string `json:"path"`
+}
+
+func loadConfig(filename string) (*config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var conf config
+	if err := dec.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	if len(conf.Listeners) == 0 {
+		return nil, errors.New("no listeners configured")
+	}
+	if len(conf.TLS.certificates()) == 0 {
+		return nil, errors.New("no TLS certificate configured")
+	}
+	return &conf, nil
+}
+
+// policy is the part of the configuration that can be changed at runtime.
+// The flows are counted by a FlowLimiter shared by all policies.
+type policy struct {
+	handler *masque.Handler
+	acl     *acl
+}
+
+func newPolicy(conf *config, proxy *masque.Proxy, flows *masque.FlowLimiter) (*policy, error) {
+	if len(conf.Templates) == 0 {
+		return nil, errors.New("no templates configured")
+	}
+	templates := make([]*uritemplate.Template, 0, len(conf.Templates))
+	for _, s := range conf.Templates {
+		t, err := uritemplate.New(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %s: %w", s, err)
+		}
+		templates = append(templates, t)
+	}
+	router, err := masque.NewTemplateRouter(templates...)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := newACL(&conf.ACL)
+	if err != nil {
+		return nil, err
+	}
+	authorize, err := newAuthorizer(&conf.Auth)
+	if err != nil {
+		return nil, err
+	}
+	return &policy{
+		handler: &masque.Handler{
+			Router:            router,
+			Proxy:             proxy,
+			Authorize:         authorize,
+			MaxFlows:          conf.Limits.MaxFlows,
+			MaxFlowsPerClient: conf.Limits.MaxFlowsPerClient,
+			FlowLimiter:       flows,
+		},
+		acl: acl,
+	}, nil
+}
+
+type portRange struct{ first, last uint16 }
+
+type acl struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	ports []portRange
+}
+
+func newACL(conf *aclConfig) (*acl, error) {
+	var a acl
+	for _, s := range conf.Allow {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACL: %w", err)
+		}
+		a.allow = append(a.allow, p)
+	}
+	for _, s := range conf.Deny {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACL: %w", err)
+		}
+		a.deny = append(a.deny, p)
+	}
+	for _, s := range conf.Ports {
+		first, last, isRange := strings.Cut(s, "-")
+		if !isRange {
+			last = first
+		}
+		f, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s in ACL", s)
+		}
+		l, err := strconv.ParseUint(last, 10, 16)
+		if err != nil || l < f {
+			return nil, fmt.Errorf("invalid port range %s in ACL", s)
+		}
+		a.ports = append(a.ports, portRange{first: uint16(f), last: uint16(l)})
+	}
+	return &a, nil
+}
+
+func (a *acl) Allow(addr netip.AddrPort) bool {
+	if len(a.ports) > 0 && !slices.ContainsFunc(a.ports, func(r portRange) bool {
+		return addr.Port() >= r.first && addr.Port() <= r.last
+	}) {
+		return false
+	}
+	contains := func(p netip.Prefix) bool { return p.Contains(addr.Addr()) }
+	if slices.ContainsFunc(a.deny, contains) {
+		return false
+	}
+	return len(a.allow) == 0 || slices.ContainsFunc(a.allow, contains)
+}
+
+func newAuthorizer(conf *authConfig) (func(http.ResponseWriter, *masque.ProxyRequest) bool, error) {
+	switch conf.Type {
+	case "", "none":
+		return nil, nil
+	case "bearer":
+		if len(conf.Tokens) == 0 {
+			return nil, errors.New("bearer authentication requires tokens")
+		}
+		return func(w http.ResponseWriter, r *masque.ProxyRequest) bool {
+			scheme, token, _ := strings.Cut(r.Request().Header.Get("Proxy-Authorization"), " ")
+			if strings.EqualFold(scheme, "Bearer") && slices.ContainsFunc(conf.Tokens, func(t string) bool {
+				return subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1
+			}) {
+				return true
+			}
+			w.Header().Set("Proxy-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return false
+		}, nil
+	case "basic":
+		if len(conf.Users) == 0 {
+			return nil, errors.New("basic authentication requires users")
+		}
+		return func(w http.ResponseWriter, r *masque.ProxyRequest) bool {
+			if user, password, ok := parseBasicAuth(r.Request().Header.Get("Proxy-Authorization")); ok {
+				if expected, ok := conf.Users[user]; ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 {
+					r.Identity = user
+					return true
+				}
+			}
+			w.Header().Set("Proxy-Authenticate", `Basic realm="masque"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return false
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown authentication type: %s", conf.Type)
+	}
+}
+
+func parseBasicAuth(header string) (user, password string, ok bool) {
+	scheme, credentials, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+func newLogger(conf *logConfig, level *slog.LevelVar) (*slog.Logger, error) {
+	l, err := parseLogLevel(conf)
+	if err != nil {
+		return nil, err
+	}
+	level.Set(l)
+	opts := &slog.HandlerOptions{Level: level}
+	switch conf.Format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", conf.Format)
+	}
+}
+
+func parseLogLevel(conf *logConfig) (slog.Level, error) {
+	var level slog.Level
+	if conf.Level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(conf.Level)); err != nil {
+		return 0, err
+	}
+	return level, nil
+}
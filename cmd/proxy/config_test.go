@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name: "valid",
+			config: `{
+				"listeners": [{"addr": "0.0.0.0:443"}],
+				"templates": ["https://proxy.example:443/masque?h={target_host}&p={target_port}"],
+				"tls": {"cert": "cert.pem", "key": "key.pem", "reload_interval": "30s"},
+				"limits": {"max_flows": 10, "max_flows_per_client": 2}
+			}`,
+		},
+		{
+			name:   "invalid JSON",
+			config: `{"listeners": [`,
+			err:    "failed to parse",
+		},
+		{
+			name:   "unknown field",
+			config: `{"listeners": [{"addr": "0.0.0.0:443"}], "tls": {"cert": "cert.pem"}, "foo": 1}`,
+			err:    `unknown field "foo"`,
+		},
+		{
+			name:   "invalid duration",
+			config: `{"listeners": [{"addr": "0.0.0.0:443"}], "tls": {"cert": "cert.pem", "reload_interval": "soon"}}`,
+			err:    "invalid duration",
+		},
+		{
+			name:   "no listeners",
+			config: `{"tls": {"cert": "cert.pem", "key": "key.pem"}}`,
+			err:    "no listeners configured",
+		},
+		{
+			name:   "no certificate",
+			config: `{"listeners": [{"addr": "0.0.0.0:443"}]}`,
+			err:    "no TLS certificate configured",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.json")
+			require.NoError(t, os.WriteFile(filename, []byte(tc.config), 0o600))
+			conf, err := loadConfig(filename)
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []listenerConfig{{Addr: "0.0.0.0:443"}}, conf.Listeners)
+			require.Equal(t, duration(30*time.Second), conf.TLS.ReloadInterval)
+			require.Equal(t, limitsConfig{MaxFlows: 10, MaxFlowsPerClient: 2}, conf.Limits)
+		})
+	}
+
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestNewPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conf config
+		err  string
+	}{
+		{
+			name: "valid",
+			conf: config{
+				Templates: []string{testTemplate},
+				ACL:       aclConfig{Allow: []string{"0.0.0.0/0"}, Deny: []string{"10.0.0.0/8"}, Ports: []string{"443", "1024-65535"}},
+				Auth:      authConfig{Type: "bearer", Tokens: []string{"secret"}},
+			},
+		},
+		{
+			name: "no templates",
+			conf: config{},
+			err:  "no templates configured",
+		},
+		{
+			name: "invalid template",
+			conf: config{Templates: []string{"https://localhost/masque?h={target_host"}},
+			err:  "invalid template",
+		},
+		{
+			name: "invalid prefix",
+			conf: config{Templates: []string{testTemplate}, ACL: aclConfig{Deny: []string{"10.0.0.0"}}},
+			err:  "invalid ACL",
+		},
+		{
+			name: "invalid port",
+			conf: config{Templates: []string{testTemplate}, ACL: aclConfig{Ports: []string{"https"}}},
+			err:  "invalid port https in ACL",
+		},
+		{
+			name: "invalid port range",
+			conf: config{Templates: []string{testTemplate}, ACL: aclConfig{Ports: []string{"443-80"}}},
+			err:  "invalid port range 443-80 in ACL",
+		},
+		{
+			name: "unknown authentication type",
+			conf: config{Templates: []string{testTemplate}, Auth: authConfig{Type: "digest"}},
+			err:  "unknown authentication type: digest",
+		},
+		{
+			name: "bearer without tokens",
+			conf: config{Templates: []string{testTemplate}, Auth: authConfig{Type: "bearer"}},
+			err:  "bearer authentication requires tokens",
+		},
+		{
+			name: "basic without users",
+			conf: config{Templates: []string{testTemplate}, Auth: authConfig{Type: "basic"}},
+			err:  "basic authentication requires users",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := newPolicy(&tc.conf, &masque.Proxy{}, &masque.FlowLimiter{})
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, p.handler)
+			require.NotNil(t, p.acl)
+		})
+	}
+}
+
+func TestACL(t *testing.T) {
+	a, err := newACL(&aclConfig{
+		Allow: []string{"192.0.2.0/24", "2001:db8::/32"},
+		Deny:  []string{"192.0.2.128/25"},
+		Ports: []string{"53", "1024-2048"},
+	})
+	require.NoError(t, err)
+	allowAll, err := newACL(&aclConfig{})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		addr     string
+		allowed  bool
+		allowAll bool
+	}{
+		{addr: "192.0.2.1:53", allowed: true, allowAll: true},
+		{addr: "192.0.2.1:1024", allowed: true, allowAll: true},
+		{addr: "192.0.2.1:2048", allowed: true, allowAll: true},
+		{addr: "[2001:db8::1]:1500", allowed: true, allowAll: true},
+		{addr: "192.0.2.1:443", allowed: false, allowAll: true},  // port not allowed
+		{addr: "192.0.2.1:2049", allowed: false, allowAll: true}, // port not allowed
+		{addr: "192.0.2.200:53", allowed: false, allowAll: true}, // denied
+		{addr: "198.51.100.1:53", allowed: false, allowAll: true},
+		{addr: "[2001:db9::1]:53", allowed: false, allowAll: true},
+	} {
+		addr := netip.MustParseAddrPort(tc.addr)
+		require.Equal(t, tc.allowed, a.Allow(addr), tc.addr)
+		require.Equal(t, tc.allowAll, allowAll.Allow(addr), tc.addr)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	basic := func(user, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+
+	for _, tc := range []struct {
+		name          string
+		conf          authConfig
+		authorization string
+		authorized    bool
+		identity      string
+		challenge     string
+	}{
+		{
+			name:       "none",
+			conf:       authConfig{Type: "none"},
+			authorized: true,
+		},
+		{
+			name:          "bearer",
+			conf:          authConfig{Type: "bearer", Tokens: []string{"foo", "bar"}},
+			authorization: "Bearer bar",
+			authorized:    true,
+		},
+		{
+			name:          "bearer, case-insensitive scheme",
+			conf:          authConfig{Type: "bearer", Tokens: []string{"foo"}},
+			authorization: "bearer foo",
+			authorized:    true,
+		},
+		{
+			name:          "bearer, wrong token",
+			conf:          authConfig{Type: "bearer", Tokens: []string{"foo"}},
+			authorization: "Bearer bar",
+			challenge:     "Bearer",
+		},
+		{
+			name:          "bearer, wrong scheme",
+			conf:          authConfig{Type: "bearer", Tokens: []string{"foo"}},
+			authorization: basic("foo", "foo"),
+			challenge:     "Bearer",
+		},
+		{
+			name:      "bearer, no credentials",
+			conf:      authConfig{Type: "bearer", Tokens: []string{"foo"}},
+			challenge: "Bearer",
+		},
+		{
+			name:          "basic",
+			conf:          authConfig{Type: "basic", Users: map[string]string{"alice": "secret"}},
+			authorization: basic("alice", "secret"),
+			authorized:    true,
+			identity:      "alice",
+		},
+		{
+			name:          "basic, wrong password",
+			conf:          authConfig{Type: "basic", Users: map[string]string{"alice": "secret"}},
+			authorization: basic("alice", "wrong"),
+			challenge:     `Basic realm="masque"`,
+		},
+		{
+			name:          "basic, unknown user",
+			conf:          authConfig{Type: "basic", Users: map[string]string{"alice": "secret"}},
+			authorization: basic("bob", "secret"),
+			challenge:     `Basic realm="masque"`,
+		},
+		{
+			name:          "basic, invalid encoding",
+			conf:          authConfig{Type: "basic", Users: map[string]string{"alice": "secret"}},
+			authorization: "Basic !!!",
+			challenge:     `Basic realm="masque"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			authorize, err := newAuthorizer(&tc.conf)
+			require.NoError(t, err)
+			if authorize == nil {
+				require.True(t, tc.authorized)
+				return
+			}
+			req := newProxyRequest(t, "192.0.2.1:1234")
+			if tc.authorization != "" {
+				req.Request().Header.Set("Proxy-Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			require.Equal(t, tc.authorized, authorize(rec, req))
+			require.Equal(t, tc.identity, req.Identity)
+			if !tc.authorized {
+				require.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+				require.Equal(t, tc.challenge, rec.Header().Get("Proxy-Authenticate"))
+			}
+		})
+	}
+}
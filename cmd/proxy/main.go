@@ -2,71 +2,194 @@ package main
 
 import (
 	"crypto/tls"
-	"errors"
 	"flag"
 	"log"
 	"log/slog"
 	"net/http"
-	"net/url"
+	"net/netip"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/quic-go/masque-go"
 
 	"github.com/quic-go/quic-go/http3"
-	"github.com/yosida95/uritemplate/v3"
 )
 
+type stringSlice []string
+
+func (s *stringSlice) String() string     { return strings.Join(*s, ", ") }
+func (s *stringSlice) Set(v string) error { *s = append(*s, v); return nil }
+
 func main() {
-	var templateStr, bind, keyFile, certFile string
-	flag.StringVar(&templateStr, "t", "", "URI template")
+	var templateStrs stringSlice
+	var configFile, bind, keyFile, certFile, accessLog string
+	var allowTCP bool
+	flag.StringVar(&configFile, "config", "", "configuration file (JSON), reloaded on SIGHUP. If set, all other flags are ignored.")
+	flag.Var(&templateStrs, "t", "URI template (can be passed multiple times)")
 	flag.StringVar(&bind, "b", "", "bind to (ip:port)")
 	flag.StringVar(&keyFile, "k", "", "key file")
 	flag.StringVar(&certFile, "c", "", "cert file")
+	flag.StringVar(&accessLog, "access-log", "", "access log file (JSON lines), - for stdout")
+	flag.BoolVar(&allowTCP, "tcp", false, "enable CONNECT-TCP")
 	flag.Parse()
 
-	if templateStr == "" || bind == "" || keyFile == "" || certFile == "" {
-		flag.Usage()
-		os.Exit(1)
+	var conf *config
+	if configFile != "" {
+		var err error
+		conf, err = loadConfig(configFile)
+		if err != nil {
+			log.Fatalf("failed to load config: %v", err)
+		}
+	} else {
+		if len(templateStrs) == 0 || bind == "" || keyFile == "" || certFile == "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+		conf = &config{
+			Listeners: []listenerConfig{{Addr: bind}},
+			Templates: templateStrs,
+			TLS:       tlsConfig{Cert: certFile, Key: keyFile},
+			AccessLog: accessLogConfig{Path: accessLog},
+			AllowTCP:  allowTCP,
+		}
+	}
+	if err := run(conf, configFile); err != nil {
+		log.Fatalf("failed to run proxy: %v", err)
 	}
+}
 
-	template, err := uritemplate.New(templateStr)
-	if err != nil {
-		log.Fatalf("invalid template: %v", err)
+type server struct {
+	configFile string
+	proxy      *masque.Proxy
+	metrics    *metrics
+	logLevel   *slog.LevelVar
+	certs      certManager
+	flows      masque.FlowLimiter
+	policy     atomic.Pointer[policy]
+}
+
+func run(conf *config, configFile string) error {
+	s := &server{
+		configFile: configFile,
+		metrics:    &metrics{},
+		logLevel:   &slog.LevelVar{},
 	}
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		log.Fatalf("failed to load certificate: %v", err)
-	}
-	tlsConf := http3.ConfigureTLSConfig(&tls.Config{
-		Certificates: []tls.Certificate{cert},
-	})
-	server := http3.Server{
-		Addr:            bind,
-		TLSConfig:       tlsConf,
-		EnableDatagrams: true,
-		Logger:          slog.Default(),
-	}
-	defer server.Close()
-	proxy := masque.Proxy{}
-	// parse the template to extract the path for the HTTP handler
-	u, err := url.Parse(templateStr)
+	logger, err := newLogger(&conf.Log, s.logLevel)
 	if err != nil {
-		log.Fatalf("failed to parse URI template: %v", err)
+		return err
 	}
-	http.HandleFunc(u.Path, func(w http.ResponseWriter, r *http.Request) {
-		req, err := masque.ParseProxyRequest(r, template)
+	slog.SetDefault(logger)
+	// The ACL is evaluated for every request, using the current policy.
+	s.proxy = &masque.Proxy{
+		AllowTCP: conf.AllowTCP,
+		AllowTarget: func(_ *masque.ProxyRequest, addr netip.AddrPort) bool {
+			return s.policy.Load().acl.Allow(addr)
+		},
+	}
+	switch conf.AccessLog.Path {
+	case "":
+	case "-":
+		s.proxy.AccessLog = masque.NewJSONAccessLog(os.Stdout).Log
+	default:
+		f, err := os.OpenFile(conf.AccessLog.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
 		if err != nil {
-			var perr *masque.ProxyRequestParseError
-			if errors.As(err, &perr) {
-				w.WriteHeader(perr.HTTPStatus)
-				return
+			return err
+		}
+		defer f.Close()
+		s.proxy.AccessLog = masque.NewJSONAccessLog(f).Log
+	}
+	// Closing the proxy waits for all flows to be logged.
+	defer s.proxy.Close()
+	if err := s.apply(conf); err != nil {
+		return err
+	}
+
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go s.certs.Watch(time.Duration(conf.TLS.ReloadInterval), stopWatching)
+
+	tlsConf := http3.ConfigureTLSConfig(&tls.Config{GetCertificate: s.certs.GetCertificate})
+	handler := s.metrics.Wrap(s)
+	errChan := make(chan error, len(conf.Listeners)+1)
+	for _, l := range conf.Listeners {
+		server := &http3.Server{
+			Addr:            l.Addr,
+			TLSConfig:       tlsConf,
+			EnableDatagrams: true,
+			Handler:         handler,
+			Logger:          slog.Default(),
+		}
+		defer server.Close()
+		go func() { errChan <- server.ListenAndServe() }()
+		slog.Info("listening", "addr", l.Addr)
+	}
+	if conf.Metrics.Addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.metrics)
+		metricsServer := &http.Server{Addr: conf.Metrics.Addr, Handler: mux}
+		defer metricsServer.Close()
+		go func() { errChan <- metricsServer.ListenAndServe() }()
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case err := <-errChan:
+			return err
+		case sig := <-sigChan:
+			if sig != syscall.SIGHUP {
+				slog.Info("shutting down", "signal", sig)
+				return nil
 			}
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			s.reload()
 		}
-		proxy.Proxy(w, req)
-	})
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("failed to run proxy: %v", err)
 	}
 }
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.policy.Load().handler.ServeHTTP(w, r)
+}
+
+// apply applies the configuration to new requests.
+// Existing flows are not affected.
+// The configuration is only applied if it is valid as a whole.
+func (s *server) apply(conf *config) error {
+	p, err := newPolicy(conf, s.proxy, &s.flows)
+	if err != nil {
+		return err
+	}
+	level, err := parseLogLevel(&conf.Log)
+	if err != nil {
+		return err
+	}
+	certs, err := loadCertificates(conf.TLS.certificates())
+	if err != nil {
+		return err
+	}
+	s.logLevel.Set(level)
+	s.certs.Set(certs)
+	s.policy.Store(p)
+	return nil
+}
+
+func (s *server) reload() {
+	if s.configFile == "" {
+		slog.Warn("ignoring SIGHUP, no configuration file")
+		return
+	}
+	conf, err := loadConfig(s.configFile)
+	if err == nil {
+		err = s.apply(conf)
+	}
+	if err != nil {
+		slog.Error("failed to reload configuration, keeping the current configuration", "error", err)
+		return
+	}
+	s.metrics.reloads.Add(1)
+	slog.Info("reloaded configuration")
+}
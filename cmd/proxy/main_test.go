@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+// writeCert writes a self-signed certificate for the DNS names, and its key, to dir.
+func writeCert(t *testing.T, dir, name string, dnsNames ...string) certConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: serial}, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	conf := certConfig{Cert: filepath.Join(dir, name+".pem"), Key: filepath.Join(dir, name+"-key.pem")}
+	require.NoError(t, os.WriteFile(conf.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(conf.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return conf
+}
+
+func writeConfig(t *testing.T, filename string, conf map[string]any) {
+	t.Helper()
+	data, err := json.Marshal(conf)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filename, data, 0o600))
+}
+
+const testTemplate = "https://localhost:443/masque?h={target_host}&p={target_port}"
+
+// newProxyRequest creates a CONNECT-UDP request for testTemplate.
+func newProxyRequest(t *testing.T, remoteAddr string) *masque.ProxyRequest {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "https://localhost:443/masque?h=192.0.2.1&p=443", nil)
+	r.Method = http.MethodConnect
+	r.Proto = masque.ProtocolConnectUDP
+	r.RemoteAddr = remoteAddr
+	req, err := masque.ParseProxyRequest(r, uritemplate.MustNew(testTemplate))
+	require.NoError(t, err)
+	return req
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeCert(t, dir, "cert", "localhost")
+	configFile := filepath.Join(dir, "config.json")
+	conf := map[string]any{
+		"listeners": []map[string]string{{"addr": "127.0.0.1:0"}},
+		"templates": []string{testTemplate},
+		"tls":       map[string]string{"cert": cert.Cert, "key": cert.Key},
+		"limits":    map[string]int{"max_flows": 1},
+	}
+	writeConfig(t, configFile, conf)
+
+	s := &server{
+		configFile: configFile,
+		proxy:      &masque.Proxy{},
+		metrics:    &metrics{},
+		logLevel:   &slog.LevelVar{},
+	}
+	defer s.proxy.Close()
+	c, err := loadConfig(configFile)
+	require.NoError(t, err)
+	require.NoError(t, s.apply(c))
+	p := s.policy.Load()
+	require.Equal(t, 1, p.handler.MaxFlows)
+
+	conf["log"] = map[string]string{"level": "debug"}
+	conf["limits"] = map[string]int{"max_flows": 2}
+	writeConfig(t, configFile, conf)
+	s.reload()
+	require.Equal(t, uint64(1), s.metrics.reloads.Load())
+	require.Equal(t, slog.LevelDebug, s.logLevel.Level())
+	require.NotSame(t, p, s.policy.Load())
+	require.Equal(t, 2, s.policy.Load().handler.MaxFlows)
+	// the flows are still counted after reloading the configuration
+	require.Same(t, &s.flows, p.handler.FlowLimiter)
+	require.Same(t, &s.flows, s.policy.Load().handler.FlowLimiter)
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeCert(t, dir, "cert", "localhost")
+	configFile := filepath.Join(dir, "config.json")
+	conf := map[string]any{
+		"listeners": []map[string]string{{"addr": "127.0.0.1:0"}},
+		"templates": []string{testTemplate},
+		"tls":       map[string]string{"cert": cert.Cert, "key": cert.Key},
+	}
+	writeConfig(t, configFile, conf)
+
+	s := &server{
+		configFile: configFile,
+		proxy:      &masque.Proxy{},
+		metrics:    &metrics{},
+		logLevel:   &slog.LevelVar{},
+	}
+	defer s.proxy.Close()
+	c, err := loadConfig(configFile)
+	require.NoError(t, err)
+	require.NoError(t, s.apply(c))
+	p := s.policy.Load()
+	certs := s.certs.certs.Load()
+
+	// The certificate can't be loaded.
+	// None of the other changes must be applied.
+	conf["log"] = map[string]string{"level": "debug"}
+	conf["acl"] = map[string][]string{"deny": {"0.0.0.0/0"}}
+	conf["tls"] = map[string]string{"cert": filepath.Join(dir, "missing.pem"), "key": cert.Key}
+	writeConfig(t, configFile, conf)
+	s.reload()
+	require.Zero(t, s.metrics.reloads.Load())
+	require.Equal(t, slog.LevelInfo, s.logLevel.Level())
+	require.Same(t, p, s.policy.Load())
+	require.Same(t, certs, s.certs.certs.Load())
+}
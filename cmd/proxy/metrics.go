@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// metrics collects metrics about the proxied requests.
+// They are exposed in the Prometheus text format.
+type metrics struct {
+	activeFlows atomic.Int64
+	flows       atomic.Uint64
+	reloads     atomic.Uint64
+
+	mx       sync.Mutex
+	requests map[int]uint64 // by status code
+}
+
+func (m *metrics) request(status int) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.requests == nil {
+		m.requests = make(map[int]uint64)
+	}
+	m.requests[status]++
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.mx.Lock()
+	statuses := make([]int, 0, len(m.requests))
+	for status := range m.requests {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	fmt.Fprintln(w, "# HELP masque_requests_total CONNECT-UDP and CONNECT-TCP requests by response status code.")
+	fmt.Fprintln(w, "# TYPE masque_requests_total counter")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "masque_requests_total{code=\"%d\"} %d\n", status, m.requests[status])
+	}
+	m.mx.Unlock()
+	fmt.Fprintln(w, "# HELP masque_flows_total Proxied flows.")
+	fmt.Fprintln(w, "# TYPE masque_flows_total counter")
+	fmt.Fprintf(w, "masque_flows_total %d\n", m.flows.Load())
+	fmt.Fprintln(w, "# HELP masque_flows_active Currently proxied flows.")
+	fmt.Fprintln(w, "# TYPE masque_flows_active gauge")
+	fmt.Fprintf(w, "masque_flows_active %d\n", m.activeFlows.Load())
+	fmt.Fprintln(w, "# HELP masque_config_reloads_total Successful configuration reloads.")
+	fmt.Fprintln(w, "# TYPE masque_config_reloads_total counter")
+	fmt.Fprintf(w, "masque_config_reloads_total %d\n", m.reloads.Load())
+}
+
+// Wrap wraps a handler to collect metrics for CONNECT requests.
+func (m *metrics) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rw := &statusRecorder{ResponseWriter: w, metrics: m}
+		defer func() {
+			if rw.status == http.StatusOK {
+				m.activeFlows.Add(-1)
+			}
+		}()
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// statusRecorder records the status code of the response.
+// It implements http3.HTTPStreamer, which is required for proxying.
+type statusRecorder struct {
+	http.ResponseWriter
+	metrics *metrics
+	status  int
+}
+
+var _ http3.HTTPStreamer = &statusRecorder{}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.metrics.request(status)
+		if status == http.StatusOK {
+			w.metrics.flows.Add(1)
+			w.metrics.activeFlows.Add(1)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) HTTPStream() *http3.Stream {
+	return w.ResponseWriter.(http3.HTTPStreamer).HTTPStream()
+}
@@ -29,6 +29,8 @@ type http3Stream interface {
 	ReceiveDatagram(context.Context) ([]byte, error)
 	SendDatagram([]byte) error
 	CancelRead(quic.StreamErrorCode)
+	CancelWrite(quic.StreamErrorCode)
+	StreamID() quic.StreamID
 }
 
 var (
@@ -39,8 +41,15 @@ var (
 type Conn struct {
 	str        http3Stream
 	localAddr  net.Addr
-	remoteAddr net.Addr
+	remoteAddr atomic.Pointer[net.Addr] // updated when the proxy fails over to a different address of the target
 	closeConn  func() error
+	clientConn *ClientConn
+
+	counters connCounters
+
+	capsuleHandlers capsuleHandlers
+	capsules        capsuleWriter
+	capsuleErr      atomic.Pointer[CapsuleError] // set when the stream was aborted while processing a capsule
 
 	closed   atomic.Bool // set when Close is called
 	readDone chan struct{}
@@ -50,45 +59,74 @@ type Conn struct {
 	readCtxCancel     context.CancelFunc
 	deadline          time.Time
 	readDeadlineTimer *time.Timer
+	icmpErrors        []*ICMPError // protected by deadlineMx, since queueing an ICMP error unblocks ReadFrom
 }
 
 var _ net.PacketConn = &Conn{}
 
 // closeConn is only used for QUIC connections dialed by [Transport.Dial].
-// It is nil for connections created through [Transport.NewClientConn]; callers close those QUIC connections themselves.
-func newProxiedConn(str http3Stream, local, remote net.Addr, closeConn func() error) *Conn {
+// It is nil for connections created through [Transport.NewClientConn]; those QUIC connections are closed using [ClientConn.Close].
+// The capsule handlers are those registered on the Request.
+func newProxiedConn(clientConn *ClientConn, str http3Stream, local, remote net.Addr, handlers capsuleHandlers, closeConn func() error) *Conn {
 	c := &Conn{
-		str:        str,
-		localAddr:  local,
-		remoteAddr: remote,
-		closeConn:  closeConn,
-		readDone:   make(chan struct{}),
+		str:             str,
+		localAddr:       local,
+		closeConn:       closeConn,
+		clientConn:      clientConn,
+		capsuleHandlers: handlers.clone(),
+		capsules:        capsuleWriter{w: str},
+		readDone:        make(chan struct{}),
 	}
+	c.remoteAddr.Store(&remote)
+	c.capsuleHandlers.handle(capsuleTypeICMPError, c.handleICMPErrorCapsule)
+	c.capsuleHandlers.handle(capsuleTypeNextHop, c.handleNextHopCapsule)
 	c.readCtx, c.readCtxCancel = context.WithCancel(context.Background())
 	go func() {
 		defer close(c.readDone)
-		if err := skipCapsules(str); err != io.EOF && !c.closed.Load() {
+		err := c.capsuleHandlers.readCapsules(str)
+		var capsuleErr *CapsuleError
+		if errors.As(err, &capsuleErr) {
+			c.capsuleErr.Store(capsuleErr)
+			abortOnCapsuleError(str, err)
+		} else if err != io.EOF && !c.closed.Load() {
 			log.Printf("reading from request stream failed: %v", err)
 		}
 		str.Close()
+		clientConn.removeFlow(str.StreamID())
 	}()
 	return c
 }
 
+// ReadFrom reads a UDP datagram from the target.
+// If the proxy relayed an ICMP error for this flow, it is returned as an [ICMPError].
+// The connection can still be used after receiving an ICMP error.
 func (c *Conn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
 start:
 	c.deadlineMx.Lock()
+	if len(c.icmpErrors) > 0 {
+		icmpErr := c.icmpErrors[0]
+		c.icmpErrors = c.icmpErrors[1:]
+		c.deadlineMx.Unlock()
+		return 0, nil, icmpErr
+	}
 	ctx := c.readCtx
 	c.deadlineMx.Unlock()
 	data, err := c.str.ReceiveDatagram(ctx)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
+			if capsuleErr := c.capsuleErr.Load(); capsuleErr != nil {
+				return 0, nil, capsuleErr
+			}
 			return 0, nil, err
 		}
 		// The context is cancelled asynchronously (in a Go routine spawned from time.AfterFunc).
-		// We need to check if a new deadline has already been set.
+		// We need to check if a new deadline has already been set (or the deadline was removed).
+		// The context is also cancelled when an ICMP error is received.
+		if c.closed.Load() {
+			return 0, nil, net.ErrClosed
+		}
 		c.deadlineMx.Lock()
-		restart := time.Now().Before(c.deadline)
+		restart := c.deadline.IsZero() || time.Now().Before(c.deadline) || len(c.icmpErrors) > 0
 		c.deadlineMx.Unlock()
 		if restart {
 			goto start
@@ -101,11 +139,16 @@ start:
 	}
 	if contextID != 0 {
 		// Drop this datagram. We currently only support proxying of UDP payloads.
+		c.countDroppedUnknownContextID()
 		goto start
 	}
+	c.countReceived(len(data[n:]))
 	// If b is too small, additional bytes are discarded.
 	// This mirrors the behavior of large UDP datagrams received on a UDP socket (on Linux).
-	return copy(b, data[n:]), c.remoteAddr, nil
+	if len(b) < len(data[n:]) {
+		c.countTruncated()
+	}
+	return copy(b, data[n:]), *c.remoteAddr.Load(), nil
 }
 
 // WriteTo sends a UDP datagram to the target.
@@ -114,7 +157,11 @@ func (c *Conn) WriteTo(p []byte, _ net.Addr) (n int, err error) {
 	data := make([]byte, 0, len(contextIDZero)+len(p))
 	data = append(data, contextIDZero...)
 	data = append(data, p...)
-	return len(p), c.str.SendDatagram(data)
+	if err := c.str.SendDatagram(data); err != nil {
+		return len(p), err
+	}
+	c.countSent(len(p))
+	return len(p), nil
 }
 
 func (c *Conn) Close() error {
@@ -122,8 +169,9 @@ func (c *Conn) Close() error {
 	c.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
 	err := c.str.Close()
 	<-c.readDone
-	c.readCtxCancel()
+	c.clientConn.removeFlow(c.str.StreamID())
 	c.deadlineMx.Lock()
+	c.readCtxCancel()
 	if c.readDeadlineTimer != nil {
 		c.readDeadlineTimer.Stop()
 	}
@@ -134,12 +182,30 @@ func (c *Conn) Close() error {
 	return err
 }
 
+// SendCapsule sends a capsule on the request stream.
+// Capsules are sent reliably, and in order.
+func (c *Conn) SendCapsule(ct http3.CapsuleType, value []byte) error {
+	return c.capsules.writeCapsule(ct, value)
+}
+
+// Migrate migrates the QUIC connection to the proxy to a new network path, see [ClientConn.Migrate].
+// It can only be used for connections dialed by [Transport.Dial].
+func (c *Conn) Migrate(ctx context.Context, tr *quic.Transport) (*quic.Path, error) {
+	if c.closeConn == nil {
+		return nil, errors.New("masque: connection wasn't dialed by Transport.Dial, use ClientConn.Migrate")
+	}
+	return c.clientConn.Migrate(ctx, tr)
+}
+
 func (c *Conn) LocalAddr() net.Addr {
 	return c.localAddr
 }
 
+// RemoteAddr returns the address of the target, as reported by the proxy in the next-hop parameter of the Proxy-Status header field.
+// If the proxy fails over to a different address of the target, the new address is returned.
+// If the proxy didn't report the address, the target of the request is returned.
 func (c *Conn) RemoteAddr() net.Addr {
-	return c.remoteAddr
+	return *c.remoteAddr.Load()
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
@@ -151,30 +217,26 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 	c.deadlineMx.Lock()
 	defer c.deadlineMx.Unlock()
 
-	oldDeadline := c.deadline
 	c.deadline = t
 	now := time.Now()
-	// Stop the timer.
-	if t.IsZero() {
-		if c.readDeadlineTimer != nil && !c.readDeadlineTimer.Stop() {
-			<-c.readDeadlineTimer.C
-		}
-
-		return nil
+	if c.readDeadlineTimer != nil {
+		c.readDeadlineTimer.Stop()
 	}
 	// If the deadline already expired, cancel immediately.
-	if !t.After(now) {
+	if !t.IsZero() && !t.After(now) {
 		c.readCtxCancel()
 		return nil
 	}
+	// The context might already have been cancelled by a previous deadline.
+	// Cancelling it unblocks ReadFrom, which then continues reading using the new context.
+	c.readCtxCancel()
+	c.readCtx, c.readCtxCancel = context.WithCancel(context.Background())
+	if t.IsZero() {
+		return nil
+	}
 	deadline := t.Sub(now)
 	// if we already have a timer, reset it
 	if c.readDeadlineTimer != nil {
-		// if that timer expired, create a new one
-		if now.Before(oldDeadline) {
-			c.readCtxCancel() // the old context might already have been cancelled, but that's not guaranteed
-			c.readCtx, c.readCtxCancel = context.WithCancel(context.Background())
-		}
 		c.readDeadlineTimer.Reset(deadline)
 	} else { // this is the first time the timer is set
 		c.readDeadlineTimer = time.AfterFunc(deadline, func() {
@@ -193,16 +255,48 @@ func (c *Conn) SetWriteDeadline(time.Time) error {
 	return nil
 }
 
-func skipCapsules(str io.Reader) error {
-	parser := http3.NewCapsuleParser(str)
-	for {
-		ct, r, err := parser.Next()
-		if err != nil {
-			return err
-		}
-		log.Printf("skipping capsule of type %d", ct)
-		if err := r.Discard(); err != nil {
-			return err
-		}
+func (c *Conn) handleICMPErrorCapsule(_ http3.CapsuleType, r io.Reader) error {
+	icmpErr, err := parseICMPErrorCapsule(r)
+	if err != nil {
+		return err
+	}
+	c.queueICMPError(icmpErr)
+	return nil
+}
+
+func (c *Conn) handleNextHopCapsule(_ http3.CapsuleType, r io.Reader) error {
+	b, err := io.ReadAll(io.LimitReader(r, maxNextHopLen+1))
+	if err != nil {
+		return err
+	}
+	// An invalid next-hop doesn't affect the flow itself, so it's ignored.
+	if len(b) > maxNextHopLen {
+		log.Printf("ignoring next-hop capsule: next-hop too long")
+		return nil
+	}
+	addr := parseNextHop(string(b))
+	if addr == nil {
+		log.Printf("ignoring next-hop capsule: invalid next-hop: %q", b)
+		return nil
+	}
+	raddr := net.Addr(addr)
+	c.remoteAddr.Store(&raddr)
+	return nil
+}
+
+func (c *Conn) queueICMPError(e *ICMPError) {
+	c.deadlineMx.Lock()
+	defer c.deadlineMx.Unlock()
+
+	c.countICMPError()
+	if len(c.icmpErrors) >= maxQueuedICMPErrors {
+		return
+	}
+	c.icmpErrors = append(c.icmpErrors, e)
+	// Unblock ReadFrom.
+	// If the deadline already expired, the context has already been cancelled.
+	if c.deadline.IsZero() || time.Now().Before(c.deadline) {
+		c.readCtxCancel()
+		c.readCtx, c.readCtxCancel = context.WithCancel(context.Background())
 	}
 }
@@ -0,0 +1,185 @@
+package masque_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func ethernetFrame(dst, src net.HardwareAddr, payload string) []byte {
+	frame := append([]byte(dst), src...)
+	frame = append(frame, 0x88, 0xb5) // EtherType for local experiments
+	return append(frame, payload...)
+}
+
+func readFrame(t *testing.T, port masque.EthernetPort) []byte {
+	t.Helper()
+	frames := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 1500)
+		n, err := port.ReadFrame(b)
+		if err != nil {
+			return
+		}
+		frames <- b[:n]
+	}()
+	select {
+	case frame := <-frames:
+		return frame
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+		return nil
+	}
+}
+
+func TestEthernetBridge(t *testing.T) {
+	var bridge masque.EthernetBridge
+	a, b, c := bridge.NewPort(), bridge.NewPort(), bridge.NewPort()
+	defer a.Close()
+	defer b.Close()
+	macA := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	macB := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b}
+
+	// unknown destinations are flooded
+	frame := ethernetFrame(macB, macA, "foo")
+	require.NoError(t, a.WriteFrame(frame))
+	require.Equal(t, frame, readFrame(t, b))
+	require.Equal(t, frame, readFrame(t, c))
+
+	// the bridge learned the MAC address of a
+	frame = ethernetFrame(macA, macB, "bar")
+	require.NoError(t, b.WriteFrame(frame))
+	require.Equal(t, frame, readFrame(t, a))
+	frame = ethernetFrame(macB, macA, "baz")
+	require.NoError(t, a.WriteFrame(frame))
+	require.Equal(t, frame, readFrame(t, b))
+
+	// closed ports don't receive any frames
+	require.NoError(t, c.Close())
+	_, err := c.ReadFrame(make([]byte, 1500))
+	require.ErrorIs(t, err, net.ErrClosed)
+	require.ErrorIs(t, c.WriteFrame(frame), net.ErrClosed)
+	frame = ethernetFrame(broadcastMAC, macA, "broadcast")
+	require.NoError(t, a.WriteFrame(frame))
+	require.Equal(t, frame, readFrame(t, b))
+
+	require.Error(t, a.WriteFrame([]byte("short")))
+}
+
+// rejectingPort rejects frames with the payload "rejected".
+type rejectingPort struct {
+	masque.EthernetPort
+}
+
+func (p *rejectingPort) WriteFrame(b []byte) error {
+	if bytes.HasSuffix(b, []byte("rejected")) {
+		return errors.New("frame rejected")
+	}
+	return p.EthernetPort.WriteFrame(b)
+}
+
+func TestProxyEthernet(t *testing.T) {
+	var bridge masque.EthernetBridge
+	records := make(chan *masque.FlowRecord, 2)
+	proxy := &masque.Proxy{AccessLog: func(rec *masque.FlowRecord) { records <- rec }}
+	defer proxy.Close()
+
+	conn := newUDPConnLocalhost(t)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/ethernet/{segment}", conn.LocalAddr().(*net.UDPAddr).Port))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ethernet/", func(w http.ResponseWriter, r *http.Request) {
+		req, err := masque.ParseProxyRequest(r, template)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Vars["segment"] != "lab" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		proxy.ProxyEthernet(w, req, &rejectingPort{EthernetPort: bridge.NewPort()})
+	})
+	server := &http3.Server{
+		TLSConfig:       tlsConf,
+		EnableDatagrams: true,
+		Handler:         mux,
+	}
+	defer server.Close()
+	go server.Serve(conn)
+
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	dial := func(segment string) (*masque.EthernetConn, *http.Response, error) {
+		req, err := masque.NewEthernetRequest(context.Background(), template, map[string]string{"segment": segment})
+		require.NoError(t, err)
+		return tr.DialEthernet(req)
+	}
+
+	conn1, rsp, err := dial("lab")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	defer conn1.Close()
+	conn2, _, err := dial("lab")
+	require.NoError(t, err)
+	defer conn2.Close()
+
+	mac1 := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	mac2 := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	frame := ethernetFrame(broadcastMAC, mac1, "who's there?")
+	require.NoError(t, conn1.WriteFrame(frame))
+	require.Equal(t, frame, readFrame(t, conn2))
+	frame = ethernetFrame(mac1, mac2, "it's me")
+	require.NoError(t, conn2.WriteFrame(frame))
+	require.Equal(t, frame, readFrame(t, conn1))
+	require.Equal(t, uint64(1), conn1.Stats().DatagramsSent)
+
+	// Frames that are too short, or that are rejected by the port, are dropped.
+	// This doesn't affect the following frames.
+	require.NoError(t, conn1.WriteFrame([]byte("short")))
+	require.NoError(t, conn1.WriteFrame(ethernetFrame(broadcastMAC, mac1, "rejected")))
+	frame2 := ethernetFrame(broadcastMAC, mac1, "still there?")
+	require.NoError(t, conn1.WriteFrame(frame2))
+	require.Equal(t, frame2, readFrame(t, conn2))
+
+	require.NoError(t, conn1.Close())
+	select {
+	case rec := <-records:
+		require.Equal(t, masque.ProtocolConnectEthernet, rec.Protocol)
+		require.Equal(t, http.StatusOK, rec.Status)
+		require.Equal(t, uint64(2), rec.DatagramsToTarget)
+		require.Equal(t, uint64(2), rec.DroppedToTarget)
+		require.Equal(t, uint64(len(frame)), rec.BytesFromTarget)
+		require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+
+	t.Run("unknown segment", func(t *testing.T) {
+		_, rsp, err := dial("prod")
+		require.Error(t, err)
+		require.Equal(t, http.StatusNotFound, rsp.StatusCode)
+	})
+
+	t.Run("using Dial for a CONNECT-ETHERNET request", func(t *testing.T) {
+		req, err := masque.NewEthernetRequest(context.Background(), template, map[string]string{"segment": "lab"})
+		require.NoError(t, err)
+		_, _, err = tr.Dial(req)
+		require.EqualError(t, err, "masque: not a CONNECT-UDP request")
+	})
+}
@@ -0,0 +1,302 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// runTCPEchoServer runs a TCP server that echoes all data,
+// and closes the connection once the client closed its sending side.
+func runTCPEchoServer(t *testing.T) *net.TCPListener {
+	t.Helper()
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	wg.Go(func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			wg.Go(func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			})
+		}
+	})
+	return ln
+}
+
+func checkTCPEcho(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+	b := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, msg, string(b))
+}
+
+func TestProxyTCP(t *testing.T) {
+	ln := runTCPEchoServer(t)
+	records := make(chan *masque.FlowRecord, 1)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{AllowTCP: true, AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+	})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewTCPRequest(context.Background(), template, ln.Addr().String())
+	require.NoError(t, err)
+	conn, rsp, err := tr.DialTCP(req)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	require.Equal(t, ln.Addr().String(), conn.RemoteAddr().String())
+	require.Equal(t, "tcp", conn.RemoteAddr().Network())
+
+	checkTCPEcho(t, conn, "foo")
+	checkTCPEcho(t, conn, "foobar")
+	// closing the sending side is forwarded to the target, which then closes the connection
+	require.NoError(t, conn.CloseWrite())
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Empty(t, data)
+
+	select {
+	case rec := <-records:
+		require.Equal(t, masque.ProtocolConnectTCP, rec.Protocol)
+		require.Equal(t, http.StatusOK, rec.Status)
+		require.Equal(t, ln.Addr().(*net.TCPAddr).AddrPort(), rec.NextHop)
+		require.Equal(t, uint64(9), rec.BytesToTarget)
+		require.Equal(t, uint64(9), rec.BytesFromTarget)
+		require.Zero(t, rec.DatagramsToTarget)
+		require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+}
+
+func TestProxyTCPTargetCloses(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	defer ln.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	records := make(chan *masque.FlowRecord, 1)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{AllowTCP: true, AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+	})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewTCPRequest(context.Background(), template, ln.Addr().String())
+	require.NoError(t, err)
+	conn, _, err := tr.DialTCP(req)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	<-done
+	// the client can still send data after the target closed its side
+	require.NoError(t, conn.CloseWrite())
+
+	select {
+	case rec := <-records:
+		require.Equal(t, masque.CloseReasonTarget, rec.CloseReason)
+		require.Equal(t, uint64(5), rec.BytesFromTarget)
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+}
+
+func TestProxyTCPRejected(t *testing.T) {
+	ln := runTCPEchoServer(t)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{
+			AllowTCP: true,
+			Resolver: fakeResolver{},
+			AllowTarget: func(_ *masque.ProxyRequest, addr netip.AddrPort) bool {
+				return addr.Addr().Is4()
+			},
+		},
+	})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+
+	t.Run("access control", func(t *testing.T) {
+		req, err := masque.NewTCPRequest(context.Background(), template, "[::1]:1234")
+		require.NoError(t, err)
+		_, rsp, err := tr.DialTCP(req)
+		require.Error(t, err)
+		require.Equal(t, http.StatusForbidden, rsp.StatusCode)
+	})
+
+	t.Run("connection refused", func(t *testing.T) {
+		closedLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+		require.NoError(t, err)
+		addr := closedLn.Addr().String()
+		require.NoError(t, closedLn.Close())
+
+		req, err := masque.NewTCPRequest(context.Background(), template, addr)
+		require.NoError(t, err)
+		_, rsp, err := tr.DialTCP(req)
+		require.Error(t, err)
+		require.Equal(t, http.StatusBadGateway, rsp.StatusCode)
+		var proxyErr *masque.ProxyError
+		require.ErrorAs(t, err, &proxyErr)
+		require.Len(t, proxyErr.ProxyStatus, 1)
+		require.Equal(t, addr, proxyErr.ProxyStatus[0].NextHop)
+	})
+
+	t.Run("using Dial for a CONNECT-TCP request", func(t *testing.T) {
+		req, err := masque.NewTCPRequest(context.Background(), template, ln.Addr().String())
+		require.NoError(t, err)
+		_, _, err = tr.Dial(req)
+		require.EqualError(t, err, "masque: not a CONNECT-UDP request")
+	})
+}
+
+func TestProxyTCPShutdown(t *testing.T) {
+	ln := runTCPEchoServer(t)
+	handler := &masque.Handler{Proxy: &masque.Proxy{AllowTCP: true}}
+	template := runHandler(t, handler)
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewTCPRequest(context.Background(), template, ln.Addr().String())
+	require.NoError(t, err)
+	conn, _, err := tr.DialTCP(req)
+	require.NoError(t, err)
+	defer conn.Close()
+	checkTCPEcho(t, conn, "foo")
+
+	require.NoError(t, handler.Close())
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+	_, err = conn.Read(make([]byte, 10))
+	var streamErr *http3.Error
+	require.ErrorAs(t, err, &streamErr)
+	require.Equal(t, http3.ErrCodeConnectError, streamErr.ErrorCode)
+}
+
+func TestProxyTCPClientCloses(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	release := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+		// keep the connection open, the target doesn't close its side
+		<-release
+	}()
+	defer close(release)
+
+	records := make(chan *masque.FlowRecord, 1)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{AllowTCP: true, AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+	})
+	qconn, err := quic.DialAddr(
+		context.Background(),
+		proxyAddr(t, template).String(),
+		&tls.Config{ServerName: "localhost", RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true},
+	)
+	require.NoError(t, err)
+	defer qconn.CloseWithError(0, "")
+	cconn, err := (&masque.Transport{}).NewClientConn(qconn)
+	require.NoError(t, err)
+	req, err := masque.NewTCPRequest(context.Background(), template, ln.Addr().String())
+	require.NoError(t, err)
+	conn, _, err := cconn.DialTCP(req)
+	require.NoError(t, err)
+	// the data is sent to the target, even though the connection is closed right away
+	_, err = conn.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	select {
+	case rec := <-records:
+		require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+		require.Equal(t, uint64(6), rec.BytesToTarget)
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+	select {
+	case data := <-received:
+		require.Equal(t, "foobar", string(data))
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+}
+
+func TestProxyTCPNotEnabled(t *testing.T) {
+	ln := runTCPEchoServer(t)
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	dial := func(t *testing.T, template *uritemplate.Template) {
+		t.Helper()
+		req, err := masque.NewTCPRequest(context.Background(), template, ln.Addr().String())
+		require.NoError(t, err)
+		_, rsp, err := tr.DialTCP(req)
+		require.Error(t, err)
+		require.Equal(t, http.StatusNotImplemented, rsp.StatusCode)
+	}
+
+	t.Run("Proxy", func(t *testing.T) {
+		_, template, _ := runProxy(t, nil)
+		dial(t, template)
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		var authorized atomic.Bool
+		template := runHandler(t, &masque.Handler{
+			Authorize: func(http.ResponseWriter, *masque.ProxyRequest) bool {
+				authorized.Store(true)
+				return true
+			},
+		})
+		dial(t, template)
+		require.False(t, authorized.Load())
+	})
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"runtime"
+	"syscall"
 	"testing"
 	"time"
 
@@ -220,6 +222,45 @@ func TestProxyingRejected(t *testing.T) {
 	_, rsp, err := tr.Dial(req)
 	require.Error(t, err)
 	require.Equal(t, http.StatusTeapot, rsp.StatusCode)
+	var proxyErr *masque.ProxyError
+	require.ErrorAs(t, err, &proxyErr)
+	require.Equal(t, http.StatusTeapot, proxyErr.StatusCode)
+	require.Empty(t, proxyErr.ProxyStatus)
+}
+
+func TestProxyingDNSFailure(t *testing.T) {
+	conn := newUDPConnLocalhost(t)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", conn.LocalAddr().(*net.UDPAddr).Port))
+	proxy := masque.Proxy{}
+	defer proxy.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/masque", func(w http.ResponseWriter, r *http.Request) {
+		req, err := masque.ParseProxyRequest(r, template)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		proxy.Proxy(w, req)
+	})
+	server := http3.Server{TLSConfig: tlsConf, EnableDatagrams: true, Handler: mux}
+	defer server.Close()
+	go server.Serve(conn)
+
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewRequest(context.Background(), template, "nxdomain.test:1234")
+	require.NoError(t, err)
+	_, rsp, err := tr.Dial(req)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadGateway, rsp.StatusCode)
+	var proxyErr *masque.ProxyError
+	require.ErrorAs(t, err, &proxyErr)
+	require.True(t, proxyErr.IsDNSError())
+	require.False(t, proxyErr.Retryable())
+	require.Len(t, proxyErr.ProxyStatus, 1)
+	require.Equal(t, "Negative response", proxyErr.ProxyStatus[0].RCode)
+	require.Contains(t, proxyErr.ProxyStatus[0].Details, "no such host")
 }
 
 func TestProxyToHostnameMissingPort(t *testing.T) {
@@ -333,3 +374,193 @@ func TestProxyShutdown(t *testing.T) {
 	}
 	require.True(t, errored, "expected datagram write side to error")
 }
+
+func TestProxyRelaysICMPErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't report ICMP errors on UDP sockets")
+	}
+	t.Run("IPv4", func(t *testing.T) { testProxyRelaysICMPErrors(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}) })
+	t.Run("IPv6", func(t *testing.T) { testProxyRelaysICMPErrors(t, &net.UDPAddr{IP: net.IPv6loopback, Port: 0}) })
+}
+
+func testProxyRelaysICMPErrors(t *testing.T, addr *net.UDPAddr) {
+	// get a port that's (very likely) not in use
+	closedConn, err := net.ListenUDP("udp", addr)
+	require.NoError(t, err)
+	target := closedConn.LocalAddr().String()
+	require.NoError(t, closedConn.Close())
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	defer conn.Close()
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", conn.LocalAddr().(*net.UDPAddr).Port))
+
+	mux := http.NewServeMux()
+	server := http3.Server{
+		TLSConfig:       tlsConf,
+		QUICConfig:      &quic.Config{EnableDatagrams: true},
+		EnableDatagrams: true,
+		Handler:         mux,
+	}
+	defer server.Close()
+	proxy := masque.Proxy{}
+	defer proxy.Close()
+	mux.HandleFunc("/masque", func(w http.ResponseWriter, r *http.Request) {
+		req, err := masque.ParseProxyRequest(r, template)
+		if err != nil {
+			t.Log("Upgrade failed:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		proxy.Proxy(w, req)
+	})
+	go func() {
+		if err := server.Serve(conn); err != nil {
+			return
+		}
+	}()
+
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewRequest(context.Background(), template, target)
+	require.NoError(t, err)
+	proxiedConn, _, err := tr.Dial(req)
+	require.NoError(t, err)
+	defer proxiedConn.Close()
+
+	for range 2 { // the flow remains usable after receiving an ICMP error
+		_, err = proxiedConn.WriteTo([]byte("foobar"), nil)
+		require.NoError(t, err)
+		require.NoError(t, proxiedConn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+		_, _, err = proxiedConn.ReadFrom(make([]byte, 1500))
+		var icmpErr *masque.ICMPError
+		require.ErrorAs(t, err, &icmpErr)
+		require.True(t, icmpErr.PortUnreachable())
+		require.Equal(t, addr.IP.To4() == nil, icmpErr.IPv6)
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+		require.True(t, icmpErr.Temporary())
+	}
+}
+
+func TestProxyRequestConnectionInfo(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	defer conn.Close()
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", conn.LocalAddr().(*net.UDPAddr).Port))
+
+	reqChan := make(chan *masque.ProxyRequest, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/masque", func(w http.ResponseWriter, r *http.Request) {
+		req, err := masque.ParseProxyRequest(r, template)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reqChan <- req
+		w.WriteHeader(http.StatusForbidden)
+	})
+	server := http3.Server{
+		TLSConfig:       tlsConf,
+		QUICConfig:      &quic.Config{EnableDatagrams: true},
+		EnableDatagrams: true,
+		Handler:         mux,
+		ConnContext:     masque.QUICConnContext,
+	}
+	defer server.Close()
+	go server.Serve(conn)
+
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewRequest(context.Background(), template, "quic-go.net:1234")
+	require.NoError(t, err)
+	_, _, err = tr.Dial(req)
+	require.Error(t, err)
+
+	var r *masque.ProxyRequest
+	select {
+	case r = <-reqChan:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.Equal(t, "quic-go.net", r.TargetHost)
+	require.Equal(t, 1234, r.TargetPort)
+	require.NotNil(t, r.QUICConn())
+	require.Equal(t, r.QUICConn().RemoteAddr(), r.RemoteAddr())
+	require.NotNil(t, r.TLS())
+	require.Equal(t, http3.NextProtoH3, r.TLS().NegotiatedProtocol)
+}
+
+func TestProxyMultipleTemplates(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	queryTemplate := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", port))
+	tenantTemplate := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/{tenant}/udp/{target_host}/{target_port}/", port))
+	router, err := masque.NewTemplateRouter(queryTemplate, tenantTemplate)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	server := http3.Server{
+		TLSConfig:       tlsConf,
+		QUICConfig:      &quic.Config{EnableDatagrams: true},
+		EnableDatagrams: true,
+		Handler:         mux,
+	}
+	defer server.Close()
+	proxy := masque.Proxy{}
+	defer proxy.Close()
+	tenants := make(chan string, 2)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		req, err := router.ParseProxyRequest(r)
+		if err != nil {
+			t.Log("Upgrade failed:", err)
+			w.WriteHeader(err.(*masque.ProxyRequestParseError).HTTPStatus)
+			return
+		}
+		tenants <- req.Vars["tenant"]
+		proxy.Proxy(w, req)
+	})
+	go server.Serve(conn)
+
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	for _, tc := range []struct {
+		template *uritemplate.Template
+		vars     map[string]string
+	}{
+		{template: queryTemplate},
+		{template: tenantTemplate, vars: map[string]string{"tenant": "acme"}},
+	} {
+		req, err := masque.NewRequestWithVars(context.Background(), tc.template, remoteServerConn.LocalAddr().String(), tc.vars)
+		require.NoError(t, err)
+		proxiedConn, rsp, err := tr.Dial(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+		require.Equal(t, tc.vars["tenant"], <-tenants)
+
+		_, err = proxiedConn.WriteTo([]byte("foobar"), nil)
+		require.NoError(t, err)
+		b := make([]byte, 1500)
+		n, _, err := proxiedConn.ReadFrom(b)
+		require.NoError(t, err)
+		require.Equal(t, []byte("foobar"), b[:n])
+		require.NoError(t, proxiedConn.Close())
+	}
+}
+
+func TestNewRequestWithVarsRejectsTargetVars(t *testing.T) {
+	_, err := masque.NewRequestWithVars(
+		context.Background(),
+		uritemplate.MustNew("https://localhost:1234/masque?h={target_host}&p={target_port}"),
+		"quic-go.net:443",
+		map[string]string{"target_host": "example.com"},
+	)
+	require.ErrorContains(t, err, "invalid template variable: target_host")
+}
@@ -0,0 +1,159 @@
+package masque
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// defaultMaxIdleDNSConns is the default value for DNSResolver.MaxIdleConns.
+const defaultMaxIdleDNSConns = 2
+
+// A DNSResolver resolves host names by sending DNS queries to a DNS server through the proxy.
+// This prevents DNS queries for proxied targets from leaking outside of the tunnel.
+// Proxied connections to the DNS server are reused for subsequent queries.
+//
+// Alternatively, clients can pass the host name of the target to the proxy,
+// which then resolves the host name itself. The address that the proxy connected to
+// is available as the RemoteAddr of the proxied connection.
+type DNSResolver struct {
+	// ClientConn is the connection to the proxy.
+	ClientConn *ClientConn
+	// Template is the URI template of the proxy.
+	Template *uritemplate.Template
+	// Server is the address (host:port) of the DNS server.
+	// If the host is a DNS name, it is resolved by the proxy.
+	Server string
+	// MaxIdleConns is the maximum number of idle proxied connections kept for reuse.
+	// If zero, 2 connections are kept.
+	MaxIdleConns int
+
+	mx     sync.Mutex
+	closed bool
+	idle   []*Conn
+}
+
+var _ HostResolver = &DNSResolver{}
+
+// NetResolver returns a [net.Resolver] that sends all queries through the proxy.
+// DNS over TCP is not supported.
+func (r *DNSResolver) NetResolver() *net.Resolver {
+	return &net.Resolver{PreferGo: true, Dial: r.dial}
+}
+
+// LookupNetIP looks up host, sending the DNS queries through the proxy.
+func (r *DNSResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return r.NetResolver().LookupNetIP(ctx, network, host)
+}
+
+func (r *DNSResolver) dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("masque: unsupported network for DNS: %s", network)
+	}
+
+	r.mx.Lock()
+	if r.closed {
+		r.mx.Unlock()
+		return nil, net.ErrClosed
+	}
+	if n := len(r.idle); n > 0 {
+		conn := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mx.Unlock()
+		return &dnsConn{Conn: conn, resolver: r}, nil
+	}
+	r.mx.Unlock()
+
+	req, err := NewRequest(ctx, r.Template, r.Server)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := r.ClientConn.Dial(req)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsConn{Conn: conn, resolver: r}, nil
+}
+
+func (r *DNSResolver) putIdle(conn *Conn) {
+	maxIdle := r.MaxIdleConns
+	if maxIdle == 0 {
+		maxIdle = defaultMaxIdleDNSConns
+	}
+	// Responses to queries that timed out might still arrive later.
+	// The resolver ignores responses that don't match the query ID.
+	if err := conn.SetDeadline(time.Time{}); err == nil {
+		r.mx.Lock()
+		if !r.closed && len(r.idle) < maxIdle {
+			r.idle = append(r.idle, conn)
+			r.mx.Unlock()
+			return
+		}
+		r.mx.Unlock()
+	}
+	conn.Close()
+}
+
+// Close closes all idle proxied connections.
+// It doesn't close the ClientConn.
+func (r *DNSResolver) Close() error {
+	r.mx.Lock()
+	r.closed = true
+	idle := r.idle
+	r.idle = nil
+	r.mx.Unlock()
+
+	var errs []error
+	for _, conn := range idle {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// dnsConn is a net.Conn used by the Go resolver.
+// Since it implements net.PacketConn, the resolver doesn't use TCP framing.
+type dnsConn struct {
+	*Conn
+	resolver *DNSResolver
+	broken   bool
+}
+
+var (
+	_ net.Conn       = &dnsConn{}
+	_ net.PacketConn = &dnsConn{}
+)
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	var icmpErr *ICMPError
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.As(err, &icmpErr) {
+		c.broken = true
+	}
+	return n, err
+}
+
+func (c *dnsConn) Write(b []byte) (int, error) {
+	n, err := c.WriteTo(b, nil)
+	if err != nil {
+		c.broken = true
+	}
+	return n, err
+}
+
+// Close returns the proxied connection to the pool of idle connections.
+func (c *dnsConn) Close() error {
+	if c.broken {
+		return c.Conn.Close()
+	}
+	c.resolver.putIdle(c.Conn)
+	return nil
+}
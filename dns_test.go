@@ -0,0 +1,113 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yosida95/uritemplate/v3"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/stretchr/testify/require"
+)
+
+// runDNSServer runs a DNS server that answers all A queries with the given address.
+// It reports the source address of every query on the returned channel.
+func runDNSServer(t *testing.T, answer netip.Addr) (*net.UDPConn, <-chan net.Addr) {
+	t.Helper()
+	conn := newUDPConnLocalhost(t)
+	queries := make(chan net.Addr, 10)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(b[:n]); err != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			queries <- addr
+			msg.Response = true
+			msg.Authoritative = true
+			q := msg.Questions[0]
+			if q.Type == dnsmessage.TypeA {
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					Body:   &dnsmessage.AResource{A: answer.As4()},
+				}}
+			}
+			rsp, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(rsp, addr)
+		}
+	}()
+	return conn, queries
+}
+
+func TestDNSResolver(t *testing.T) {
+	dnsServer, queries := runDNSServer(t, netip.MustParseAddr("192.0.2.1"))
+
+	conn := newUDPConnLocalhost(t)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", conn.LocalAddr().(*net.UDPAddr).Port))
+	proxy := masque.Proxy{}
+	defer proxy.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/masque", func(w http.ResponseWriter, r *http.Request) {
+		req, err := masque.ParseProxyRequest(r, template)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		proxy.Proxy(w, req)
+	})
+	server := http3.Server{TLSConfig: tlsConf, EnableDatagrams: true, Handler: mux}
+	defer server.Close()
+	go server.Serve(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(5*time.Second))
+	defer cancel()
+	qconn, err := quic.DialAddr(
+		ctx,
+		conn.LocalAddr().String(),
+		&tls.Config{ServerName: "localhost", RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true},
+	)
+	require.NoError(t, err)
+	defer qconn.CloseWithError(0, "")
+	cc, err := new(masque.Transport).NewClientConn(qconn)
+	require.NoError(t, err)
+
+	resolver := &masque.DNSResolver{ClientConn: cc, Template: template, Server: dnsServer.LocalAddr().String()}
+	defer resolver.Close()
+
+	var queryAddr net.Addr
+	for i := range 3 {
+		addrs, err := resolver.LookupNetIP(ctx, "ip4", "quic-go.test.")
+		require.NoError(t, err)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, addrs)
+		select {
+		case addr := <-queries:
+			// All queries are sent through the same proxied connection.
+			if i == 0 {
+				queryAddr = addr
+			} else {
+				require.Equal(t, queryAddr.String(), addr.String())
+			}
+		default:
+			t.Fatal("DNS server didn't receive a query")
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package masque
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// maxEthernetFrameSize is the maximum size of an Ethernet frame, including a VLAN tag,
+// but excluding the frame check sequence, which is not sent in HTTP Datagrams (RFC 9729 Section 5).
+const maxEthernetFrameSize = 1518
+
+// ethernetHeaderLen is the length of the destination and source MAC address, and the EtherType.
+const ethernetHeaderLen = 14
+
+// An EthernetPort is a source and a sink of Ethernet frames,
+// for example a TAP device, or a port of an [EthernetBridge].
+type EthernetPort interface {
+	// ReadFrame reads a single Ethernet frame.
+	// If b is too small, the frame is truncated.
+	ReadFrame(b []byte) (int, error)
+	// WriteFrame writes a single Ethernet frame.
+	// When proxying, frames that can't be written are dropped,
+	// and only an error wrapping net.ErrClosed ends the flow.
+	WriteFrame(b []byte) error
+	// Close closes the port. Blocked ReadFrame calls are unblocked and return an error.
+	Close() error
+}
+
+// An EthernetConn is a Layer 2 tunnel established using CONNECT-ETHERNET (RFC 9729).
+// Ethernet frames are sent in HTTP Datagrams, using the same context ID handling as for CONNECT-UDP.
+// Since HTTP Datagrams can't be fragmented, frames larger than the maximum datagram size
+// of the QUIC connection to the proxy can't be sent.
+type EthernetConn struct {
+	conn *Conn
+}
+
+var _ EthernetPort = &EthernetConn{}
+
+// DialEthernet establishes a Layer 2 tunnel over the proxy connection.
+// The request must be created using [NewEthernetRequest].
+func (c *ClientConn) DialEthernet(req *Request) (*EthernetConn, *http.Response, error) {
+	return c.dialEthernet(req, nil)
+}
+
+func (c *ClientConn) dialEthernet(req *Request, closeConn func() error) (*EthernetConn, *http.Response, error) {
+	if req.req.Proto != ProtocolConnectEthernet {
+		return nil, nil, errors.New("masque: not a CONNECT-ETHERNET request")
+	}
+	rstr, rsp, err := c.connect(req)
+	if err != nil {
+		return nil, rsp, err
+	}
+	conn := newProxiedConn(c, rstr, masqueAddr{c.conn.LocalAddr().String()}, masqueAddr{req.req.Host}, req.capsuleHandlers, closeConn)
+	return &EthernetConn{conn: conn}, rsp, nil
+}
+
+// ReadFrame reads an Ethernet frame received from the proxy.
+func (c *EthernetConn) ReadFrame(b []byte) (int, error) {
+	n, _, err := c.conn.ReadFrom(b)
+	return n, err
+}
+
+// WriteFrame sends an Ethernet frame to the proxy.
+// The frame must not include the frame check sequence.
+func (c *EthernetConn) WriteFrame(b []byte) error {
+	_, err := c.conn.WriteTo(b, nil)
+	return err
+}
+
+// SetReadDeadline sets the deadline for ReadFrame calls.
+func (c *EthernetConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Stats returns statistics about the tunnel.
+// Ethernet frames are counted as datagrams.
+func (c *EthernetConn) Stats() ConnStats {
+	return c.conn.Stats()
+}
+
+// SendCapsule sends a capsule on the request stream.
+func (c *EthernetConn) SendCapsule(ct http3.CapsuleType, value []byte) error {
+	return c.conn.SendCapsule(ct, value)
+}
+
+// Close closes the tunnel.
+func (c *EthernetConn) Close() error {
+	return c.conn.Close()
+}
+
+// maxBridgeQueueLen is the number of frames queued per port of an EthernetBridge.
+// Further frames are dropped until the port reads frames from the queue.
+const maxBridgeQueueLen = 64
+
+// An EthernetBridge is an in-memory learning bridge connecting multiple [EthernetPort]s.
+// Frames are forwarded to the port that the destination MAC address was learned on.
+// Frames to unknown, broadcast and multicast destinations are flooded to all other ports.
+// It can be used to connect multiple CONNECT-ETHERNET flows to the same network segment,
+// and in tests.
+// The zero value is ready to use.
+type EthernetBridge struct {
+	mx    sync.Mutex
+	ports map[*bridgePort]struct{}
+	macs  map[[6]byte]*bridgePort
+}
+
+// NewPort adds a new port to the bridge.
+// Closing the port removes it from the bridge.
+func (b *EthernetBridge) NewPort() EthernetPort {
+	p := &bridgePort{
+		bridge: b,
+		queue:  make(chan []byte, maxBridgeQueueLen),
+		closed: make(chan struct{}),
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.ports == nil {
+		b.ports = make(map[*bridgePort]struct{})
+		b.macs = make(map[[6]byte]*bridgePort)
+	}
+	b.ports[p] = struct{}{}
+	return p
+}
+
+func (b *EthernetBridge) forward(from *bridgePort, frame []byte) {
+	dst := [6]byte(frame[0:6])
+	src := [6]byte(frame[6:12])
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if _, ok := b.ports[from]; !ok {
+		return
+	}
+	// The least significant bit of the first octet is set for multicast (and broadcast) addresses.
+	if src[0]&1 == 0 {
+		b.macs[src] = from
+	}
+	if dst[0]&1 == 0 {
+		if p, ok := b.macs[dst]; ok {
+			if p != from {
+				p.enqueue(frame)
+			}
+			return
+		}
+	}
+	for p := range b.ports {
+		if p != from {
+			p.enqueue(frame)
+		}
+	}
+}
+
+func (b *EthernetBridge) removePort(p *bridgePort) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	delete(b.ports, p)
+	for mac, port := range b.macs {
+		if port == p {
+			delete(b.macs, mac)
+		}
+	}
+}
+
+type bridgePort struct {
+	bridge    *EthernetBridge
+	queue     chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ EthernetPort = &bridgePort{}
+
+func (p *bridgePort) ReadFrame(b []byte) (int, error) {
+	select {
+	case frame := <-p.queue:
+		return copy(b, frame), nil
+	case <-p.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (p *bridgePort) WriteFrame(b []byte) error {
+	select {
+	case <-p.closed:
+		return net.ErrClosed
+	default:
+	}
+	if len(b) < ethernetHeaderLen {
+		return errors.New("masque: Ethernet frame too short")
+	}
+	p.bridge.forward(p, b)
+	return nil
+}
+
+func (p *bridgePort) enqueue(frame []byte) {
+	select {
+	case p.queue <- append([]byte(nil), frame...):
+	default: // queue full, drop the frame
+	}
+}
+
+func (p *bridgePort) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.bridge.removePort(p)
+	})
+	return nil
+}
@@ -0,0 +1,269 @@
+package masque
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/dunglas/httpsfv"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// A Handler is an [http.Handler] that runs a complete CONNECT-UDP proxy.
+// It is intended to be used as the handler of an [http3.Server] with EnableDatagrams set.
+// If Proxy.AllowTCP is set, it also serves CONNECT-TCP requests for the same templates.
+//
+// It validates that the request is a CONNECT-UDP or CONNECT-TCP request for one of the templates of the Router,
+// that both the server and the client enabled HTTP Datagrams (for CONNECT-UDP),
+// authorizes the request and enforces the flow limits, and then proxies the request using the Proxy.
+// The resolver and the access control list for target addresses are configured on the Proxy.
+type Handler struct {
+	// Router is used to match requests against the URI templates. It must be set.
+	Router *TemplateRouter
+	// Proxy proxies the requests.
+	// If nil, a zero Proxy is used.
+	Proxy *Proxy
+
+	// Authorize, if set, is called for every CONNECT-UDP and CONNECT-TCP request before it is proxied.
+	// The protocol of the request is available in ProxyRequest.Protocol.
+	// If it returns false, the request is rejected, and Authorize must have written the response,
+	// for example a 407 response with a Proxy-Authenticate header field.
+	Authorize func(w http.ResponseWriter, r *ProxyRequest) bool
+
+	// MaxFlows is the maximum number of concurrently proxied flows.
+	// Requests exceeding this limit are rejected with a 503 status code.
+	// If zero, the number of flows is not limited.
+	MaxFlows int
+	// MaxFlowsPerClient is the maximum number of concurrently proxied flows per client IP address.
+	// Requests exceeding this limit are rejected with a 429 status code.
+	// If zero, the number of flows per client is not limited.
+	MaxFlowsPerClient int
+	// FlowLimiter counts the flows to enforce MaxFlows and MaxFlowsPerClient.
+	// Handlers sharing a FlowLimiter apply their limits to the flows of all of them,
+	// for example when a Handler is replaced to apply a new configuration.
+	// If nil, the Handler only counts its own flows.
+	FlowLimiter *FlowLimiter
+
+	// Fallback handles all requests that aren't CONNECT-UDP or CONNECT-TCP requests.
+	// If nil, these requests are rejected with a 404 status code.
+	Fallback http.Handler
+
+	initOnce sync.Once
+	proxy    *Proxy
+	limiter  *FlowLimiter
+}
+
+var _ http.Handler = &Handler{}
+
+func (h *Handler) init() {
+	h.initOnce.Do(func() {
+		h.proxy = h.Proxy
+		if h.proxy == nil {
+			h.proxy = &Proxy{}
+		}
+		h.limiter = h.FlowLimiter
+		if h.limiter == nil {
+			h.limiter = &FlowLimiter{}
+		}
+	})
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.init()
+
+	if r.Method != http.MethodConnect || (r.Proto != ProtocolConnectUDP && r.Proto != ProtocolConnectTCP) {
+		if h.Fallback != nil {
+			h.Fallback.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	// Requests rejected before they are parsed are logged with the protocol and the client address.
+	unparsed := &ProxyRequest{Protocol: r.Proto, req: r}
+	if r.Proto == ProtocolConnectTCP && !h.proxy.AllowTCP {
+		w.WriteHeader(http.StatusNotImplemented)
+		h.logRejected(unparsed, http.StatusNotImplemented, "masque: CONNECT-TCP not enabled")
+		return
+	}
+	if r.Proto == ProtocolConnectUDP {
+		if status, err := h.checkDatagrams(w, r); err != nil {
+			if status != 0 {
+				h.logRejected(unparsed, status, err.Error())
+			}
+			return
+		}
+	}
+	if _, ok := w.(http3.HTTPStreamer); !ok {
+		w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		h.logRejected(unparsed, http.StatusHTTPVersionNotSupported, "masque: not an HTTP/3 request")
+		return
+	}
+
+	req, err := h.Router.ParseProxyRequest(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		var perr *ProxyRequestParseError
+		if errors.As(err, &perr) {
+			status = perr.HTTPStatus
+		}
+		w.WriteHeader(status)
+		h.logRejected(unparsed, status, err.Error())
+		return
+	}
+	if h.Authorize != nil {
+		sw := &statusWriter{ResponseWriter: w}
+		if !h.Authorize(sw, req) {
+			h.logRejected(req, sw.Status(), "masque: request not authorized")
+			return
+		}
+	}
+
+	client := clientKey(req)
+	if status := h.limiter.add(client, h.MaxFlows, h.MaxFlowsPerClient); status != 0 {
+		writeProxyError(w, req.Host, ProxyErrorConnectionLimitReached, status)
+		h.logRejected(req, status, "masque: connection limit reached")
+		return
+	}
+	defer h.limiter.remove(client)
+	h.proxy.Proxy(w, req)
+}
+
+// checkDatagrams checks that both the server and the client enabled HTTP Datagrams.
+// If not, it writes the response and returns its status code, together with the reason.
+// If the request is cancelled while waiting for the client's SETTINGS, no response is written,
+// and the status code is 0.
+func (h *Handler) checkDatagrams(w http.ResponseWriter, r *http.Request) (int, error) {
+	if server, ok := r.Context().Value(http3.ServerContextKey).(*http3.Server); ok && !server.EnableDatagrams {
+		log.Printf("rejecting CONNECT-UDP request: the http3.Server needs to enable Datagrams")
+		writeProxyError(w, r.Host, ProxyErrorProxyConfigurationError, http.StatusInternalServerError)
+		return http.StatusInternalServerError, errors.New("masque: HTTP Datagrams not enabled on the server")
+	}
+	// The client needs to enable HTTP Datagrams as well.
+	// Extended CONNECT is always enabled by the http3.Server.
+	if settingser, ok := r.Body.(http3.Settingser); ok {
+		select {
+		case <-settingser.ReceivedSettings():
+		case <-r.Context().Done():
+			return 0, r.Context().Err()
+		}
+		if !settingser.Settings().EnableDatagrams {
+			w.WriteHeader(http.StatusBadRequest)
+			return http.StatusBadRequest, errors.New("masque: HTTP Datagrams not enabled by the client")
+		}
+	}
+	return 0, nil
+}
+
+// logRejected logs a request rejected by the Handler to Proxy.AccessLog.
+// The response must already have been written.
+func (h *Handler) logRejected(r *ProxyRequest, status int, reason string) {
+	rec := newFlowRecord(r)
+	rec.Status = status
+	rec.CloseReason = reason
+	h.proxy.logFlow(rec)
+}
+
+// statusWriter records the status code of the response written by Handler.Authorize.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Status returns the status code of the response.
+// If no response was written, the status code is 200, like for every http.Handler.
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap allows using an http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// A FlowLimiter counts the flows proxied by one or more Handlers, per client IP address.
+// The limits are configured on the Handler, see Handler.FlowLimiter.
+// The zero value is ready to use.
+type FlowLimiter struct {
+	mx          sync.Mutex
+	flows       int
+	clientFlows map[string]int
+}
+
+// add adds a flow for the client.
+// If a limit is exceeded, it returns the status code that the request should be rejected with.
+func (l *FlowLimiter) add(client string, maxFlows, maxFlowsPerClient int) int {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if maxFlows > 0 && l.flows >= maxFlows {
+		return http.StatusServiceUnavailable
+	}
+	if maxFlowsPerClient > 0 && l.clientFlows[client] >= maxFlowsPerClient {
+		return http.StatusTooManyRequests
+	}
+	l.flows++
+	if l.clientFlows == nil {
+		l.clientFlows = make(map[string]int)
+	}
+	l.clientFlows[client]++
+	return 0
+}
+
+func (l *FlowLimiter) remove(client string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.flows--
+	l.clientFlows[client]--
+	if l.clientFlows[client] == 0 {
+		delete(l.clientFlows, client)
+	}
+}
+
+// Close closes the Proxy, and with it all proxied flows.
+func (h *Handler) Close() error {
+	h.init()
+	return h.proxy.Close()
+}
+
+// clientKey identifies the client by its IP address.
+func clientKey(r *ProxyRequest) string {
+	addr := r.RemoteAddr()
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	if req := r.Request(); req != nil {
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			return host
+		}
+		return req.RemoteAddr
+	}
+	return ""
+}
+
+func writeProxyError(w http.ResponseWriter, proxy, errType string, status int) {
+	proxyStatus := httpsfv.NewItem(proxy)
+	proxyStatus.Params.Add("error", errType)
+	if v, err := httpsfv.Marshal(proxyStatus); err == nil {
+		w.Header().Add("Proxy-Status", v)
+	}
+	w.WriteHeader(status)
+}
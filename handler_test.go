@@ -0,0 +1,345 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+func runHandler(t *testing.T, handler *masque.Handler) *uritemplate.Template {
+	t.Helper()
+	conn := newUDPConnLocalhost(t)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", conn.LocalAddr().(*net.UDPAddr).Port))
+	router, err := masque.NewTemplateRouter(template)
+	require.NoError(t, err)
+	handler.Router = router
+	t.Cleanup(func() { handler.Close() })
+	server := &http3.Server{
+		TLSConfig:       tlsConf,
+		EnableDatagrams: true,
+		Handler:         handler,
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve(conn)
+	return template
+}
+
+func TestHandler(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	template := runHandler(t, &masque.Handler{})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+	require.NoError(t, err)
+	conn, rsp, err := tr.Dial(req)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	checkEcho(t, conn, "foo")
+
+	// a request for a different path
+	u, err := url.Parse(template.Raw())
+	require.NoError(t, err)
+	req, err = masque.NewRequest(context.Background(), uritemplate.MustNew("https://"+u.Host+"/foo/{target_host}/{target_port}"), "127.0.0.1:1234")
+	require.NoError(t, err)
+	_, rsp, err = tr.Dial(req)
+	require.Error(t, err)
+	require.Equal(t, http.StatusNotFound, rsp.StatusCode)
+}
+
+func TestHandlerNonMASQUERequests(t *testing.T) {
+	t.Run("without fallback", func(t *testing.T) {
+		template := runHandler(t, &masque.Handler{})
+		h3tr := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: certPool}}
+		defer h3tr.Close()
+		cl := &http.Client{Transport: h3tr}
+		u, err := template.Expand(uritemplate.Values{})
+		require.NoError(t, err)
+		rsp, err := cl.Get(u)
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		require.Equal(t, http.StatusNotFound, rsp.StatusCode)
+	})
+
+	t.Run("with fallback", func(t *testing.T) {
+		template := runHandler(t, &masque.Handler{
+			Fallback: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte("hello world"))
+			}),
+		})
+		h3tr := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: certPool}}
+		defer h3tr.Close()
+		cl := &http.Client{Transport: h3tr}
+		u, err := template.Expand(uritemplate.Values{})
+		require.NoError(t, err)
+		rsp, err := cl.Get(u)
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+		body, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "hello world", string(body))
+	})
+}
+
+func TestHandlerRequiresDatagrams(t *testing.T) {
+	template := uritemplate.MustNew("https://localhost:1234/masque?h={target_host}&p={target_port}")
+	router, err := masque.NewTemplateRouter(template)
+	require.NoError(t, err)
+	handler := &masque.Handler{Router: router}
+	defer handler.Close()
+
+	req := newRequest("https://localhost:1234/masque?h=localhost&p=1337")
+	req = req.WithContext(context.WithValue(req.Context(), http3.ServerContextKey, &http3.Server{}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	statuses, err := masque.ParseProxyStatus(rec.Header())
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	require.Equal(t, masque.ProxyErrorProxyConfigurationError, statuses[0].Error)
+}
+
+func TestHandlerAuthorization(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	template := runHandler(t, &masque.Handler{
+		Authorize: func(w http.ResponseWriter, r *masque.ProxyRequest) bool {
+			if r.Request().Header.Get("Proxy-Authorization") == "Bearer secret" {
+				return true
+			}
+			w.Header().Set("Proxy-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return false
+		},
+	})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+
+	req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+	require.NoError(t, err)
+	_, rsp, err := tr.Dial(req)
+	require.Error(t, err)
+	require.Equal(t, http.StatusProxyAuthRequired, rsp.StatusCode)
+	require.Equal(t, "Bearer", rsp.Header.Get("Proxy-Authenticate"))
+
+	req, err = masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+	require.NoError(t, err)
+	req.Header().Set("Proxy-Authorization", "Bearer secret")
+	conn, rsp, err := tr.Dial(req)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	checkEcho(t, conn, "foo")
+}
+
+func TestHandlerAccessLogRejected(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	records := make(chan *masque.FlowRecord, 4)
+	template := runHandler(t, &masque.Handler{
+		Proxy:    &masque.Proxy{AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+		MaxFlows: 1,
+		Authorize: func(w http.ResponseWriter, r *masque.ProxyRequest) bool {
+			if r.Request().Header.Get("Proxy-Authorization") == "Bearer secret" {
+				return true
+			}
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return false
+		},
+	})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	target := remoteServerConn.LocalAddr().String()
+	dial := func(t *testing.T, template *uritemplate.Template) (*masque.Conn, *http.Response, error) {
+		t.Helper()
+		req, err := masque.NewRequest(context.Background(), template, target)
+		require.NoError(t, err)
+		req.Header().Set("Proxy-Authorization", "Bearer secret")
+		return tr.Dial(req)
+	}
+	expectRecord := func(t *testing.T, status int, target, reason string) {
+		t.Helper()
+		select {
+		case rec := <-records:
+			require.Equal(t, status, rec.Status)
+			require.Equal(t, target, rec.Target)
+			require.Contains(t, rec.CloseReason, reason)
+			require.Equal(t, masque.ProtocolConnectUDP, rec.Protocol)
+			require.NotNil(t, rec.ClientAddr)
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	}
+
+	t.Run("not authorized", func(t *testing.T) {
+		req, err := masque.NewRequest(context.Background(), template, target)
+		require.NoError(t, err)
+		_, rsp, err := tr.Dial(req)
+		require.Error(t, err)
+		require.Equal(t, http.StatusProxyAuthRequired, rsp.StatusCode)
+		expectRecord(t, http.StatusProxyAuthRequired, target, "masque: request not authorized")
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		u, err := url.Parse(template.Raw())
+		require.NoError(t, err)
+		_, rsp, err := dial(t, uritemplate.MustNew("https://"+u.Host+"/foo/{target_host}/{target_port}"))
+		require.Error(t, err)
+		require.Equal(t, http.StatusNotFound, rsp.StatusCode)
+		expectRecord(t, http.StatusNotFound, "", "no template matches")
+	})
+
+	t.Run("connection limit", func(t *testing.T) {
+		conn, _, err := dial(t, template)
+		require.NoError(t, err)
+		_, rsp, err := dial(t, template)
+		require.Error(t, err)
+		require.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+		expectRecord(t, http.StatusServiceUnavailable, target, "masque: connection limit reached")
+		require.NoError(t, conn.Close())
+		expectRecord(t, http.StatusOK, target, masque.CloseReasonClient)
+	})
+}
+
+func TestHandlerAccessControl(t *testing.T) {
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{
+			Resolver: fakeResolver{"example.com": {netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.0.2.1")}},
+			AllowTarget: func(_ *masque.ProxyRequest, addr netip.AddrPort) bool {
+				return !addr.Addr().IsPrivate() && !addr.Addr().IsLoopback()
+			},
+		},
+	})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+
+	req, err := masque.NewRequest(context.Background(), template, "127.0.0.1:1234")
+	require.NoError(t, err)
+	_, rsp, err := tr.Dial(req)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, rsp.StatusCode)
+	var proxyErr *masque.ProxyError
+	require.ErrorAs(t, err, &proxyErr)
+	require.True(t, proxyErr.IsDenied())
+	require.Equal(t, masque.ProxyErrorDestinationIPProhibited, proxyErr.ErrorType())
+
+	// private addresses are skipped
+	req, err = masque.NewRequest(context.Background(), template, "example.com:1234")
+	require.NoError(t, err)
+	conn, rsp, err := tr.Dial(req)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	require.Equal(t, "192.0.2.1:1234", conn.RemoteAddr().String())
+}
+
+func TestHandlerFlowLimits(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	for _, tc := range []struct {
+		name    string
+		handler *masque.Handler
+		status  int
+	}{
+		{name: "total", handler: &masque.Handler{MaxFlows: 2}, status: http.StatusServiceUnavailable},
+		{name: "per client", handler: &masque.Handler{MaxFlowsPerClient: 2}, status: http.StatusTooManyRequests},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			template := runHandler(t, tc.handler)
+			dial := func() (*masque.Conn, *http.Response, error) {
+				req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+				require.NoError(t, err)
+				return tr.Dial(req)
+			}
+			var conns []*masque.Conn
+			for range 2 {
+				conn, _, err := dial()
+				require.NoError(t, err)
+				conns = append(conns, conn)
+			}
+			_, rsp, err := dial()
+			require.Error(t, err)
+			require.Equal(t, tc.status, rsp.StatusCode)
+			var proxyErr *masque.ProxyError
+			require.ErrorAs(t, err, &proxyErr)
+			require.Equal(t, masque.ProxyErrorConnectionLimitReached, proxyErr.ErrorType())
+			require.True(t, proxyErr.Retryable())
+
+			// once a flow is closed, new flows can be proxied
+			require.NoError(t, conns[0].Close())
+			require.Eventually(t, func() bool {
+				conn, _, err := dial()
+				if err != nil {
+					return false
+				}
+				conn.Close()
+				return true
+			}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+			require.NoError(t, conns[1].Close())
+		})
+	}
+}
+
+func TestHandlerSharedFlowLimiter(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	// the second Handler replaces the first one, for example after a configuration change
+	var limiter masque.FlowLimiter
+	proxy := &masque.Proxy{}
+	template1 := runHandler(t, &masque.Handler{Proxy: proxy, MaxFlows: 1, FlowLimiter: &limiter})
+	template2 := runHandler(t, &masque.Handler{Proxy: proxy, MaxFlows: 1, FlowLimiter: &limiter})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	dial := func(template *uritemplate.Template) (*masque.Conn, *http.Response, error) {
+		req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+		require.NoError(t, err)
+		return tr.Dial(req)
+	}
+
+	conn, _, err := dial(template1)
+	require.NoError(t, err)
+	// the flow proxied by the first Handler counts towards the limit of the second Handler
+	_, rsp, err := dial(template2)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		conn, _, err := dial(template2)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+}
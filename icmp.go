@@ -0,0 +1,210 @@
+package masque
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// capsuleTypeICMPError is the capsule used by the proxy to relay ICMP errors
+// that it received for a proxied flow to the client.
+// This capsule type is not registered with IANA. It was picked from the unassigned range,
+// and since RFC 9297 requires endpoints to skip unknown capsules,
+// clients that don't implement it just ignore it.
+const capsuleTypeICMPError http3.CapsuleType = 0x2b7a4c0e
+
+const (
+	icmpv4TypeDestinationUnreachable = 3
+	icmpv4TypeTimeExceeded           = 11
+	icmpv4CodeNetworkUnreachable     = 0
+	icmpv4CodeHostUnreachable        = 1
+	icmpv4CodePortUnreachable        = 3
+	icmpv4CodeFragmentationNeeded    = 4
+
+	icmpv6TypeDestinationUnreachable = 1
+	icmpv6TypePacketTooBig           = 2
+	icmpv6TypeTimeExceeded           = 3
+	icmpv6CodeNoRoute                = 0
+	icmpv6CodeAddressUnreachable     = 3
+	icmpv6CodePortUnreachable        = 4
+)
+
+// maxQueuedICMPErrors is the maximum number of ICMP errors queued on a Conn.
+// Additional ICMP errors are dropped until the application has called ReadFrom.
+const maxQueuedICMPErrors = 16
+
+// An ICMPError is an ICMP or ICMPv6 error that the proxy received for a proxied flow.
+// It is returned from [Conn.ReadFrom].
+// The flow remains usable after an ICMP error was received.
+type ICMPError struct {
+	// IPv6 is true for ICMPv6 errors.
+	IPv6 bool
+	// Type and Code are the type and code of the ICMP message.
+	Type, Code uint8
+	// MTU is the next-hop MTU reported in a Fragmentation Needed (ICMP)
+	// or Packet Too Big (ICMPv6) message. It is 0 for all other messages.
+	MTU int
+}
+
+var _ net.Error = &ICMPError{}
+
+// PortUnreachable says if the target port is unreachable.
+func (e *ICMPError) PortUnreachable() bool {
+	if e.IPv6 {
+		return e.Type == icmpv6TypeDestinationUnreachable && e.Code == icmpv6CodePortUnreachable
+	}
+	return e.Type == icmpv4TypeDestinationUnreachable && e.Code == icmpv4CodePortUnreachable
+}
+
+// HostUnreachable says if the target host (or the network it's in) is unreachable.
+func (e *ICMPError) HostUnreachable() bool {
+	if e.IPv6 {
+		return e.Type == icmpv6TypeDestinationUnreachable && e.Code != icmpv6CodePortUnreachable
+	}
+	return e.Type == icmpv4TypeDestinationUnreachable &&
+		e.Code != icmpv4CodePortUnreachable && e.Code != icmpv4CodeFragmentationNeeded
+}
+
+// PacketTooBig says if the packet was too big to be forwarded to the target.
+// The path MTU is then reported in MTU.
+func (e *ICMPError) PacketTooBig() bool {
+	if e.IPv6 {
+		return e.Type == icmpv6TypePacketTooBig
+	}
+	return e.Type == icmpv4TypeDestinationUnreachable && e.Code == icmpv4CodeFragmentationNeeded
+}
+
+// TimeExceeded says if the packet's hop limit was exceeded.
+func (e *ICMPError) TimeExceeded() bool {
+	if e.IPv6 {
+		return e.Type == icmpv6TypeTimeExceeded
+	}
+	return e.Type == icmpv4TypeTimeExceeded
+}
+
+func (e *ICMPError) Error() string {
+	var desc string
+	switch {
+	case e.PortUnreachable():
+		desc = "port unreachable"
+	case e.HostUnreachable():
+		desc = "host unreachable"
+	case e.PacketTooBig():
+		desc = fmt.Sprintf("packet too big (MTU: %d)", e.MTU)
+	case e.TimeExceeded():
+		desc = "time exceeded"
+	default:
+		desc = "error"
+	}
+	proto := "ICMP"
+	if e.IPv6 {
+		proto = "ICMPv6"
+	}
+	return fmt.Sprintf("masque: %s %s (type %d, code %d)", proto, desc, e.Type, e.Code)
+}
+
+// Unwrap returns the error that a connected UDP socket would return for this ICMP error.
+// This allows checking for errors using errors.Is(err, syscall.ECONNREFUSED).
+func (e *ICMPError) Unwrap() error {
+	switch {
+	case e.PortUnreachable():
+		return syscall.ECONNREFUSED
+	case e.HostUnreachable():
+		return syscall.EHOSTUNREACH
+	case e.PacketTooBig():
+		return syscall.EMSGSIZE
+	}
+	return nil
+}
+
+func (e *ICMPError) Timeout() bool { return false }
+
+// Temporary returns true, since the flow can still be used after an ICMP error.
+// This is what quic-go uses to decide whether to continue reading from a net.PacketConn.
+func (e *ICMPError) Temporary() bool { return true }
+
+func (e *ICMPError) append(b []byte) []byte {
+	version := uint64(4)
+	if e.IPv6 {
+		version = 6
+	}
+	b = quicvarint.Append(b, version)
+	b = quicvarint.Append(b, uint64(e.Type))
+	b = quicvarint.Append(b, uint64(e.Code))
+	return quicvarint.Append(b, uint64(e.MTU))
+}
+
+func parseICMPErrorCapsule(r io.Reader) (*ICMPError, error) {
+	vr := quicvarint.NewReader(r)
+	var vals [4]uint64
+	for i := range vals {
+		v, err := quicvarint.Read(vr)
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		vals[i] = v
+	}
+	if vals[0] != 4 && vals[0] != 6 {
+		return nil, fmt.Errorf("masque: invalid IP version in ICMP error capsule: %d", vals[0])
+	}
+	if vals[1] > 0xff || vals[2] > 0xff {
+		return nil, errors.New("masque: invalid ICMP type or code")
+	}
+	// make sure the whole capsule is consumed
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+	return &ICMPError{
+		IPv6: vals[0] == 6,
+		Type: uint8(vals[1]),
+		Code: uint8(vals[2]),
+		MTU:  int(vals[3]),
+	}, nil
+}
+
+// isICMPErrno says if an error returned from a connected UDP socket was caused by an ICMP error.
+func isICMPErrno(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EMSGSIZE)
+}
+
+// icmpErrorFromErrno synthesizes an ICMP error from the error returned from a connected UDP socket.
+// It is used on platforms where the original ICMP message is not available.
+func icmpErrorFromErrno(err error, ipv6 bool) *ICMPError {
+	e := &ICMPError{IPv6: ipv6}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		e.Type, e.Code = icmpv4TypeDestinationUnreachable, icmpv4CodePortUnreachable
+		if ipv6 {
+			e.Type, e.Code = icmpv6TypeDestinationUnreachable, icmpv6CodePortUnreachable
+		}
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		e.Type, e.Code = icmpv4TypeDestinationUnreachable, icmpv4CodeHostUnreachable
+		if ipv6 {
+			e.Type, e.Code = icmpv6TypeDestinationUnreachable, icmpv6CodeAddressUnreachable
+		}
+	case errors.Is(err, syscall.ENETUNREACH):
+		e.Type, e.Code = icmpv4TypeDestinationUnreachable, icmpv4CodeNetworkUnreachable
+		if ipv6 {
+			e.Type, e.Code = icmpv6TypeDestinationUnreachable, icmpv6CodeNoRoute
+		}
+	case errors.Is(err, syscall.EMSGSIZE):
+		e.Type, e.Code = icmpv4TypeDestinationUnreachable, icmpv4CodeFragmentationNeeded
+		if ipv6 {
+			e.Type, e.Code = icmpv6TypePacketTooBig, 0
+		}
+	default:
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,124 @@
+//go:build linux
+
+package masque
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// enableICMPErrors enables queueing of extended errors (IP_RECVERR / IPV6_RECVERR),
+// so that the original ICMP messages can be read from the socket's error queue.
+func enableICMPErrors(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rawConn.Control(func(fd uintptr) {
+		domain, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if err != nil {
+			serr = err
+			return
+		}
+		if domain == unix.AF_INET6 {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1)
+			// needed for IPv4-mapped addresses, might fail on IPv6-only sockets
+			_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVERR, 1)
+			return
+		}
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVERR, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// icmpErrorsFromSocket is called when reading from or writing to a connected UDP socket failed.
+// It returns true if the error was caused by an ICMP error, in which case the flow can continue.
+// The ICMP errors are read from the socket's error queue. Since the error queue is shared between
+// the send and the receive side, it might already have been drained when the other side hit the error.
+func icmpErrorsFromSocket(conn *net.UDPConn, err error) ([]*ICMPError, bool) {
+	if !isICMPErrno(err) {
+		return nil, false
+	}
+	rawConn, rerr := conn.SyscallConn()
+	if rerr != nil {
+		return nil, true
+	}
+	var errs []*ICMPError
+	b := make([]byte, 1)
+	oob := make([]byte, 256)
+	for {
+		var oobn int
+		var recvErr error
+		// Reading from the error queue never blocks.
+		// Control is used instead of Read, since Read would wait for a concurrent Read call on conn to return.
+		if err := rawConn.Control(func(fd uintptr) {
+			_, oobn, _, _, recvErr = unix.Recvmsg(int(fd), b, oob, unix.MSG_ERRQUEUE)
+		}); err != nil {
+			return errs, true
+		}
+		if recvErr != nil {
+			if !errors.Is(recvErr, unix.EAGAIN) {
+				return errs, true
+			}
+			break
+		}
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if e := parseSockExtendedErr(msg); e != nil {
+				errs = append(errs, e)
+			}
+		}
+	}
+	return errs, true
+}
+
+func parseSockExtendedErr(msg unix.SocketControlMessage) *ICMPError {
+	isV4 := msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_RECVERR
+	isV6 := msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_RECVERR
+	// struct sock_extended_err {
+	//     __u32 ee_errno;
+	//     __u8  ee_origin;
+	//     __u8  ee_type;
+	//     __u8  ee_code;
+	//     __u8  ee_pad;
+	//     __u32 ee_info;
+	//     __u32 ee_data;
+	// };
+	if (!isV4 && !isV6) || len(msg.Data) < 16 {
+		return nil
+	}
+	errno := unix.Errno(binary.NativeEndian.Uint32(msg.Data[0:4]))
+	origin := msg.Data[4]
+	info := binary.NativeEndian.Uint32(msg.Data[8:12])
+	switch origin {
+	case unix.SO_EE_ORIGIN_ICMP, unix.SO_EE_ORIGIN_ICMP6:
+		e := &ICMPError{
+			IPv6: origin == unix.SO_EE_ORIGIN_ICMP6,
+			Type: msg.Data[5],
+			Code: msg.Data[6],
+		}
+		if e.PacketTooBig() {
+			e.MTU = int(info)
+		}
+		return e
+	case unix.SO_EE_ORIGIN_LOCAL:
+		// The kernel already knows that the packet exceeds the path MTU.
+		if errno != unix.EMSGSIZE {
+			return nil
+		}
+		e := icmpErrorFromErrno(errno, isV6)
+		e.MTU = int(info)
+		return e
+	default:
+		return nil
+	}
+}
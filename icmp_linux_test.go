@@ -0,0 +1,111 @@
+//go:build linux
+
+package masque
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// When sending to the target fails with an ICMP error, the error queue is drained on the send path,
+// while the receive path is blocked reading from the same socket.
+// Draining the error queue must not wait for that read to return,
+// otherwise the flow stalls until the target sends a datagram.
+func TestICMPErrorsFromSocketWithConcurrentRead(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	defer target.Close()
+	conn, err := net.DialUDP("udp", nil, target.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, enableICMPErrors(conn))
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		conn.Read(make([]byte, 1500))
+	}()
+	// give the Go routine some time to block in Read
+	time.Sleep(10 * time.Millisecond)
+
+	type result struct {
+		errs []*ICMPError
+		ok   bool
+	}
+	done := make(chan result, 1)
+	go func() {
+		errs, ok := icmpErrorsFromSocket(conn, syscall.ECONNREFUSED)
+		done <- result{errs: errs, ok: ok}
+	}()
+	select {
+	case res := <-done:
+		require.True(t, res.ok)
+		require.Empty(t, res.errs)
+	case <-time.After(time.Second):
+		t.Fatal("draining the error queue blocked on the concurrent read")
+	}
+	select {
+	case <-readDone:
+		t.Fatal("Read unexpectedly returned")
+	default:
+	}
+	require.NoError(t, conn.Close())
+	<-readDone
+}
+
+// A datagram that fails with an ICMP error while failing over is possible
+// is retransmitted to the next address of the target.
+func TestFailoverOnSend(t *testing.T) {
+	unreachable, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	require.NoError(t, unreachable.Close())
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	defer target.Close()
+
+	conn, err := net.DialUDP("udp", nil, unreachable.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	require.NoError(t, enableICMPErrors(conn))
+	var capsules bytes.Buffer
+	e := &proxyEntry{
+		capsules: &capsuleWriter{w: &capsules},
+		conn:     conn,
+		failover: &failoverState{
+			deadline: time.Now().Add(time.Minute),
+			addrs:    []netip.AddrPort{target.LocalAddr().(*net.UDPAddr).AddrPort()},
+		},
+	}
+	defer e.closeConn()
+
+	c, saved := e.connForSending([]byte("foo"))
+	require.True(t, saved)
+	_, err = c.Write([]byte("foo"))
+	require.NoError(t, err)
+	// wait for the ICMP error to arrive
+	time.Sleep(10 * time.Millisecond)
+
+	c, saved = e.connForSending([]byte("bar"))
+	require.True(t, saved)
+	_, err = c.Write([]byte("bar"))
+	require.Error(t, err)
+	ok, failedOver := e.handleSocketError(c, err)
+	require.True(t, ok)
+	require.True(t, failedOver)
+	require.NotSame(t, c, e.conn)
+	require.NotZero(t, capsules.Len())
+
+	// both datagrams are retransmitted to the next address
+	b := make([]byte, 1500)
+	require.NoError(t, target.SetReadDeadline(time.Now().Add(time.Second)))
+	for _, msg := range []string{"foo", "bar"} {
+		n, _, err := target.ReadFrom(b)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b[:n]))
+	}
+}
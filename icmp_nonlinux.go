@@ -0,0 +1,23 @@
+//go:build !linux
+
+package masque
+
+import "net"
+
+func enableICMPErrors(*net.UDPConn) error { return nil }
+
+// icmpErrorsFromSocket is called when reading from or writing to a connected UDP socket failed.
+// It returns true if the error was caused by an ICMP error, in which case the flow can continue.
+// On this platform, the original ICMP message is not available, and the ICMP error is
+// reconstructed from the error code.
+func icmpErrorsFromSocket(conn *net.UDPConn, err error) ([]*ICMPError, bool) {
+	if !isICMPErrno(err) {
+		return nil, false
+	}
+	return []*ICMPError{icmpErrorFromErrno(err, isIPv6Conn(conn))}, true
+}
+
+func isIPv6Conn(conn *net.UDPConn) bool {
+	addr, ok := conn.RemoteAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
@@ -0,0 +1,185 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// interfaceConn simulates a network interface that can go down.
+// Once it is down, all packets are dropped.
+type interfaceConn struct {
+	net.PacketConn
+	down atomic.Bool
+}
+
+func (c *interfaceConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.down.Load() {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *interfaceConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !c.down.Load() {
+			return n, addr, err
+		}
+	}
+}
+
+func newInterface(t *testing.T) (*interfaceConn, *quic.Transport) {
+	t.Helper()
+	conn := &interfaceConn{PacketConn: newUDPConnLocalhost(t)}
+	tr := &quic.Transport{Conn: conn}
+	t.Cleanup(func() { tr.Close() })
+	return conn, tr
+}
+
+func proxyAddr(t *testing.T, template *uritemplate.Template) *net.UDPAddr {
+	t.Helper()
+	str, err := template.Expand(uritemplate.Values{})
+	require.NoError(t, err)
+	u, err := url.Parse(str)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+// checkEcho checks that datagrams are echoed.
+// Since datagrams are unreliable, and might be lost while the proxy is migrating the connection to the new path,
+// the datagram is retransmitted a few times.
+func checkEcho(t *testing.T, conn net.PacketConn, msg string) {
+	t.Helper()
+	b := make([]byte, 1500)
+	for range 10 {
+		_, err := conn.WriteTo([]byte(msg), nil)
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(scaleDuration(100 * time.Millisecond)))
+		n, _, err := conn.ReadFrom(b)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b[:n]))
+		return
+	}
+	t.Fatal("no echo received")
+}
+
+func TestClientConnMigration(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	_, template, connChan := runProxy(t, nil)
+
+	wifi, wifiTr := newInterface(t)
+	cellular, cellularTr := newInterface(t)
+
+	qconn, err := wifiTr.Dial(
+		context.Background(),
+		proxyAddr(t, template),
+		&tls.Config{ServerName: "localhost", RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true},
+	)
+	require.NoError(t, err)
+	defer qconn.CloseWithError(0, "")
+	cconn, err := (&masque.Transport{}).NewClientConn(qconn)
+	require.NoError(t, err)
+
+	var conns []*masque.Conn
+	for range 2 {
+		req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+		require.NoError(t, err)
+		conn, _, err := cconn.Dial(req)
+		require.NoError(t, err)
+		defer conn.Close()
+		checkEcho(t, conn, "foo")
+		conns = append(conns, conn)
+	}
+	var serverConn *quic.Conn
+	select {
+	case serverConn = <-connChan:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.Equal(t, wifi.LocalAddr().String(), serverConn.RemoteAddr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(time.Second))
+	defer cancel()
+	_, err = conns[0].Migrate(ctx, cellularTr)
+	require.ErrorContains(t, err, "use ClientConn.Migrate")
+	_, err = cconn.Migrate(ctx, cellularTr)
+	require.NoError(t, err)
+	for _, conn := range conns {
+		checkEcho(t, conn, "bar")
+	}
+	// The proxy switches to the new path once it has validated it.
+	// Until then, it might still send packets on the old path.
+	require.Eventually(t, func() bool {
+		return serverConn.RemoteAddr().String() == cellular.LocalAddr().String()
+	}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+
+	// the Wi-Fi connection is gone
+	wifi.down.Store(true)
+	for _, conn := range conns {
+		checkEcho(t, conn, "baz")
+	}
+}
+
+func TestConnMigration(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	_, template, connChan := runProxy(t, nil)
+
+	wifi, wifiTr := newInterface(t)
+	cellular, cellularTr := newInterface(t)
+
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "localhost", RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+		DialAddr: func(ctx context.Context, _ string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+			return wifiTr.Dial(ctx, proxyAddr(t, template), tlsConf, quicConf)
+		},
+	}
+	req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+	require.NoError(t, err)
+	conn, _, err := tr.Dial(req)
+	require.NoError(t, err)
+	defer conn.Close()
+	checkEcho(t, conn, "foo")
+	var serverConn *quic.Conn
+	select {
+	case serverConn = <-connChan:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(time.Second))
+	defer cancel()
+	_, err = conn.Migrate(ctx, cellularTr)
+	require.NoError(t, err)
+	checkEcho(t, conn, "bar")
+	// The proxy switches to the new path once it has validated it.
+	// Until then, it might still send packets on the old path.
+	require.Eventually(t, func() bool {
+		return serverConn.RemoteAddr().String() == cellular.LocalAddr().String()
+	}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+	wifi.down.Store(true)
+	checkEcho(t, conn, "baz")
+}
@@ -0,0 +1,401 @@
+package masque
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+const (
+	// defaultMultiConnIdleTimeout is the default value for MultiConnConfig.IdleTimeout.
+	// This is the minimum UDP mapping timeout recommended by RFC 4787.
+	defaultMultiConnIdleTimeout = 2 * time.Minute
+	// defaultMultiConnMaxFlows is the default value for MultiConnConfig.MaxFlows.
+	defaultMultiConnMaxFlows = 64
+	// maxQueuedMultiConnPackets is the number of received packets queued until they are read.
+	maxQueuedMultiConnPackets = 1024
+)
+
+// MultiConnConfig configures a [MultiConn].
+type MultiConnConfig struct {
+	// IdleTimeout is the duration after which a proxied connection that didn't send or receive any datagrams is closed.
+	// If zero, 2 minutes is used.
+	IdleTimeout time.Duration
+	// MaxFlows is the maximum number of proxied connections kept open at the same time.
+	// When a datagram is sent to a new destination while the limit is reached,
+	// the least recently used proxied connection is closed.
+	// If zero, 64 connections are allowed.
+	MaxFlows int
+}
+
+// A MultiConn is a net.PacketConn that sends datagrams to multiple destinations through the proxy.
+// Unlike [Conn], it honors the address passed to WriteTo:
+// A proxied connection using CONNECT-UDP is dialed when a datagram is first sent to a destination,
+// and datagrams received on that connection are returned by ReadFrom with the destination as the source address.
+//
+// Only IP addresses are supported as destinations.
+// Proxied connections are closed when idle, and dialed again when needed.
+type MultiConn struct {
+	clientConn  *ClientConn
+	template    *uritemplate.Template
+	idleTimeout time.Duration
+	maxFlows    int
+	localAddr   net.Addr
+
+	ctx      context.Context // cancelled when Close is called
+	cancel   context.CancelFunc
+	received chan multiConnPacket
+	wg       sync.WaitGroup // the Go routines reading from the proxied connections
+
+	mx              sync.Mutex
+	flows           map[netip.AddrPort]*multiConnFlow
+	readDeadline    time.Time
+	deadlineChanged chan struct{} // closed when the read deadline is changed
+}
+
+var _ net.PacketConn = &MultiConn{}
+
+type multiConnPacket struct {
+	data []byte
+	addr net.Addr
+	err  error // an ICMP error relayed by the proxy
+}
+
+type multiConnFlow struct {
+	addr     netip.AddrPort
+	ready    chan struct{} // closed once dialing finished
+	lastUsed atomic.Int64  // in Unix nanoseconds
+	closed   atomic.Bool   // set when the flow is removed
+
+	// set before ready is closed
+	conn *Conn
+	err  error
+
+	idleTimer *time.Timer // protected by MultiConn.mx
+}
+
+func (f *multiConnFlow) touch() { f.lastUsed.Store(time.Now().UnixNano()) }
+
+// NewMultiConn creates a new MultiConn, using the connection to the proxy.
+// The template is the URI template of the proxy. The config may be nil.
+func NewMultiConn(clientConn *ClientConn, template *uritemplate.Template, conf *MultiConnConfig) *MultiConn {
+	if conf == nil {
+		conf = &MultiConnConfig{}
+	}
+	m := &MultiConn{
+		clientConn:      clientConn,
+		template:        template,
+		idleTimeout:     conf.IdleTimeout,
+		maxFlows:        conf.MaxFlows,
+		localAddr:       masqueAddr{clientConn.conn.LocalAddr().String()},
+		received:        make(chan multiConnPacket, maxQueuedMultiConnPackets),
+		flows:           make(map[netip.AddrPort]*multiConnFlow),
+		deadlineChanged: make(chan struct{}),
+	}
+	if m.idleTimeout == 0 {
+		m.idleTimeout = defaultMultiConnIdleTimeout
+	}
+	if m.maxFlows == 0 {
+		m.maxFlows = defaultMultiConnMaxFlows
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m
+}
+
+// ReadFrom reads a UDP datagram received from any of the destinations.
+// The address is the destination that the datagram was received from.
+// If the proxy relayed an ICMP error, it is returned as an [ICMPError], together with the destination address.
+func (m *MultiConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		m.mx.Lock()
+		deadline, deadlineChanged := m.readDeadline, m.deadlineChanged
+		m.mx.Unlock()
+		if m.ctx.Err() != nil {
+			return 0, nil, net.ErrClosed
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case p := <-m.received:
+			if timer != nil {
+				timer.Stop()
+			}
+			if p.err != nil {
+				return 0, p.addr, p.err
+			}
+			return copy(b, p.data), p.addr, nil
+		case <-deadlineChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-timeout:
+		case <-m.ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+// WriteTo sends a UDP datagram to addr, dialing a proxied connection if necessary.
+// It blocks while the proxied connection is dialed.
+func (m *MultiConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	dst, err := multiConnAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	f, err := m.getFlow(dst)
+	if err != nil {
+		return 0, err
+	}
+	f.touch()
+	if _, err := f.conn.WriteTo(p, nil); err != nil {
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			m.removeFlow(f)
+		}
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func multiConnAddr(addr net.Addr) (netip.AddrPort, error) {
+	if addr == nil {
+		return netip.AddrPort{}, errors.New("masque: missing destination address")
+	}
+	var ap netip.AddrPort
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		ap = udpAddr.AddrPort()
+	} else {
+		var err error
+		ap, err = netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("masque: invalid destination address: %w", err)
+		}
+	}
+	if !ap.IsValid() || ap.Port() == 0 {
+		return netip.AddrPort{}, fmt.Errorf("masque: invalid destination address: %s", addr)
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), nil
+}
+
+// getFlow returns the proxied connection to addr, dialing it if necessary.
+// Concurrent writes to the same destination wait for the first write to dial the connection.
+func (m *MultiConn) getFlow(addr netip.AddrPort) (*multiConnFlow, error) {
+	m.mx.Lock()
+	if m.ctx.Err() != nil {
+		m.mx.Unlock()
+		return nil, net.ErrClosed
+	}
+	f, ok := m.flows[addr]
+	var evicted *multiConnFlow
+	if !ok {
+		if len(m.flows) >= m.maxFlows {
+			evicted = m.leastRecentlyUsedLocked()
+			m.removeFlowLocked(evicted)
+		}
+		f = &multiConnFlow{addr: addr, ready: make(chan struct{})}
+		f.touch()
+		m.flows[addr] = f
+	}
+	m.mx.Unlock()
+
+	if evicted != nil {
+		m.closeFlow(evicted)
+	}
+	if !ok {
+		m.dial(f)
+	}
+	<-f.ready
+	return f, f.err
+}
+
+func (m *MultiConn) leastRecentlyUsedLocked() *multiConnFlow {
+	var lru *multiConnFlow
+	for _, f := range m.flows {
+		if lru == nil || f.lastUsed.Load() < lru.lastUsed.Load() {
+			lru = f
+		}
+	}
+	return lru
+}
+
+func (m *MultiConn) dial(f *multiConnFlow) {
+	req, err := NewRequest(m.ctx, m.template, f.addr.String())
+	if err != nil {
+		m.dialFailed(f, err)
+		return
+	}
+	conn, _, err := m.clientConn.Dial(req)
+	if err != nil {
+		m.dialFailed(f, err)
+		return
+	}
+
+	m.mx.Lock()
+	// The flow might have been evicted, or the MultiConn closed, while dialing.
+	if f.closed.Load() {
+		f.err = net.ErrClosed
+		close(f.ready)
+		m.mx.Unlock()
+		conn.Close()
+		return
+	}
+	f.conn = conn
+	f.idleTimer = time.AfterFunc(m.idleTimeout, func() { m.checkIdle(f) })
+	m.wg.Add(1)
+	// Closing ready while holding the lock guarantees that a flow removed from now on
+	// has its proxied connection closed by closeFlow.
+	close(f.ready)
+	m.mx.Unlock()
+	go m.receive(f)
+}
+
+func (m *MultiConn) dialFailed(f *multiConnFlow, err error) {
+	f.err = err
+	close(f.ready)
+	m.removeFlow(f)
+}
+
+// checkIdle closes the proxied connection if it didn't send or receive any datagrams for the idle timeout.
+func (m *MultiConn) checkIdle(f *multiConnFlow) {
+	idle := time.Since(time.Unix(0, f.lastUsed.Load()))
+	if idle >= m.idleTimeout {
+		m.removeFlow(f)
+		return
+	}
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if !f.closed.Load() {
+		f.idleTimer.Reset(m.idleTimeout - idle)
+	}
+}
+
+// receive reads the datagrams received on the proxied connection, until the proxied connection is closed.
+func (m *MultiConn) receive(f *multiConnFlow) {
+	defer m.wg.Done()
+	addr := net.UDPAddrFromAddrPort(f.addr)
+	b := make([]byte, 1<<16)
+	for {
+		n, _, err := f.conn.ReadFrom(b)
+		var p multiConnPacket
+		if err != nil {
+			var icmpErr *ICMPError
+			if !errors.As(err, &icmpErr) {
+				if !f.closed.Load() {
+					log.Printf("proxied connection to %s failed: %v", f.addr, err)
+					m.removeFlow(f)
+				}
+				return
+			}
+			p = multiConnPacket{addr: addr, err: icmpErr}
+		} else {
+			f.touch()
+			p = multiConnPacket{data: append([]byte(nil), b[:n]...), addr: addr}
+		}
+		select {
+		case m.received <- p:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// removeFlow removes a proxied connection, such that the next datagram sent to its destination dials a new one.
+func (m *MultiConn) removeFlow(f *multiConnFlow) {
+	m.mx.Lock()
+	m.removeFlowLocked(f)
+	m.mx.Unlock()
+	m.closeFlow(f)
+}
+
+func (m *MultiConn) removeFlowLocked(f *multiConnFlow) {
+	if m.flows[f.addr] == f {
+		delete(m.flows, f.addr)
+	}
+	f.closed.Store(true)
+	if f.idleTimer != nil {
+		f.idleTimer.Stop()
+	}
+}
+
+// closeFlow closes the proxied connection of a removed flow.
+// Flows that are still dialing are closed by dial once dialing finished.
+func (m *MultiConn) closeFlow(f *multiConnFlow) {
+	select {
+	case <-f.ready:
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	default:
+	}
+}
+
+// Close closes all proxied connections.
+func (m *MultiConn) Close() error {
+	m.mx.Lock()
+	if m.ctx.Err() != nil {
+		m.mx.Unlock()
+		return nil
+	}
+	m.cancel()
+	flows := m.flows
+	m.flows = nil
+	for _, f := range flows {
+		m.removeFlowLocked(f)
+	}
+	m.mx.Unlock()
+
+	for _, f := range flows {
+		// Dialing is aborted, since the context used for dialing was cancelled.
+		<-f.ready
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}
+	m.wg.Wait()
+	return nil
+}
+
+// LocalAddr returns the local address of the connection to the proxy.
+func (m *MultiConn) LocalAddr() net.Addr {
+	return m.localAddr
+}
+
+func (m *MultiConn) SetDeadline(t time.Time) error {
+	_ = m.SetWriteDeadline(t)
+	return m.SetReadDeadline(t)
+}
+
+func (m *MultiConn) SetReadDeadline(t time.Time) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.readDeadline = t
+	close(m.deadlineChanged)
+	m.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (m *MultiConn) SetWriteDeadline(time.Time) error {
+	// Write deadlines are not supported by Conn, see Conn.SetWriteDeadline.
+	return nil
+}
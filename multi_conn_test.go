@@ -0,0 +1,158 @@
+package masque_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+// checkMultiConnEcho checks that a datagram sent to addr is echoed, and that it is received from addr.
+func checkMultiConnEcho(t *testing.T, conn *masque.MultiConn, addr net.Addr, msg string) {
+	t.Helper()
+	b := make([]byte, 1500)
+	for range 10 {
+		_, err := conn.WriteTo([]byte(msg), addr)
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(scaleDuration(100 * time.Millisecond)))
+		n, raddr, err := conn.ReadFrom(b)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b[:n]))
+		require.Equal(t, addr.String(), raddr.String())
+		return
+	}
+	t.Fatal("no echo received")
+}
+
+func TestMultiConn(t *testing.T) {
+	server1 := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer server1.Close()
+	server2 := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer server2.Close()
+
+	records := make(chan *masque.FlowRecord, 2)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+	})
+	conn := masque.NewMultiConn(dialClientConn(t, template), template, nil)
+	defer conn.Close()
+
+	checkMultiConnEcho(t, conn, server1.LocalAddr(), "foo")
+	checkMultiConnEcho(t, conn, server2.LocalAddr(), "bar")
+	checkMultiConnEcho(t, conn, server1.LocalAddr(), "baz")
+
+	_, err := conn.WriteTo([]byte("foobar"), nil)
+	require.ErrorContains(t, err, "masque: missing destination address")
+
+	// every destination uses its own proxied connection
+	require.NoError(t, conn.Close())
+	targets := make(map[string]struct{})
+	for range 2 {
+		select {
+		case rec := <-records:
+			require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+			targets[rec.Target] = struct{}{}
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	}
+	require.Contains(t, targets, server1.LocalAddr().String())
+	require.Contains(t, targets, server2.LocalAddr().String())
+
+	_, err = conn.WriteTo([]byte("foobar"), server1.LocalAddr())
+	require.ErrorIs(t, err, net.ErrClosed)
+	_, _, err = conn.ReadFrom(make([]byte, 1500))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestMultiConnFlowLimits(t *testing.T) {
+	server1 := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer server1.Close()
+	server2 := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer server2.Close()
+
+	records := make(chan *masque.FlowRecord, 4)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+	})
+	cconn := dialClientConn(t, template)
+
+	expectClosed := func(t *testing.T, target net.Addr) {
+		t.Helper()
+		select {
+		case rec := <-records:
+			require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+			require.Equal(t, target.String(), rec.Target)
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	}
+
+	t.Run("max flows", func(t *testing.T) {
+		conn := masque.NewMultiConn(cconn, template, &masque.MultiConnConfig{MaxFlows: 1})
+		defer conn.Close()
+
+		checkMultiConnEcho(t, conn, server1.LocalAddr(), "foo")
+		// the proxied connection to the first server is closed
+		checkMultiConnEcho(t, conn, server2.LocalAddr(), "bar")
+		expectClosed(t, server1.LocalAddr())
+		// ... and dialed again
+		checkMultiConnEcho(t, conn, server1.LocalAddr(), "baz")
+		expectClosed(t, server2.LocalAddr())
+	})
+	expectClosed(t, server1.LocalAddr())
+
+	t.Run("idle timeout", func(t *testing.T) {
+		conn := masque.NewMultiConn(cconn, template, &masque.MultiConnConfig{IdleTimeout: scaleDuration(50 * time.Millisecond)})
+		defer conn.Close()
+
+		checkMultiConnEcho(t, conn, server1.LocalAddr(), "foo")
+		expectClosed(t, server1.LocalAddr())
+		// the proxied connection is dialed again
+		checkMultiConnEcho(t, conn, server1.LocalAddr(), "bar")
+	})
+	expectClosed(t, server1.LocalAddr())
+}
+
+func TestMultiConnConcurrentEviction(t *testing.T) {
+	var servers []*net.UDPConn
+	for range 8 {
+		server := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+		defer server.Close()
+		servers = append(servers, server)
+	}
+
+	template := runHandler(t, &masque.Handler{Proxy: &masque.Proxy{}})
+	conn := masque.NewMultiConn(dialClientConn(t, template), template, &masque.MultiConnConfig{MaxFlows: 1})
+
+	// Every write evicts the proxied connection used by the other destinations,
+	// possibly while it is still being dialed.
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Go(func() {
+			for range 50 {
+				// writes fail if the proxied connection is evicted while dialing
+				conn.WriteTo([]byte("foobar"), server.LocalAddr())
+			}
+		})
+	}
+	wg.Wait()
+
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(scaleDuration(5 * time.Second)):
+		t.Fatal("Close didn't return, a proxied connection was leaked")
+	}
+}
@@ -0,0 +1,222 @@
+package privacypass
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/masque-go"
+)
+
+// defaultChallengeLifetime is the default value for Authorizer.ChallengeLifetime.
+const defaultChallengeLifetime = time.Hour
+
+var errDoubleSpend = errors.New("privacypass: token already redeemed")
+
+// An Authorizer authorizes proxy requests using Privacy Pass tokens.
+// Its Authorize method can be used as [masque.Handler.Authorize],
+// or called before [masque.Proxy.Proxy] when handling requests directly.
+//
+// Requests without a valid token are rejected with a 407 (Proxy Authentication Required) response,
+// carrying a PrivateToken challenge for every Verifier.
+// If the Authorizer is misconfigured, all requests are rejected with a 500 (Internal Server Error) response.
+// Every token is only accepted once.
+// To bound the number of redeemed tokens that need to be remembered,
+// the challenges use a redemption context that is replaced after the ChallengeLifetime.
+// Tokens for the previous challenges are accepted until the redemption context is replaced again.
+type Authorizer struct {
+	// IssuerName is the name of the issuer, sent in the challenges. It must not be empty.
+	IssuerName string
+	// Verifiers verify the tokens. At least one Verifier is required.
+	// Clients can redeem tokens of the token type of any of the Verifiers.
+	Verifiers []Verifier
+	// OriginInfo, if set, binds the tokens to the names of the proxy.
+	// Otherwise, tokens can be redeemed with any proxy using the same issuer.
+	OriginInfo []string
+	// ChallengeLifetime is the time after which a new redemption context is used.
+	// If zero, one hour is used.
+	ChallengeLifetime time.Duration
+
+	mx                sync.Mutex
+	current, previous *redemptionEpoch
+}
+
+// A redemptionEpoch are the challenges using the same redemption context,
+// together with the tokens redeemed for these challenges.
+type redemptionEpoch struct {
+	expiry     time.Time
+	challenges map[uint16][]byte            // encoded challenges, by token type
+	digests    map[[digestLen]byte]struct{} // the digests of the encoded challenges
+	redeemed   map[[nonceLen]byte]struct{}  // the nonces of the redeemed tokens
+}
+
+// Authorize checks the token sent in the Proxy-Authorization header field.
+// If the request doesn't carry a valid token, it writes a 407 response and returns false.
+func (a *Authorizer) Authorize(w http.ResponseWriter, r *masque.ProxyRequest) bool {
+	if err := a.validate(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if err := a.redeem(r.Request().Header); err == nil {
+		return true
+	}
+	a.mx.Lock()
+	e, err := a.currentEpochLocked(time.Now())
+	a.mx.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	maxAge := max(int(time.Until(e.expiry).Seconds()), 0)
+	for _, v := range a.Verifiers {
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf(`%s challenge="%s", token-key="%s", max-age=%d`,
+			masque.AuthSchemePrivateToken, encode(e.challenges[v.TokenType()]), encode(v.TokenKey()), maxAge,
+		))
+	}
+	w.WriteHeader(http.StatusProxyAuthRequired)
+	return false
+}
+
+// validate checks the configuration.
+// Clients reject challenges without an issuer name, so they would never be able to redeem a token.
+func (a *Authorizer) validate() error {
+	if a.IssuerName == "" {
+		return errors.New("privacypass: missing issuer name")
+	}
+	if len(a.Verifiers) == 0 {
+		return errors.New("privacypass: no verifiers")
+	}
+	return nil
+}
+
+// redeem checks the token, and marks it as redeemed.
+// Verifying the authenticator is expensive, so it is only verified for a known challenge, if the token wasn't redeemed yet.
+func (a *Authorizer) redeem(h http.Header) error {
+	creds, err := masque.ParseProxyAuthorization(h)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(creds.Scheme, masque.AuthSchemePrivateToken) {
+		return fmt.Errorf("privacypass: unexpected authentication scheme: %s", creds.Scheme)
+	}
+	data, err := decode(creds.Params["token"])
+	if err != nil {
+		return fmt.Errorf("privacypass: invalid token parameter: %w", err)
+	}
+	t, err := ParseToken(data)
+	if err != nil {
+		return err
+	}
+	v := a.verifier(t)
+	if v == nil {
+		return errors.New("privacypass: unknown token key")
+	}
+	a.mx.Lock()
+	_, err = a.epochLocked(t)
+	a.mx.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := v.Verify(t); err != nil {
+		return err
+	}
+
+	// The token might have been redeemed concurrently, or the epoch might have expired while verifying.
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	e, err := a.epochLocked(t)
+	if err != nil {
+		return err
+	}
+	e.redeemed[t.Nonce] = struct{}{}
+	return nil
+}
+
+// epochLocked returns the epoch of the challenge the token was issued for.
+// It fails if the challenge is unknown, or if the token was already redeemed.
+func (a *Authorizer) epochLocked(t *Token) (*redemptionEpoch, error) {
+	if _, err := a.currentEpochLocked(time.Now()); err != nil {
+		return nil, err
+	}
+	for _, e := range []*redemptionEpoch{a.current, a.previous} {
+		if e == nil {
+			continue
+		}
+		if _, ok := e.digests[t.ChallengeDigest]; !ok {
+			continue
+		}
+		if _, ok := e.redeemed[t.Nonce]; ok {
+			return nil, errDoubleSpend
+		}
+		return e, nil
+	}
+	return nil, errors.New("privacypass: unknown challenge")
+}
+
+// verifier returns the Verifier for the token type and token key of the token.
+func (a *Authorizer) verifier(t *Token) Verifier {
+	for _, v := range a.Verifiers {
+		if v.TokenType() == t.TokenType && sha256.Sum256(v.TokenKey()) == t.TokenKeyID {
+			return v
+		}
+	}
+	return nil
+}
+
+// currentEpochLocked returns the current epoch, replacing it if it expired.
+func (a *Authorizer) currentEpochLocked(now time.Time) (*redemptionEpoch, error) {
+	if a.current != nil && now.Before(a.current.expiry) {
+		return a.current, nil
+	}
+	lifetime := a.ChallengeLifetime
+	if lifetime == 0 {
+		lifetime = defaultChallengeLifetime
+	}
+	e, err := a.newEpoch(now.Add(lifetime))
+	if err != nil {
+		return nil, err
+	}
+	// Tokens for the previous challenges are only accepted if the challenges were in use until recently.
+	if a.current != nil && now.Sub(a.current.expiry) < lifetime {
+		a.previous = a.current
+	} else {
+		a.previous = nil
+	}
+	a.current = e
+	return e, nil
+}
+
+func (a *Authorizer) newEpoch(expiry time.Time) (*redemptionEpoch, error) {
+	redemptionContext := make([]byte, redemptionContextLen)
+	if _, err := rand.Read(redemptionContext); err != nil {
+		return nil, err
+	}
+	e := &redemptionEpoch{
+		expiry:     expiry,
+		challenges: make(map[uint16][]byte),
+		digests:    make(map[[digestLen]byte]struct{}),
+		redeemed:   make(map[[nonceLen]byte]struct{}),
+	}
+	for _, v := range a.Verifiers {
+		if _, ok := e.challenges[v.TokenType()]; ok {
+			continue
+		}
+		challenge, err := (&TokenChallenge{
+			TokenType:         v.TokenType(),
+			IssuerName:        a.IssuerName,
+			RedemptionContext: redemptionContext,
+			OriginInfo:        a.OriginInfo,
+		}).Marshal()
+		if err != nil {
+			return nil, err
+		}
+		e.challenges[v.TokenType()] = challenge
+		e.digests[sha256.Sum256(challenge)] = struct{}{}
+	}
+	return e, nil
+}
@@ -0,0 +1,174 @@
+package privacypass
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/cloudflare/circl/blindsign/blindrsa"
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/circl/zk/dleq"
+)
+
+// A TokenSource provides the tokens that are redeemed with the proxy.
+type TokenSource interface {
+	// Token returns a token for the challenge, issued using the token key.
+	// Every token is only redeemed once.
+	Token(ctx context.Context, challenge *TokenChallenge, tokenKey []byte) (*Token, error)
+}
+
+// IssuingTokenSource is a TokenSource that obtains a new token from the issuer for every challenge,
+// running the issuance protocol for the token type of the challenge.
+type IssuingTokenSource struct {
+	Issuer TokenIssuer
+}
+
+var _ TokenSource = &IssuingTokenSource{}
+
+// Token obtains a new token from the issuer.
+func (s *IssuingTokenSource) Token(ctx context.Context, challenge *TokenChallenge, tokenKey []byte) (*Token, error) {
+	if _, err := authenticatorLen(challenge.TokenType); err != nil {
+		return nil, err
+	}
+	encodedChallenge, err := challenge.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	t := &Token{
+		TokenType:       challenge.TokenType,
+		ChallengeDigest: sha256.Sum256(encodedChallenge),
+		TokenKeyID:      sha256.Sum256(tokenKey),
+	}
+	if _, err := rand.Read(t.Nonce[:]); err != nil {
+		return nil, err
+	}
+	if t.TokenType == TokenTypePrivate {
+		t.Authenticator, err = s.issuePrivate(ctx, t, tokenKey)
+	} else {
+		t.Authenticator, err = s.issuePublic(ctx, t, tokenKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// issuePrivate runs the issuance protocol for privately verifiable tokens (RFC 9578, Section 5).
+func (s *IssuingTokenSource) issuePrivate(ctx context.Context, t *Token, tokenKey []byte) ([]byte, error) {
+	key := &oprf.PublicKey{}
+	if err := key.UnmarshalBinary(oprf.SuiteP384, tokenKey); err != nil {
+		return nil, fmt.Errorf("privacypass: invalid token key: %w", err)
+	}
+	client := oprf.NewVerifiableClient(oprf.SuiteP384, key)
+	finData, evalReq, err := client.Blind([][]byte{t.input()})
+	if err != nil {
+		return nil, err
+	}
+	blinded, err := evalReq.Elements[0].MarshalBinaryCompress()
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := s.Issuer.IssueToken(ctx, tokenRequest(t, blinded))
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) <= blindedElementLen {
+		return nil, errors.New("privacypass: invalid token response")
+	}
+	g := oprf.SuiteP384.Group()
+	evaluated := g.NewElement()
+	if err := evaluated.UnmarshalBinary(rsp[:blindedElementLen]); err != nil {
+		return nil, fmt.Errorf("privacypass: invalid token response: %w", err)
+	}
+	proof := &dleq.Proof{}
+	if err := proof.UnmarshalBinary(g, rsp[blindedElementLen:]); err != nil {
+		return nil, fmt.Errorf("privacypass: invalid token response: %w", err)
+	}
+	outputs, err := client.Finalize(finData, &oprf.Evaluation{Elements: []oprf.Evaluated{evaluated}, Proof: proof})
+	if err != nil {
+		return nil, fmt.Errorf("privacypass: invalid token response: %w", err)
+	}
+	return outputs[0], nil
+}
+
+// issuePublic runs the issuance protocol for publicly verifiable tokens (RFC 9578, Section 6).
+func (s *IssuingTokenSource) issuePublic(ctx context.Context, t *Token, tokenKey []byte) ([]byte, error) {
+	key, err := parsePublicTokenKey(tokenKey)
+	if err != nil {
+		return nil, err
+	}
+	client, err := blindrsa.NewClient(blindrsa.SHA384PSSDeterministic, key)
+	if err != nil {
+		return nil, err
+	}
+	blindedMsg, state, err := client.Blind(rand.Reader, t.input())
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := s.Issuer.IssueToken(ctx, tokenRequest(t, blindedMsg))
+	if err != nil {
+		return nil, err
+	}
+	// Finalize verifies the signature.
+	sig, err := client.Finalize(state, rsp)
+	if err != nil {
+		return nil, fmt.Errorf("privacypass: invalid token response: %w", err)
+	}
+	return sig, nil
+}
+
+// tokenRequest encodes a token request, carrying the least significant byte of the token key ID.
+func tokenRequest(t *Token, blindedMsg []byte) []byte {
+	b := make([]byte, 0, 3+len(blindedMsg))
+	b = append(b, byte(t.TokenType>>8), byte(t.TokenType), t.TokenKeyID[len(t.TokenKeyID)-1])
+	return append(b, blindedMsg...)
+}
+
+// Credentials is a [masque.CredentialsProvider] that redeems tokens for PrivateToken challenges.
+// Tokens are single-use, so a new token is obtained from the Source for every challenged request.
+type Credentials struct {
+	Source TokenSource
+}
+
+var _ masque.CredentialsProvider = &Credentials{}
+
+// ProxyCredentials redeems a token for the first PrivateToken challenge that a token can be obtained for.
+func (c *Credentials) ProxyCredentials(ctx context.Context, req *masque.AuthRequest) (string, bool, error) {
+	var errs []error
+	for _, ch := range req.Challenges {
+		if !strings.EqualFold(ch.Scheme, masque.AuthSchemePrivateToken) {
+			continue
+		}
+		t, err := c.token(ctx, ch)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return fmt.Sprintf(`%s token="%s"`, masque.AuthSchemePrivateToken, encode(t.Marshal())), false, nil
+	}
+	if len(errs) == 0 {
+		return "", false, fmt.Errorf("privacypass: proxy didn't offer the %s authentication scheme", masque.AuthSchemePrivateToken)
+	}
+	return "", false, errors.Join(errs...)
+}
+
+func (c *Credentials) token(ctx context.Context, ch masque.Challenge) (*Token, error) {
+	encodedChallenge, err := decode(ch.Params["challenge"])
+	if err != nil || len(encodedChallenge) == 0 {
+		return nil, errors.New("privacypass: invalid challenge parameter")
+	}
+	tokenKey, err := decode(ch.Params["token-key"])
+	if err != nil || len(tokenKey) == 0 {
+		return nil, errors.New("privacypass: invalid token-key parameter")
+	}
+	challenge, err := ParseTokenChallenge(encodedChallenge)
+	if err != nil {
+		return nil, err
+	}
+	return c.Source.Token(ctx, challenge, tokenKey)
+}
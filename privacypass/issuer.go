@@ -0,0 +1,120 @@
+package privacypass
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/circl/blindsign/blindrsa"
+	"github.com/cloudflare/circl/oprf"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// blindedElementLen is the length of an encoded P-384 group element, Ne.
+const blindedElementLen = 49
+
+// A TokenIssuer issues tokens, by answering token requests (RFC 9578, Sections 5 and 6).
+// Usually, token requests are sent to the issuer in HTTP requests, after authenticating the client.
+type TokenIssuer interface {
+	// IssueToken answers an encoded token request with an encoded token response.
+	IssueToken(ctx context.Context, tokenRequest []byte) (tokenResponse []byte, err error)
+}
+
+// An Issuer is a local, in-process issuer.
+// It issues both privately and publicly verifiable tokens to every client,
+// and is therefore mostly useful for testing.
+type Issuer struct {
+	name            string
+	publicVerifier  *publicVerifier
+	privateVerifier *privateVerifier
+	signer          blindrsa.Signer
+}
+
+var _ TokenIssuer = &Issuer{}
+
+// NewIssuer creates a new issuer, generating new keys for both token types.
+func NewIssuer(name string) (*Issuer, error) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	publicVerifier, err := newPublicVerifier(&rsaKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	oprfKey, err := oprf.GenerateKey(oprf.SuiteP384, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	privateVerifier, err := newPrivateVerifier(oprfKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{
+		name:            name,
+		publicVerifier:  publicVerifier,
+		privateVerifier: privateVerifier,
+		signer:          blindrsa.NewSigner(rsaKey),
+	}, nil
+}
+
+// Name returns the name of the issuer, used in challenges.
+func (i *Issuer) Name() string { return i.name }
+
+// PublicVerifier returns the Verifier for publicly verifiable tokens issued by this issuer.
+func (i *Issuer) PublicVerifier() Verifier { return i.publicVerifier }
+
+// PrivateVerifier returns the Verifier for privately verifiable tokens issued by this issuer.
+func (i *Issuer) PrivateVerifier() Verifier { return i.privateVerifier }
+
+// IssueToken answers a token request for either token type.
+func (i *Issuer) IssueToken(_ context.Context, tokenRequest []byte) ([]byte, error) {
+	s := cryptobyte.String(tokenRequest)
+	var tokenType uint16
+	var truncatedKeyID uint8
+	if !s.ReadUint16(&tokenType) || !s.ReadUint8(&truncatedKeyID) {
+		return nil, errors.New("privacypass: invalid token request")
+	}
+	var verifier Verifier
+	var blindedMsgLen int
+	switch tokenType {
+	case TokenTypePrivate:
+		verifier, blindedMsgLen = i.privateVerifier, blindedElementLen
+	case TokenTypePublic:
+		verifier, blindedMsgLen = i.publicVerifier, 256
+	default:
+		return nil, fmt.Errorf("privacypass: unsupported token type %#04x", tokenType)
+	}
+	var blindedMsg []byte
+	if !s.ReadBytes(&blindedMsg, blindedMsgLen) || !s.Empty() {
+		return nil, errors.New("privacypass: invalid token request")
+	}
+	if keyID := sha256.Sum256(verifier.TokenKey()); truncatedKeyID != keyID[len(keyID)-1] {
+		return nil, errors.New("privacypass: unknown token key")
+	}
+
+	if tokenType == TokenTypePublic {
+		return i.signer.BlindSign(blindedMsg)
+	}
+	g := oprf.SuiteP384.Group()
+	blinded := g.NewElement()
+	if err := blinded.UnmarshalBinary(blindedMsg); err != nil {
+		return nil, fmt.Errorf("privacypass: invalid blinded element: %w", err)
+	}
+	eval, err := i.privateVerifier.server.Evaluate(&oprf.EvaluationRequest{Elements: []oprf.Blinded{blinded}})
+	if err != nil {
+		return nil, err
+	}
+	evaluated, err := eval.Elements[0].MarshalBinaryCompress()
+	if err != nil {
+		return nil, err
+	}
+	proof, err := eval.Proof.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(evaluated, proof...), nil
+}
@@ -0,0 +1,448 @@
+package privacypass_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+	"github.com/quic-go/masque-go/privacypass"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+var (
+	issuerOnce sync.Once
+	issuer     *privacypass.Issuer
+)
+
+// getIssuer returns an issuer shared by all tests, since generating the RSA key is slow.
+func getIssuer(t *testing.T) *privacypass.Issuer {
+	t.Helper()
+	issuerOnce.Do(func() {
+		var err error
+		issuer, err = privacypass.NewIssuer("issuer.example")
+		require.NoError(t, err)
+	})
+	require.NotNil(t, issuer)
+	return issuer
+}
+
+func verifiers(t *testing.T) map[string]privacypass.Verifier {
+	return map[string]privacypass.Verifier{
+		"privately verifiable": getIssuer(t).PrivateVerifier(),
+		"publicly verifiable":  getIssuer(t).PublicVerifier(),
+	}
+}
+
+func TestTokenChallengeEncoding(t *testing.T) {
+	challenge := &privacypass.TokenChallenge{
+		TokenType:         privacypass.TokenTypePublic,
+		IssuerName:        "issuer.example",
+		RedemptionContext: make([]byte, 32),
+		OriginInfo:        []string{"proxy.example", "proxy2.example"},
+	}
+	data, err := challenge.Marshal()
+	require.NoError(t, err)
+	parsed, err := privacypass.ParseTokenChallenge(data)
+	require.NoError(t, err)
+	require.Equal(t, challenge, parsed)
+
+	// without redemption context and origin info
+	challenge = &privacypass.TokenChallenge{TokenType: privacypass.TokenTypePrivate, IssuerName: "issuer.example"}
+	data, err = challenge.Marshal()
+	require.NoError(t, err)
+	parsed, err = privacypass.ParseTokenChallenge(data)
+	require.NoError(t, err)
+	require.Equal(t, challenge, parsed)
+
+	_, err = privacypass.ParseTokenChallenge(data[:len(data)-1])
+	require.ErrorContains(t, err, "invalid token challenge")
+	_, err = (&privacypass.TokenChallenge{IssuerName: "issuer.example", RedemptionContext: []byte("foo")}).Marshal()
+	require.ErrorContains(t, err, "invalid redemption context length")
+}
+
+func TestIssuance(t *testing.T) {
+	for name, v := range verifiers(t) {
+		t.Run(name, func(t *testing.T) {
+			source := &privacypass.IssuingTokenSource{Issuer: getIssuer(t)}
+			challenge := &privacypass.TokenChallenge{TokenType: v.TokenType(), IssuerName: getIssuer(t).Name()}
+			token, err := source.Token(context.Background(), challenge, v.TokenKey())
+			require.NoError(t, err)
+			require.NoError(t, v.Verify(token))
+
+			parsed, err := privacypass.ParseToken(token.Marshal())
+			require.NoError(t, err)
+			require.Equal(t, token, parsed)
+
+			// the authenticator covers the nonce
+			token.Nonce[0] ^= 0xff
+			require.ErrorContains(t, v.Verify(token), "invalid token authenticator")
+
+			// invalid token keys are rejected
+			_, err = source.Token(context.Background(), challenge, []byte("foobar"))
+			require.ErrorContains(t, err, "invalid token key")
+		})
+	}
+}
+
+// authorize sends a request through the Authorizer.
+func authorize(t *testing.T, a *privacypass.Authorizer, authorization string) *httptest.ResponseRecorder {
+	t.Helper()
+	template := uritemplate.MustNew("https://localhost:1234/masque?h={target_host}&p={target_port}")
+	r := httptest.NewRequest(http.MethodGet, "https://localhost:1234/masque?h=localhost&p=443", nil)
+	r.Method = http.MethodConnect
+	r.Proto = "connect-udp"
+	r.Header.Add("Capsule-Protocol", "?1")
+	if authorization != "" {
+		r.Header.Set("Proxy-Authorization", authorization)
+	}
+	req, err := masque.ParseProxyRequest(r, template)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	if a.Authorize(w, req) {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w
+}
+
+// redeem obtains the credentials for the challenges of a 407 response.
+func redeem(t *testing.T, source privacypass.TokenSource, rsp *httptest.ResponseRecorder) string {
+	t.Helper()
+	require.Equal(t, http.StatusProxyAuthRequired, rsp.Code)
+	challenges, err := masque.ParseProxyAuthenticate(rsp.Header())
+	require.NoError(t, err)
+	authorization, reusable, err := (&privacypass.Credentials{Source: source}).ProxyCredentials(
+		context.Background(),
+		&masque.AuthRequest{Challenges: challenges},
+	)
+	require.NoError(t, err)
+	require.False(t, reusable)
+	return authorization
+}
+
+func TestAuthorizer(t *testing.T) {
+	source := &privacypass.IssuingTokenSource{Issuer: getIssuer(t)}
+
+	for name, v := range verifiers(t) {
+		t.Run(name, func(t *testing.T) {
+			a := &privacypass.Authorizer{IssuerName: getIssuer(t).Name(), Verifiers: []privacypass.Verifier{v}}
+			rsp := authorize(t, a, "")
+			require.Equal(t, http.StatusProxyAuthRequired, rsp.Code)
+			challenges, err := masque.ParseProxyAuthenticate(rsp.Header())
+			require.NoError(t, err)
+			require.Len(t, challenges, 1)
+			require.Equal(t, masque.AuthSchemePrivateToken, challenges[0].Scheme)
+			require.Equal(t, base64.URLEncoding.EncodeToString(v.TokenKey()), challenges[0].Params["token-key"])
+			require.Contains(t, []string{"3599", "3600"}, challenges[0].Params["max-age"])
+
+			authorization := redeem(t, source, rsp)
+			require.Equal(t, http.StatusOK, authorize(t, a, authorization).Code)
+			// tokens can only be redeemed once
+			require.Equal(t, http.StatusProxyAuthRequired, authorize(t, a, authorization).Code)
+			// a new token for the same challenge is accepted
+			require.Equal(t, http.StatusOK, authorize(t, a, redeem(t, source, rsp)).Code)
+
+			require.Equal(t, http.StatusProxyAuthRequired, authorize(t, a, "Bearer foobar").Code)
+		})
+	}
+
+	t.Run("tokens for a different proxy", func(t *testing.T) {
+		a1 := &privacypass.Authorizer{IssuerName: getIssuer(t).Name(), Verifiers: []privacypass.Verifier{getIssuer(t).PublicVerifier()}}
+		a2 := &privacypass.Authorizer{IssuerName: getIssuer(t).Name(), Verifiers: []privacypass.Verifier{getIssuer(t).PublicVerifier()}}
+		authorization := redeem(t, source, authorize(t, a1, ""))
+		require.Equal(t, http.StatusProxyAuthRequired, authorize(t, a2, authorization).Code)
+		require.Equal(t, http.StatusOK, authorize(t, a1, authorization).Code)
+	})
+
+	t.Run("expired challenges", func(t *testing.T) {
+		a := &privacypass.Authorizer{
+			IssuerName:        getIssuer(t).Name(),
+			Verifiers:         []privacypass.Verifier{getIssuer(t).PublicVerifier()},
+			ChallengeLifetime: 20 * time.Millisecond,
+		}
+		rsp := authorize(t, a, "")
+		authorization := redeem(t, source, rsp)
+		// more than twice the lifetime passed, so tokens for the old challenge are rejected
+		time.Sleep(100 * time.Millisecond)
+		rsp2 := authorize(t, a, authorization)
+		require.Equal(t, http.StatusProxyAuthRequired, rsp2.Code)
+		require.NotEqual(t, rsp.Header().Get("Proxy-Authenticate"), rsp2.Header().Get("Proxy-Authenticate"))
+		require.Equal(t, http.StatusOK, authorize(t, a, redeem(t, source, rsp2)).Code)
+	})
+}
+
+// countingVerifier counts how often a token authenticator is verified.
+type countingVerifier struct {
+	privacypass.Verifier
+	verified atomic.Int32
+}
+
+func (v *countingVerifier) Verify(token *privacypass.Token) error {
+	v.verified.Add(1)
+	return v.Verifier.Verify(token)
+}
+
+func TestAuthorizerChecksChallengeBeforeVerifying(t *testing.T) {
+	source := &privacypass.IssuingTokenSource{Issuer: getIssuer(t)}
+	v := &countingVerifier{Verifier: getIssuer(t).PublicVerifier()}
+	a := &privacypass.Authorizer{IssuerName: getIssuer(t).Name(), Verifiers: []privacypass.Verifier{v}}
+
+	authorization := redeem(t, source, authorize(t, a, ""))
+	require.Equal(t, http.StatusOK, authorize(t, a, authorization).Code)
+	require.Equal(t, int32(1), v.verified.Load())
+	// tokens that were already redeemed are rejected without verifying them
+	require.Equal(t, http.StatusProxyAuthRequired, authorize(t, a, authorization).Code)
+	require.Equal(t, int32(1), v.verified.Load())
+
+	// as are tokens for unknown challenges
+	other := &privacypass.Authorizer{IssuerName: getIssuer(t).Name(), Verifiers: []privacypass.Verifier{v}}
+	authorization = redeem(t, source, authorize(t, other, ""))
+	require.Equal(t, http.StatusProxyAuthRequired, authorize(t, a, authorization).Code)
+	require.Equal(t, int32(1), v.verified.Load())
+}
+
+func TestAuthorizerInvalidConfig(t *testing.T) {
+	for name, a := range map[string]*privacypass.Authorizer{
+		"no issuer name": {Verifiers: []privacypass.Verifier{getIssuer(t).PublicVerifier()}},
+		"no verifiers":   {IssuerName: getIssuer(t).Name()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rsp := authorize(t, a, "")
+			require.Equal(t, http.StatusInternalServerError, rsp.Code)
+			require.Empty(t, rsp.Header().Values("Proxy-Authenticate"))
+		})
+	}
+}
+
+// pssParameters are the RSASSA-PSS parameters (RFC 4055, Section 3.1).
+type pssParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+func TestPublicTokenKeyPSSParameters(t *testing.T) {
+	oidSHA256 := asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	tokenKey := getIssuer(t).PublicVerifier().TokenKey()
+
+	// modifyTokenKey re-encodes the token key, with modified RSASSA-PSS parameters.
+	modifyTokenKey := func(t *testing.T, modify func(*pssParameters)) []byte {
+		t.Helper()
+		var spki subjectPublicKeyInfo
+		_, err := asn1.Unmarshal(tokenKey, &spki)
+		require.NoError(t, err)
+		var params pssParameters
+		_, err = asn1.Unmarshal(spki.Algorithm.Parameters.FullBytes, &params)
+		require.NoError(t, err)
+		modify(&params)
+		data, err := asn1.Marshal(params)
+		require.NoError(t, err)
+		spki.Algorithm.Parameters = asn1.RawValue{FullBytes: data}
+		data, err = asn1.Marshal(spki)
+		require.NoError(t, err)
+		return data
+	}
+
+	source := &privacypass.IssuingTokenSource{Issuer: getIssuer(t)}
+	challenge := &privacypass.TokenChallenge{TokenType: privacypass.TokenTypePublic, IssuerName: getIssuer(t).Name()}
+	for _, tc := range []struct {
+		name   string
+		modify func(*pssParameters)
+		err    string
+	}{
+		{
+			name:   "hash",
+			modify: func(p *pssParameters) { p.Hash.Algorithm = oidSHA256 },
+			err:    "unexpected RSASSA-PSS hash algorithm",
+		},
+		{
+			name:   "mask generation function",
+			modify: func(p *pssParameters) { p.MGF.Algorithm = oidSHA256 },
+			err:    "unexpected RSASSA-PSS mask generation function",
+		},
+		{
+			name: "MGF1 hash",
+			modify: func(p *pssParameters) {
+				mgfParams, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: oidSHA256})
+				require.NoError(t, err)
+				p.MGF.Parameters = asn1.RawValue{FullBytes: mgfParams}
+			},
+			err: "unexpected RSASSA-PSS MGF1 hash algorithm",
+		},
+		{
+			name:   "salt length",
+			modify: func(p *pssParameters) { p.SaltLength = 32 },
+			err:    "unexpected RSASSA-PSS salt length: 32",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := source.Token(context.Background(), challenge, modifyTokenKey(t, tc.modify))
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+
+	// the unmodified token key is accepted
+	_, err := source.Token(context.Background(), challenge, modifyTokenKey(t, func(*pssParameters) {}))
+	require.NoError(t, err)
+}
+
+func serverTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certTempl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, certTempl, certTempl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+		NextProtos:   []string{http3.NextProtoH3},
+	}
+}
+
+// runProxy runs a proxy that authorizes requests using the Authorizer.
+func runProxy(t *testing.T, a *privacypass.Authorizer) (*net.UDPAddr, *uritemplate.Template) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", addr.Port))
+	router, err := masque.NewTemplateRouter(template)
+	require.NoError(t, err)
+	handler := &masque.Handler{Router: router, Authorize: a.Authorize}
+	t.Cleanup(func() { handler.Close() })
+	server := &http3.Server{TLSConfig: serverTLSConfig(t), EnableDatagrams: true, Handler: handler}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve(conn)
+	return addr, template
+}
+
+func runEchoServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if _, err := conn.WriteTo(b[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+// replayingSource redeems the same token over and over again.
+type replayingSource struct {
+	privacypass.TokenSource
+	mx    sync.Mutex
+	token *privacypass.Token
+}
+
+func (s *replayingSource) Token(ctx context.Context, challenge *privacypass.TokenChallenge, tokenKey []byte) (*privacypass.Token, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.token == nil {
+		var err error
+		if s.token, err = s.TokenSource.Token(ctx, challenge, tokenKey); err != nil {
+			return nil, err
+		}
+	}
+	return s.token, nil
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	echoServer := runEchoServer(t)
+	a := &privacypass.Authorizer{
+		IssuerName: getIssuer(t).Name(),
+		Verifiers:  []privacypass.Verifier{getIssuer(t).PublicVerifier(), getIssuer(t).PrivateVerifier()},
+	}
+	addr, template := runProxy(t, a)
+
+	dial := func(t *testing.T, source privacypass.TokenSource) (*masque.Conn, error) {
+		t.Helper()
+		qconn, err := quic.DialAddr(
+			context.Background(),
+			addr.String(),
+			&tls.Config{ServerName: "localhost", InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+			&quic.Config{EnableDatagrams: true},
+		)
+		require.NoError(t, err)
+		tr := &masque.Transport{CredentialsProvider: &privacypass.Credentials{Source: source}}
+		cconn, err := tr.NewClientConn(qconn)
+		require.NoError(t, err)
+		t.Cleanup(func() { cconn.Close() })
+		req, err := masque.NewRequest(context.Background(), template, echoServer.LocalAddr().String())
+		require.NoError(t, err)
+		conn, _, err := cconn.Dial(req)
+		return conn, err
+	}
+
+	t.Run("valid tokens", func(t *testing.T) {
+		source := &privacypass.IssuingTokenSource{Issuer: getIssuer(t)}
+		for range 2 {
+			conn, err := dial(t, source)
+			require.NoError(t, err)
+			_, err = conn.WriteTo([]byte("foobar"), nil)
+			require.NoError(t, err)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			b := make([]byte, 1500)
+			n, _, err := conn.ReadFrom(b)
+			require.NoError(t, err)
+			require.Equal(t, "foobar", string(b[:n]))
+			require.NoError(t, conn.Close())
+		}
+	})
+
+	t.Run("double spending", func(t *testing.T) {
+		source := &replayingSource{TokenSource: &privacypass.IssuingTokenSource{Issuer: getIssuer(t)}}
+		conn, err := dial(t, source)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+
+		_, err = dial(t, source)
+		var proxyErr *masque.ProxyError
+		require.ErrorAs(t, err, &proxyErr)
+		require.Equal(t, http.StatusProxyAuthRequired, proxyErr.StatusCode)
+	})
+}
@@ -0,0 +1,157 @@
+// Package privacypass implements Privacy Pass token authentication (RFC 9577) for proxies,
+// using the issuance protocols defined in RFC 9578.
+//
+// Privacy Pass allows a proxy to authorize clients without learning their identity:
+// Clients obtain tokens from an issuer, which authenticates them, and redeem them with the proxy.
+// Due to the blinding used during issuance, the issuer can't link the tokens it issued to the tokens redeemed with the proxy.
+//
+// On the proxy side, the [Authorizer] challenges clients and verifies the tokens they redeem.
+// On the client side, [Credentials] redeems tokens obtained from a [TokenSource].
+// [Issuer] is a local, in-process issuer.
+package privacypass
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Token types (RFC 9578, Section 8.2.1).
+const (
+	// TokenTypePrivate is the privately verifiable token type, using VOPRF (P-384, SHA-384).
+	// Verifying a token requires the private key of the issuer.
+	TokenTypePrivate uint16 = 0x0001
+	// TokenTypePublic is the publicly verifiable token type, using blind RSA (2048-bit).
+	// Tokens can be verified using the public key of the issuer.
+	TokenTypePublic uint16 = 0x0002
+)
+
+const (
+	nonceLen             = 32
+	digestLen            = sha256.Size
+	redemptionContextLen = 32
+)
+
+// authenticatorLen returns the length of the token authenticator, Nk.
+func authenticatorLen(tokenType uint16) (int, error) {
+	switch tokenType {
+	case TokenTypePrivate:
+		return 48, nil
+	case TokenTypePublic:
+		return 256, nil
+	default:
+		return 0, fmt.Errorf("privacypass: unsupported token type %#04x", tokenType)
+	}
+}
+
+// A TokenChallenge is the challenge sent by the proxy (RFC 9577, Section 2.1).
+type TokenChallenge struct {
+	TokenType  uint16
+	IssuerName string
+	// RedemptionContext is either empty or 32 bytes long.
+	// A redemption context binds tokens to a context chosen by the proxy.
+	RedemptionContext []byte
+	// OriginInfo are the names of the origins the tokens are valid for.
+	// If empty, tokens can be redeemed with any origin using the issuer.
+	OriginInfo []string
+}
+
+// Marshal encodes the challenge.
+func (c *TokenChallenge) Marshal() ([]byte, error) {
+	if len(c.RedemptionContext) != 0 && len(c.RedemptionContext) != redemptionContextLen {
+		return nil, fmt.Errorf("privacypass: invalid redemption context length: %d", len(c.RedemptionContext))
+	}
+	var b cryptobyte.Builder
+	b.AddUint16(c.TokenType)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(c.IssuerName)) })
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(c.RedemptionContext) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(strings.Join(c.OriginInfo, ","))) })
+	return b.Bytes()
+}
+
+// ParseTokenChallenge parses an encoded challenge.
+func ParseTokenChallenge(data []byte) (*TokenChallenge, error) {
+	s := cryptobyte.String(data)
+	var c TokenChallenge
+	var issuerName, redemptionContext, originInfo cryptobyte.String
+	if !s.ReadUint16(&c.TokenType) ||
+		!s.ReadUint16LengthPrefixed(&issuerName) ||
+		!s.ReadUint8LengthPrefixed(&redemptionContext) ||
+		!s.ReadUint16LengthPrefixed(&originInfo) ||
+		!s.Empty() {
+		return nil, errors.New("privacypass: invalid token challenge")
+	}
+	if len(issuerName) == 0 {
+		return nil, errors.New("privacypass: missing issuer name")
+	}
+	if len(redemptionContext) != 0 && len(redemptionContext) != redemptionContextLen {
+		return nil, fmt.Errorf("privacypass: invalid redemption context length: %d", len(redemptionContext))
+	}
+	c.IssuerName = string(issuerName)
+	if len(redemptionContext) > 0 {
+		c.RedemptionContext = redemptionContext
+	}
+	if len(originInfo) > 0 {
+		c.OriginInfo = strings.Split(string(originInfo), ",")
+	}
+	return &c, nil
+}
+
+// A Token is a Privacy Pass token (RFC 9577, Section 2.2).
+type Token struct {
+	TokenType       uint16
+	Nonce           [nonceLen]byte
+	ChallengeDigest [digestLen]byte // the SHA-256 digest of the encoded challenge
+	TokenKeyID      [digestLen]byte // the SHA-256 digest of the encoded token key
+	Authenticator   []byte
+}
+
+// Marshal encodes the token.
+func (t *Token) Marshal() []byte {
+	b := make([]byte, 0, 2+nonceLen+2*digestLen+len(t.Authenticator))
+	b = append(b, t.input()...)
+	return append(b, t.Authenticator...)
+}
+
+// input returns the token input, which is the encoded token without the authenticator.
+// The authenticator is computed over the token input.
+func (t *Token) input() []byte {
+	b := make([]byte, 0, 2+nonceLen+2*digestLen)
+	b = append(b, byte(t.TokenType>>8), byte(t.TokenType))
+	b = append(b, t.Nonce[:]...)
+	b = append(b, t.ChallengeDigest[:]...)
+	return append(b, t.TokenKeyID[:]...)
+}
+
+// ParseToken parses an encoded token.
+func ParseToken(data []byte) (*Token, error) {
+	s := cryptobyte.String(data)
+	var t Token
+	if !s.ReadUint16(&t.TokenType) {
+		return nil, errors.New("privacypass: invalid token")
+	}
+	nk, err := authenticatorLen(t.TokenType)
+	if err != nil {
+		return nil, err
+	}
+	if !s.CopyBytes(t.Nonce[:]) ||
+		!s.CopyBytes(t.ChallengeDigest[:]) ||
+		!s.CopyBytes(t.TokenKeyID[:]) ||
+		!s.ReadBytes(&t.Authenticator, nk) ||
+		!s.Empty() {
+		return nil, errors.New("privacypass: invalid token")
+	}
+	return &t, nil
+}
+
+// encode encodes challenges, token keys and tokens for use in header fields.
+func encode(b []byte) string { return base64.URLEncoding.EncodeToString(b) }
+
+// decode decodes a base64url-encoded value, with or without padding.
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
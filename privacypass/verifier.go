@@ -0,0 +1,190 @@
+package privacypass
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/circl/oprf"
+)
+
+// rsaSaltLen is the PSS salt length used for publicly verifiable tokens.
+const rsaSaltLen = sha512.Size384
+
+var errInvalidAuthenticator = errors.New("privacypass: invalid token authenticator")
+
+// A Verifier verifies the authenticators of tokens of one token type, issued using one issuer key.
+type Verifier interface {
+	// TokenType returns the token type.
+	TokenType() uint16
+	// TokenKey returns the encoded public key of the issuer, which is sent to clients in the challenge.
+	TokenKey() []byte
+	// Verify verifies the authenticator of the token.
+	// The token type and the token key ID were already checked.
+	Verify(token *Token) error
+}
+
+type publicVerifier struct {
+	key      *rsa.PublicKey
+	tokenKey []byte
+}
+
+// NewPublicVerifier creates a Verifier for publicly verifiable tokens, using the RSA public key of the issuer.
+func NewPublicVerifier(key *rsa.PublicKey) (Verifier, error) {
+	return newPublicVerifier(key)
+}
+
+func newPublicVerifier(key *rsa.PublicKey) (*publicVerifier, error) {
+	if key.Size() != 256 {
+		return nil, fmt.Errorf("privacypass: invalid RSA key size: %d bits", key.N.BitLen())
+	}
+	tokenKey, err := marshalPublicTokenKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &publicVerifier{key: key, tokenKey: tokenKey}, nil
+}
+
+func (v *publicVerifier) TokenType() uint16 { return TokenTypePublic }
+func (v *publicVerifier) TokenKey() []byte  { return v.tokenKey }
+
+func (v *publicVerifier) Verify(token *Token) error {
+	digest := sha512.Sum384(token.input())
+	if err := rsa.VerifyPSS(v.key, crypto.SHA384, digest[:], token.Authenticator, &rsa.PSSOptions{SaltLength: rsaSaltLen}); err != nil {
+		return errInvalidAuthenticator
+	}
+	return nil
+}
+
+type privateVerifier struct {
+	server   oprf.VerifiableServer
+	tokenKey []byte
+}
+
+// NewPrivateVerifier creates a Verifier for privately verifiable tokens,
+// using the encoded VOPRF private key of the issuer.
+// The proxy needs to share this key with the issuer.
+func NewPrivateVerifier(privateKey []byte) (Verifier, error) {
+	key := &oprf.PrivateKey{}
+	if err := key.UnmarshalBinary(oprf.SuiteP384, privateKey); err != nil {
+		return nil, fmt.Errorf("privacypass: invalid VOPRF private key: %w", err)
+	}
+	return newPrivateVerifier(key)
+}
+
+func newPrivateVerifier(key *oprf.PrivateKey) (*privateVerifier, error) {
+	tokenKey, err := key.Public().MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &privateVerifier{server: oprf.NewVerifiableServer(oprf.SuiteP384, key), tokenKey: tokenKey}, nil
+}
+
+func (v *privateVerifier) TokenType() uint16 { return TokenTypePrivate }
+func (v *privateVerifier) TokenKey() []byte  { return v.tokenKey }
+
+func (v *privateVerifier) Verify(token *Token) error {
+	expected, err := v.server.FullEvaluate(token.input())
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(expected, token.Authenticator) != 1 {
+		return errInvalidAuthenticator
+	}
+	return nil
+}
+
+var (
+	oidRSASSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidSHA384    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+)
+
+type pssParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// marshalPublicTokenKey encodes the RSA public key as a SubjectPublicKeyInfo,
+// using the RSASSA-PSS OID with SHA-384 (RFC 9578, Section 6.5).
+func marshalPublicTokenKey(key *rsa.PublicKey) ([]byte, error) {
+	mgfParams, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: oidSHA384})
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pssParameters{
+		Hash:       pkix.AlgorithmIdentifier{Algorithm: oidSHA384},
+		MGF:        pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: mgfParams}},
+		SaltLength: rsaSaltLen,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pk := x509.MarshalPKCS1PublicKey(key)
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSASSAPSS, Parameters: asn1.RawValue{FullBytes: params}},
+		PublicKey: asn1.BitString{Bytes: pk, BitLength: 8 * len(pk)},
+	})
+}
+
+// parsePublicTokenKey parses an RSA public key encoded by marshalPublicTokenKey.
+func parsePublicTokenKey(data []byte) (*rsa.PublicKey, error) {
+	var spki subjectPublicKeyInfo
+	if rest, err := asn1.Unmarshal(data, &spki); err != nil || len(rest) > 0 {
+		return nil, errors.New("privacypass: invalid token key")
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidRSASSAPSS) {
+		return nil, fmt.Errorf("privacypass: unexpected token key algorithm: %s", spki.Algorithm.Algorithm)
+	}
+	if err := checkPSSParameters(spki.Algorithm.Parameters.FullBytes); err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS1PublicKey(spki.PublicKey.RightAlign())
+	if err != nil {
+		return nil, fmt.Errorf("privacypass: invalid token key: %w", err)
+	}
+	if key.Size() != 256 {
+		return nil, fmt.Errorf("privacypass: invalid RSA key size: %d bits", key.N.BitLen())
+	}
+	return key, nil
+}
+
+// checkPSSParameters checks that the RSASSA-PSS parameters of a token key
+// use SHA-384, MGF1 with SHA-384, and a salt length of 48 bytes.
+// The signatures of the issuer are verified using these parameters,
+// so a key using different parameters can't be used.
+func checkPSSParameters(data []byte) error {
+	var params pssParameters
+	if rest, err := asn1.Unmarshal(data, &params); err != nil || len(rest) > 0 {
+		return errors.New("privacypass: invalid RSASSA-PSS parameters")
+	}
+	if !params.Hash.Algorithm.Equal(oidSHA384) {
+		return fmt.Errorf("privacypass: unexpected RSASSA-PSS hash algorithm: %s", params.Hash.Algorithm)
+	}
+	if !params.MGF.Algorithm.Equal(oidMGF1) {
+		return fmt.Errorf("privacypass: unexpected RSASSA-PSS mask generation function: %s", params.MGF.Algorithm)
+	}
+	var mgfHash pkix.AlgorithmIdentifier
+	if rest, err := asn1.Unmarshal(params.MGF.Parameters.FullBytes, &mgfHash); err != nil || len(rest) > 0 {
+		return errors.New("privacypass: invalid RSASSA-PSS parameters")
+	}
+	if !mgfHash.Algorithm.Equal(oidSHA384) {
+		return fmt.Errorf("privacypass: unexpected RSASSA-PSS MGF1 hash algorithm: %s", mgfHash.Algorithm)
+	}
+	if params.SaltLength != rsaSaltLen {
+		return fmt.Errorf("privacypass: unexpected RSASSA-PSS salt length: %d", params.SaltLength)
+	}
+	return nil
+}
@@ -3,37 +3,129 @@ package masque
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dunglas/httpsfv"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/quic-go/quicvarint"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const maxUDPPayloadSize = 1500
 
 var contextIDZero = quicvarint.Append([]byte{}, 0)
 
+// defaultFailoverTimeout is the default value for Proxy.FailoverTimeout.
+const defaultFailoverTimeout = time.Second
+
+// maxFailoverDatagrams is the maximum number of datagrams retransmitted
+// to the next address when failing over.
+const maxFailoverDatagrams = 8
+
+// capsuleTypeNextHop is the capsule used by the proxy to inform the client about the new address
+// of the target after failing over. Its value is the address, encoded like the next-hop parameter
+// of the Proxy-Status header field.
+// Like capsuleTypeICMPError, this capsule type is not registered with IANA,
+// and clients that don't implement it just ignore it. Clients also ignore invalid values,
+// keeping the previous address.
+const capsuleTypeNextHop http3.CapsuleType = 0x2b7a4c0f
+
+// maxNextHopLen is the maximum length of the value of a next-hop capsule.
+const maxNextHopLen = 64
+
 type proxyEntry struct {
-	str  *http3.Stream
-	conn *net.UDPConn
+	str      *http3.Stream
+	capsules *capsuleWriter
+
+	mx       sync.Mutex // protects conn, closed and failover
+	conn     *net.UDPConn
+	closed   bool
+	failover *failoverState // nil if failing over is not possible (anymore)
+
+	receivedData atomic.Bool // set when the first datagram was received from the target
+
+	err error // the first error that terminated the flow, protected by mx
+
+	bytesToTarget, datagramsToTarget, droppedToTarget       atomic.Uint64
+	bytesFromTarget, datagramsFromTarget, droppedFromTarget atomic.Uint64
+}
+
+// failoverState is used to fail over to the next address of the target
+// if the first address turns out to be unreachable.
+type failoverState struct {
+	deadline time.Time
+	addrs    []netip.AddrPort // remaining addresses
+	sent     [][]byte         // datagrams sent so far, retransmitted to the next address
 }
 
-func (e proxyEntry) Close() error {
+func (e *proxyEntry) Close() error {
 	e.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeConnectError))
-	return errors.Join(e.str.Close(), e.conn.Close())
+	return errors.Join(e.str.Close(), e.closeConn())
+}
+
+func (e *proxyEntry) closeConn() error {
+	e.mx.Lock()
+	e.closed = true
+	conn := e.conn
+	e.mx.Unlock()
+	return conn.Close()
 }
 
 // A Proxy is an RFC 9298 CONNECT-UDP proxy.
+// It also proxies template-driven CONNECT-TCP requests,
+// using the same resolver and access control for both protocols.
 type Proxy struct {
+	// Resolver is used to resolve the target host.
+	// If nil, net.DefaultResolver is used.
+	Resolver HostResolver
+	// PreferIPv4 changes the address family preference when the target host resolves
+	// to both IPv4 and IPv6 addresses. By default, IPv6 addresses are preferred.
+	// Addresses of the two address families are tried in interleaved order (RFC 8305).
+	PreferIPv4 bool
+	// FailoverTimeout is the time after the start of a flow during which the proxy fails over
+	// to the next address of the target if it receives an ICMP unreachable error,
+	// as long as no datagram has been received from the target.
+	// Datagrams sent so far are retransmitted to the new address.
+	// The next-hop in the Proxy-Status header field reports the address used when the response was sent.
+	// After failing over, the new address is sent to the client in a capsule.
+	// If zero, a timeout of 1s is used. Failing over is disabled if the timeout is negative.
+	FailoverTimeout time.Duration
+	// AllowTarget, if set, is called for every address that the target resolves to,
+	// and can be used to implement access control.
+	// Addresses for which it returns false are not used.
+	// If no address is allowed, the request is rejected with a 403 status code.
+	AllowTarget func(r *ProxyRequest, addr netip.AddrPort) bool
+	// AllowTCP enables proxying CONNECT-TCP requests.
+	// By default, only CONNECT-UDP requests are proxied,
+	// and CONNECT-TCP requests are rejected with a 501 status code.
+	AllowTCP bool
+	// AccessLog, if set, is called once for every request passed to Proxy or ProxyConnectedSocket,
+	// after the flow ended or the request was rejected.
+	// It is called synchronously, and should not block.
+	AccessLog func(*FlowRecord)
+
+	// TracerProvider is used to create OpenTelemetry spans for proxied requests,
+	// covering resolving the target, dialing the target and the lifetime of the flow.
+	// If nil, the global TracerProvider is used.
+	TracerProvider trace.TracerProvider
+	// Propagator is used to extract the trace context from the header fields of the request.
+	// If nil, the global TextMapPropagator is used.
+	Propagator propagation.TextMapPropagator
+
 	mx       sync.Mutex
 	closed   bool
-	refCount sync.WaitGroup // counter for the Go routines spawned in Upgrade
+	refCount sync.WaitGroup // counter for the flows, and the Go routines spawned in Upgrade
 	closers  map[io.Closer]struct{}
 }
 
@@ -76,16 +168,29 @@ func dnsErrorToProxyStatus(proxyStatus *httpsfv.Item, dnsError *net.DNSError) {
 
 // Proxy proxies a request on a newly created connected UDP socket.
 // For more control over the UDP socket, use ProxyConnectedSocket.
+// If AllowTCP is set, CONNECT-TCP requests are proxied on a newly established TCP connection.
+// CONNECT-ETHERNET requests are rejected, they are proxied using ProxyEthernet.
 // Applications may add custom header fields to the response header,
 // but MUST NOT call WriteHeader on the http.ResponseWriter.
 func (s *Proxy) Proxy(w http.ResponseWriter, r *ProxyRequest) error {
-	s.mx.Lock()
-	if s.closed {
-		s.mx.Unlock()
-		w.WriteHeader(http.StatusServiceUnavailable)
-		return net.ErrClosed
+	rec := newFlowRecord(r)
+	ctx, span := s.startSpan(r)
+	defer endFlowSpan(span, rec)
+	if !s.startFlow() {
+		defer s.logFlow(rec)
+		return rec.reject(w, http.StatusServiceUnavailable, net.ErrClosed)
+	}
+	defer s.refCount.Done()
+	defer s.logFlow(rec)
+
+	switch r.Protocol {
+	case ProtocolConnectTCP:
+		if !s.AllowTCP {
+			return rec.reject(w, http.StatusNotImplemented, errors.New("masque: CONNECT-TCP not enabled"))
+		}
+	case ProtocolConnectEthernet:
+		return rec.reject(w, http.StatusNotImplemented, errors.New("masque: CONNECT-ETHERNET requests are proxied using ProxyEthernet"))
 	}
-	s.mx.Unlock()
 
 	proxyStatus := httpsfv.NewItem(r.Host)
 	// Adds the proxy status to the header.  Returns
@@ -102,49 +207,152 @@ func (s *Proxy) Proxy(w http.ResponseWriter, r *ProxyRequest) error {
 		return err
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", r.Target)
+	resolveCtx, resolveSpan := tracer(s.TracerProvider).Start(ctx, spanNameResolve)
+	addrs, err := resolveTarget(resolveCtx, s.Resolver, r.Target, s.PreferIPv4)
+	resolveSpan.SetAttributes(attrResolvedAddrs.Int(len(addrs)))
+	endSpan(resolveSpan, err)
 	if err != nil {
 		var dnsError *net.DNSError
 		if errors.As(err, &dnsError) {
 			dnsErrorToProxyStatus(&proxyStatus, dnsError)
 		}
 		err = writeProxyStatus(err)
-		w.WriteHeader(errToStatus(err))
-		return err
+		return rec.reject(w, errToStatus(err), err)
+	}
+
+	if s.AllowTarget != nil {
+		addrs = slices.DeleteFunc(addrs, func(addr netip.AddrPort) bool { return !s.AllowTarget(r, addr) })
+		if len(addrs) == 0 {
+			proxyStatus.Params.Add("error", "destination_ip_prohibited")
+			err = writeProxyStatus(errors.New("destination not allowed"))
+			return rec.reject(w, http.StatusForbidden, err)
+		}
+	}
+
+	if r.Protocol == ProtocolConnectTCP {
+		conn, nextHop, err := s.dialTCP(ctx, addrs)
+		if nextHop.IsValid() {
+			proxyStatus.Params.Add("next-hop", nextHop.String())
+		}
+		if err != nil {
+			errType, status := tcpDialErrorToProxyStatus(err)
+			proxyStatus.Params.Add("error", errType)
+			err = writeProxyStatus(err)
+			return rec.reject(w, status, err)
+		}
+		defer conn.Close()
+		if err = writeProxyStatus(nil); err != nil {
+			return rec.reject(w, errToStatus(err), err)
+		}
+		return s.proxyTCP(ctx, w, conn, rec)
 	}
-	proxyStatus.Params.Add("next-hop", addr.String())
 
-	conn, err := net.DialUDP("udp", nil, addr)
+	// Dialing a UDP socket fails if there's no route to the address.
+	// In that case, try the next address.
+	_, dialSpan := tracer(s.TracerProvider).Start(ctx, spanNameDialTarget)
+	var conn *net.UDPConn
+	var nextHop netip.AddrPort
+	for len(addrs) > 0 {
+		nextHop, addrs = addrs[0], addrs[1:]
+		conn, err = net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(nextHop))
+		if err == nil {
+			break
+		}
+	}
+	dialSpan.SetAttributes(attrNextHop.String(nextHop.String()))
+	endSpan(dialSpan, err)
+	proxyStatus.Params.Add("next-hop", nextHop.String())
 	if err != nil {
 		proxyStatus.Params.Add("error", "destination_ip_unroutable")
 		err = writeProxyStatus(err)
-		w.WriteHeader(errToStatus(err))
-		return err
+		return rec.reject(w, errToStatus(err), err)
 	}
 	defer conn.Close()
 
 	if err = writeProxyStatus(nil); err != nil {
-		w.WriteHeader(errToStatus(err))
-		return err
+		return rec.reject(w, errToStatus(err), err)
 	}
-	return s.ProxyConnectedSocket(w, r, conn)
+	var failover *failoverState
+	if len(addrs) > 0 && s.FailoverTimeout >= 0 {
+		timeout := s.FailoverTimeout
+		if timeout == 0 {
+			timeout = defaultFailoverTimeout
+		}
+		failover = &failoverState{deadline: time.Now().Add(timeout), addrs: addrs}
+	}
+	return s.proxyConnectedSocket(ctx, w, r, conn, failover, rec)
 }
 
 // ProxyConnectedSocket proxies a request on a connected UDP socket.
 // Applications may add custom header fields such as Proxy-Status
 // to the response header, but MUST NOT call WriteHeader on the
 // http.ResponseWriter. It closes the connection before returning.
-func (s *Proxy) ProxyConnectedSocket(w http.ResponseWriter, _ *ProxyRequest, conn *net.UDPConn) error {
+// Only CONNECT-UDP requests can be proxied, other requests are rejected.
+func (s *Proxy) ProxyConnectedSocket(w http.ResponseWriter, r *ProxyRequest, conn *net.UDPConn) error {
+	rec := newFlowRecord(r)
+	ctx, span := s.startSpan(r)
+	defer endFlowSpan(span, rec)
+	if r.Protocol != "" && r.Protocol != ProtocolConnectUDP {
+		defer s.logFlow(rec)
+		conn.Close()
+		return rec.reject(w, http.StatusBadRequest, fmt.Errorf("masque: can't proxy a %s request on a UDP socket", r.Protocol))
+	}
+	if !s.startFlow() {
+		defer s.logFlow(rec)
+		conn.Close()
+		return rec.reject(w, http.StatusServiceUnavailable, net.ErrClosed)
+	}
+	defer s.refCount.Done()
+	defer s.logFlow(rec)
+	return s.proxyConnectedSocket(ctx, w, r, conn, nil, rec)
+}
+
+// startSpan starts the span for a request,
+// using the trace context propagated in the header fields of the request.
+func (s *Proxy) startSpan(r *ProxyRequest) (context.Context, trace.Span) {
+	ctx := context.Background()
+	if req := r.Request(); req != nil {
+		ctx = propagator(s.Propagator).Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	}
+	return tracer(s.TracerProvider).Start(ctx, spanNameProxy,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrTarget.String(r.Target)),
+	)
+}
+
+// startFlow makes Close wait for the flow to end, including the call to AccessLog.
+// It returns false if the proxy is already closed.
+func (s *Proxy) startFlow() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return false
+	}
+	s.refCount.Add(1)
+	return true
+}
+
+func (s *Proxy) logFlow(rec *FlowRecord) {
+	if s.AccessLog == nil {
+		return
+	}
+	rec.End = time.Now()
+	s.AccessLog(rec)
+}
+
+func (s *Proxy) proxyConnectedSocket(ctx context.Context, w http.ResponseWriter, r *ProxyRequest, conn *net.UDPConn, failover *failoverState, rec *FlowRecord) error {
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		rec.NextHop = addr.AddrPort()
+	}
 	s.mx.Lock()
 	if s.closed {
 		s.mx.Unlock()
 		conn.Close()
-		w.WriteHeader(http.StatusServiceUnavailable)
-		return net.ErrClosed
+		return rec.reject(w, http.StatusServiceUnavailable, net.ErrClosed)
 	}
 
 	str := w.(http3.HTTPStreamer).HTTPStream()
-	entry := proxyEntry{str: str, conn: conn}
+	entry := &proxyEntry{str: str, capsules: &capsuleWriter{w: str}, conn: conn, failover: failover}
 
 	if s.closers == nil {
 		s.closers = make(map[io.Closer]struct{})
@@ -155,89 +363,285 @@ func (s *Proxy) ProxyConnectedSocket(w http.ResponseWriter, _ *ProxyRequest, con
 	defer s.refCount.Done()
 	s.mx.Unlock()
 
+	if err := enableICMPErrors(conn); err != nil {
+		log.Printf("failed to enable ICMP error reporting: %v", err)
+	}
+
 	w.Header().Set(http3.CapsuleProtocolHeader, capsuleProtocolHeaderValue)
 	w.WriteHeader(http.StatusOK)
+	rec.Status = http.StatusOK
+	r.capsules.Store(entry.capsules)
+	_, span := tracer(s.TracerProvider).Start(ctx, spanNameFlow)
+	defer endDataSpan(span, rec)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		if err := s.proxyConnSend(conn, str); err != nil {
+		if err := s.proxyConnSend(entry); err != nil {
 			log.Printf("proxying send side to %s failed: %v", conn.RemoteAddr(), err)
+			entry.setError(err)
 		}
 		str.Close()
 	}()
 	go func() {
 		defer wg.Done()
-		if err := s.proxyConnReceive(conn, str); err != nil {
+		if err := s.proxyConnReceive(entry); err != nil {
 			s.mx.Lock()
 			closed := s.closed
 			s.mx.Unlock()
 			if !closed {
 				log.Printf("proxying receive side to %s failed: %v", conn.RemoteAddr(), err)
+				entry.setError(err)
 			}
 		}
 		str.Close()
 	}()
-	// discard all capsules sent on the request stream
-	if err := skipCapsules(str); err == io.EOF {
-		log.Printf("reading from request stream failed: %v", err)
+	streamErr := r.capsuleHandlers.readCapsules(str)
+	if streamErr == io.EOF {
+		log.Printf("reading from request stream failed: %v", streamErr)
 	}
+	abortOnCapsuleError(str, streamErr)
 	str.Close()
-	conn.Close()
+	entry.closeConn()
 	wg.Wait()
 	s.mx.Lock()
 	delete(s.closers, entry)
+	proxyClosed := s.closed
 	s.mx.Unlock()
+
+	entry.mx.Lock()
+	if addr, ok := entry.conn.RemoteAddr().(*net.UDPAddr); ok {
+		rec.NextHop = addr.AddrPort()
+	}
+	switch {
+	case proxyClosed:
+		rec.CloseReason = CloseReasonProxy
+	case errors.As(streamErr, new(*CapsuleError)):
+		rec.CloseReason = streamErr.Error()
+	case entry.err != nil && !closedByClient(entry.err):
+		rec.CloseReason = entry.err.Error()
+	case closedByClient(streamErr):
+		rec.CloseReason = CloseReasonClient
+	default:
+		rec.CloseReason = streamErr.Error()
+	}
+	entry.mx.Unlock()
+	rec.BytesToTarget = entry.bytesToTarget.Load()
+	rec.DatagramsToTarget = entry.datagramsToTarget.Load()
+	rec.DroppedToTarget = entry.droppedToTarget.Load()
+	rec.BytesFromTarget = entry.bytesFromTarget.Load()
+	rec.DatagramsFromTarget = entry.datagramsFromTarget.Load()
+	rec.DroppedFromTarget = entry.droppedFromTarget.Load()
 	return nil
 }
 
-func (s *Proxy) proxyConnSend(conn *net.UDPConn, str *http3.Stream) error {
+// closedByClient says if the error was caused by the client closing the stream or the connection.
+func closedByClient(err error) bool {
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		return streamErr.Remote
+	}
+	var appErr *quic.ApplicationError
+	return errors.As(err, &appErr) && appErr.Remote
+}
+
+// setError records the error that terminated the flow.
+// Errors caused by closing the flow are ignored.
+func (e *proxyEntry) setError(err error) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	if e.err == nil && !e.closed {
+		e.err = err
+	}
+}
+
+func (s *Proxy) proxyConnSend(e *proxyEntry) error {
 	for {
-		data, err := str.ReceiveDatagram(context.Background())
+		payload, err := receivePayload(e.str, &e.droppedToTarget)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				return nil
 			}
 			return err
 		}
+		if len(payload) > maxUDPPayloadSize {
+			log.Printf("dropping datagram larger than MTU (%d > %d)", len(payload), maxUDPPayloadSize)
+			e.droppedToTarget.Add(1)
+			continue
+		}
+		conn, saved := e.connForSending(payload)
+		if _, err := conn.Write(payload); err != nil {
+			// A pending ICMP error might be reported when sending.
+			if ok, failedOver := e.handleSocketError(conn, err); ok {
+				// If the proxy failed over, a saved datagram was retransmitted to the next address.
+				if !saved || !failedOver {
+					e.droppedToTarget.Add(1)
+				}
+				continue
+			}
+			return err
+		}
+		e.datagramsToTarget.Add(1)
+		e.bytesToTarget.Add(uint64(len(payload)))
+	}
+}
+
+// receivePayload receives the next HTTP Datagram that uses context ID 0, and returns its payload.
+// Datagrams using other context IDs are dropped, and counted in dropped.
+func receivePayload(str *http3.Stream, dropped *atomic.Uint64) ([]byte, error) {
+	for {
+		data, err := str.ReceiveDatagram(context.Background())
+		if err != nil {
+			return nil, err
+		}
 		contextID, n, err := quicvarint.Parse(data)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if contextID != 0 {
-			// Drop this datagram. We currently only support proxying of UDP payloads.
-			continue
-		}
-		if len(data[n:]) > maxUDPPayloadSize {
-			log.Printf("dropping datagram larger than MTU (%d > %d)", len(data[n:]), maxUDPPayloadSize)
+			// Drop this datagram. We currently only support context ID 0.
+			dropped.Add(1)
 			continue
 		}
-		if _, err := conn.Write(data[n:]); err != nil {
-			return err
-		}
+		return data[n:], nil
 	}
 }
 
-func (s *Proxy) proxyConnReceive(conn *net.UDPConn, str *http3.Stream) error {
+func (s *Proxy) proxyConnReceive(e *proxyEntry) error {
+	str := e.str
 	b := make([]byte, len(contextIDZero)+maxUDPPayloadSize+1)
 	copy(b, contextIDZero)
 	for {
+		e.mx.Lock()
+		conn := e.conn
+		e.mx.Unlock()
 		n, err := conn.Read(b[len(contextIDZero):])
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				return nil
 			}
+			if ok, _ := e.handleSocketError(conn, err); ok {
+				continue
+			}
 			return err
 		}
+		if !e.receivedData.Load() {
+			e.receivedData.Store(true)
+			e.mx.Lock()
+			e.failover = nil
+			e.mx.Unlock()
+		}
 		if n > maxUDPPayloadSize {
 			log.Printf("dropping UDP packet larger than MTU")
+			e.droppedFromTarget.Add(1)
 			continue
 		}
 		if err := str.SendDatagram(b[:len(contextIDZero)+n]); err != nil {
+			// The packet doesn't fit into a QUIC packet, for example a Path MTU Discovery probe packet.
+			var tooLarge *quic.DatagramTooLargeError
+			if errors.As(err, &tooLarge) {
+				e.droppedFromTarget.Add(1)
+				continue
+			}
 			return err
 		}
+		e.datagramsFromTarget.Add(1)
+		e.bytesFromTarget.Add(uint64(n))
+	}
+}
+
+// connForSending returns the socket that the datagram should be sent on.
+// While failing over is possible, it also saves the datagram for retransmission,
+// and reports if it did so.
+func (e *proxyEntry) connForSending(data []byte) (*net.UDPConn, bool) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if f := e.failover; f != nil && len(f.sent) < maxFailoverDatagrams {
+		f.sent = append(f.sent, slices.Clone(data))
+		return e.conn, true
+	}
+	return e.conn, false
+}
+
+// handleSocketError is called when reading from or writing to conn failed.
+// If the error was caused by an ICMP error, it either fails over to the next address of the target,
+// or sends the ICMP errors to the client. In both cases, the flow can continue.
+// failedOver reports whether conn was replaced, in which case the datagrams saved for
+// retransmission were sent to the next address.
+func (e *proxyEntry) handleSocketError(conn *net.UDPConn, err error) (ok, failedOver bool) {
+	e.mx.Lock()
+	// The socket was replaced while it was used.
+	if conn != e.conn {
+		closed := e.closed
+		e.mx.Unlock()
+		return !closed, true
+	}
+	icmpErrs, ok := icmpErrorsFromSocket(conn, err)
+	if !ok {
+		e.mx.Unlock()
+		return false, false
+	}
+	nextHop, sent, failedOver := e.maybeFailover(icmpErrs)
+	newConn := e.conn
+	e.mx.Unlock()
+
+	// Writing to the socket and to the request stream might block,
+	// so the datagrams and capsules are written without holding the lock.
+	if failedOver {
+		for _, data := range sent {
+			newConn.Write(data)
+		}
+		return e.capsules.writeCapsule(capsuleTypeNextHop, []byte(nextHop.String())) == nil, true
+	}
+	for _, icmpErr := range icmpErrs {
+		if err := e.capsules.writeCapsule(capsuleTypeICMPError, icmpErr.append(nil)); err != nil {
+			return false, false
+		}
+	}
+	return true, false
+}
+
+// maybeFailover fails over to the next address of the target,
+// if the ICMP errors indicate that the current address is unreachable.
+// It returns the new address, and the datagrams that need to be retransmitted to it.
+// It must be called with e.mx held.
+func (e *proxyEntry) maybeFailover(icmpErrs []*ICMPError) (netip.AddrPort, [][]byte, bool) {
+	f := e.failover
+	if f == nil || e.closed {
+		return netip.AddrPort{}, nil, false
+	}
+	if e.receivedData.Load() || time.Now().After(f.deadline) {
+		e.failover = nil
+		return netip.AddrPort{}, nil, false
+	}
+	unreachable := slices.ContainsFunc(icmpErrs, func(e *ICMPError) bool {
+		return e.PortUnreachable() || e.HostUnreachable()
+	})
+	if !unreachable {
+		return netip.AddrPort{}, nil, false
+	}
+	for len(f.addrs) > 0 {
+		var addr netip.AddrPort
+		addr, f.addrs = f.addrs[0], f.addrs[1:]
+		conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			continue
+		}
+		if err := enableICMPErrors(conn); err != nil {
+			log.Printf("failed to enable ICMP error reporting: %v", err)
+		}
+		log.Printf("%s unreachable, failing over to %s", e.conn.RemoteAddr(), addr)
+		e.conn.Close()
+		e.conn = conn
+		return addr, slices.Clone(f.sent), true
 	}
+	e.failover = nil
+	return netip.AddrPort{}, nil, false
 }
 
 // Close closes the proxy, immediately terminating all proxied flows.
@@ -0,0 +1,196 @@
+package masque
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+type ethernetProxyEntry struct {
+	str  *http3.Stream
+	port EthernetPort
+
+	mx     sync.Mutex // protects closed and err
+	closed bool
+	err    error // the first error that terminated the flow
+
+	bytesToPort, framesToPort, droppedToPort       atomic.Uint64
+	bytesFromPort, framesFromPort, droppedFromPort atomic.Uint64
+}
+
+func (e *ethernetProxyEntry) Close() error {
+	e.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeConnectError))
+	return errors.Join(e.str.Close(), e.closePort())
+}
+
+func (e *ethernetProxyEntry) closePort() error {
+	e.mx.Lock()
+	e.closed = true
+	e.mx.Unlock()
+	return e.port.Close()
+}
+
+// setError records the error that terminated the flow.
+// Errors caused by closing the flow are ignored, in which case it returns false.
+func (e *ethernetProxyEntry) setError(err error) bool {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	if e.closed {
+		return false
+	}
+	if e.err == nil {
+		e.err = err
+	}
+	return true
+}
+
+// ProxyEthernet proxies a CONNECT-ETHERNET request (RFC 9729),
+// forwarding the Ethernet frames sent by the client to the port, and vice versa.
+// Applications may add custom header fields to the response header,
+// but MUST NOT call WriteHeader on the http.ResponseWriter.
+// It closes the port before returning.
+//
+// In the FlowRecord passed to AccessLog, frames sent to the port are counted as datagrams sent to the target.
+func (s *Proxy) ProxyEthernet(w http.ResponseWriter, r *ProxyRequest, port EthernetPort) error {
+	rec := newFlowRecord(r)
+	ctx, span := s.startSpan(r)
+	defer endFlowSpan(span, rec)
+	if !s.startFlow() {
+		defer s.logFlow(rec)
+		port.Close()
+		return rec.reject(w, http.StatusServiceUnavailable, net.ErrClosed)
+	}
+	defer s.refCount.Done()
+	defer s.logFlow(rec)
+
+	if r.Protocol != ProtocolConnectEthernet {
+		port.Close()
+		return rec.reject(w, http.StatusBadRequest, errors.New("masque: not a CONNECT-ETHERNET request"))
+	}
+
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		port.Close()
+		return rec.reject(w, http.StatusServiceUnavailable, net.ErrClosed)
+	}
+	str := w.(http3.HTTPStreamer).HTTPStream()
+	entry := &ethernetProxyEntry{str: str, port: port}
+	if s.closers == nil {
+		s.closers = make(map[io.Closer]struct{})
+	}
+	s.closers[entry] = struct{}{}
+	s.refCount.Add(1)
+	defer s.refCount.Done()
+	s.mx.Unlock()
+
+	w.Header().Set(http3.CapsuleProtocolHeader, capsuleProtocolHeaderValue)
+	w.WriteHeader(http.StatusOK)
+	rec.Status = http.StatusOK
+	r.capsules.Store(&capsuleWriter{w: str})
+	_, flowSpan := tracer(s.TracerProvider).Start(ctx, spanNameFlow)
+	defer endDataSpan(flowSpan, rec)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := proxyFramesToPort(entry); err != nil && entry.setError(err) {
+			log.Printf("proxying frames to the Ethernet port failed: %v", err)
+		}
+		str.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		if err := proxyFramesFromPort(entry); err != nil && entry.setError(err) {
+			log.Printf("proxying frames from the Ethernet port failed: %v", err)
+		}
+		str.Close()
+	}()
+	streamErr := r.capsuleHandlers.readCapsules(str)
+	abortOnCapsuleError(str, streamErr)
+	str.Close()
+	entry.closePort()
+	wg.Wait()
+	s.mx.Lock()
+	delete(s.closers, entry)
+	proxyClosed := s.closed
+	s.mx.Unlock()
+
+	entry.mx.Lock()
+	switch {
+	case proxyClosed:
+		rec.CloseReason = CloseReasonProxy
+	case errors.As(streamErr, new(*CapsuleError)):
+		rec.CloseReason = streamErr.Error()
+	case entry.err != nil && !closedByClient(entry.err):
+		rec.CloseReason = entry.err.Error()
+	case closedByClient(streamErr):
+		rec.CloseReason = CloseReasonClient
+	default:
+		rec.CloseReason = streamErr.Error()
+	}
+	entry.mx.Unlock()
+	rec.BytesToTarget = entry.bytesToPort.Load()
+	rec.DatagramsToTarget = entry.framesToPort.Load()
+	rec.DroppedToTarget = entry.droppedToPort.Load()
+	rec.BytesFromTarget = entry.bytesFromPort.Load()
+	rec.DatagramsFromTarget = entry.framesFromPort.Load()
+	rec.DroppedFromTarget = entry.droppedFromPort.Load()
+	return nil
+}
+
+func proxyFramesToPort(e *ethernetProxyEntry) error {
+	for {
+		frame, err := receivePayload(e.str, &e.droppedToPort)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if len(frame) < ethernetHeaderLen || len(frame) > maxEthernetFrameSize {
+			e.droppedToPort.Add(1)
+			continue
+		}
+		if err := e.port.WriteFrame(frame); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// A frame rejected by the port doesn't affect the following frames.
+			e.droppedToPort.Add(1)
+			continue
+		}
+		e.framesToPort.Add(1)
+		e.bytesToPort.Add(uint64(len(frame)))
+	}
+}
+
+func proxyFramesFromPort(e *ethernetProxyEntry) error {
+	b := make([]byte, len(contextIDZero)+maxEthernetFrameSize)
+	copy(b, contextIDZero)
+	for {
+		n, err := e.port.ReadFrame(b[len(contextIDZero):])
+		if err != nil {
+			return err
+		}
+		if err := e.str.SendDatagram(b[:len(contextIDZero)+n]); err != nil {
+			// The frame doesn't fit into a QUIC packet.
+			var tooLarge *quic.DatagramTooLargeError
+			if errors.As(err, &tooLarge) {
+				e.droppedFromPort.Add(1)
+				continue
+			}
+			return err
+		}
+		e.framesFromPort.Add(1)
+		e.bytesFromPort.Add(uint64(n))
+	}
+}
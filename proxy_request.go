@@ -1,27 +1,129 @@
 package masque
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"reflect"
 	"strconv"
-	"strings"
+	"sync/atomic"
 
 	"github.com/dunglas/httpsfv"
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/yosida95/uritemplate/v3"
 )
 
-// ProxyRequest is the parsed CONNECT-UDP request returned from ParseProxyRequest.
+// ProxyRequest is the parsed CONNECT-UDP, CONNECT-TCP or CONNECT-ETHERNET request returned from ParseProxyRequest.
+// CONNECT-ETHERNET requests don't have a target, and all target fields are empty.
 // Target is the target server that the client requests to connect to.
 // It can either be DNS name:port or an IP:port.
+// The Proxy connects to Target. Applications may rewrite it before proxying the request.
 type ProxyRequest struct {
 	Target string
 	Host   string
+
+	// TargetHost is the target_host requested by the client.
+	// It is either a DNS name or an IP address. IPv6 addresses are not enclosed in brackets.
+	TargetHost string
+	// TargetIP is the target IP address.
+	// It is only valid if the client requested a connection to an IP address,
+	// and the zero value if TargetHost is a DNS name.
+	TargetIP netip.Addr
+	// TargetPort is the target_port requested by the client.
+	// It is not validated, invalid port numbers are rejected when proxying the request.
+	TargetPort int
+	// Vars contains the values of all template variables other than target_host and target_port.
+	Vars map[string]string
+	// Template is the URI template that the request was matched against.
+	Template *uritemplate.Template
+	// Protocol is the requested protocol: ProtocolConnectUDP, ProtocolConnectTCP or ProtocolConnectEthernet.
+	// The Proxy treats requests with an empty Protocol as CONNECT-UDP requests.
+	Protocol string
+	// Identity identifies the client, for example the name of the authenticated user.
+	// It is not set by ParseProxyRequest. Applications may set it when authorizing the request,
+	// and it is included in the FlowRecord passed to Proxy.AccessLog.
+	Identity string
+
+	req *http.Request
+
+	capsuleHandlers capsuleHandlers
+	capsules        atomic.Pointer[capsuleWriter] // set when the flow is established
+}
+
+// TargetIsIP says if the client requested a connection to an IP address (as opposed to a DNS name).
+func (r *ProxyRequest) TargetIsIP() bool { return r.TargetIP.IsValid() }
+
+// Request returns the original HTTP request.
+func (r *ProxyRequest) Request() *http.Request { return r.req }
+
+// RemoteAddr returns the address of the client.
+func (r *ProxyRequest) RemoteAddr() net.Addr {
+	if r.req == nil {
+		return nil
+	}
+	addr, _ := r.req.Context().Value(http3.RemoteAddrContextKey).(net.Addr)
+	return addr
+}
+
+// TLS returns the TLS connection state of the QUIC connection that the request was received on.
+// The client's certificate chain (if any) can be found in TLS().PeerCertificates.
+func (r *ProxyRequest) TLS() *tls.ConnectionState {
+	if r.req == nil {
+		return nil
+	}
+	return r.req.TLS
+}
+
+// QUICConn returns the QUIC connection that the request was received on.
+// It is only available if the http3.Server was configured to use [QUICConnContext].
+func (r *ProxyRequest) QUICConn() *quic.Conn {
+	if r.req == nil {
+		return nil
+	}
+	conn, _ := r.req.Context().Value(quicConnContextKey{}).(*quic.Conn)
+	return conn
+}
+
+// HandleCapsule registers the handler for capsules of the given type, received on the request stream.
+// It must be called before the request is proxied, for example in [Handler.Authorize].
+// CONNECT-TCP doesn't use capsules.
+func (r *ProxyRequest) HandleCapsule(ct http3.CapsuleType, handler CapsuleHandler) {
+	r.capsuleHandlers.handle(ct, handler)
+}
+
+// HandleUnknownCapsules registers the handler for capsules of all types that no handler was registered for.
+// By default, these capsules are skipped. See [ErrUnknownCapsule].
+// It must be called before the request is proxied.
+func (r *ProxyRequest) HandleUnknownCapsules(handler CapsuleHandler) {
+	r.capsuleHandlers.unknown = handler
 }
 
-// ProxyRequestParseError is returned from ParseProxyRequest if parsing the CONNECT-UDP request fails.
+// SendCapsule sends a capsule on the request stream.
+// It can only be used once the flow is established, for example from a [CapsuleHandler].
+func (r *ProxyRequest) SendCapsule(ct http3.CapsuleType, value []byte) error {
+	w := r.capsules.Load()
+	if w == nil {
+		return errors.New("masque: flow not established")
+	}
+	return w.writeCapsule(ct, value)
+}
+
+type quicConnContextKey struct{}
+
+// QUICConnContext stores the QUIC connection in the connection's context.
+// It is intended to be used as the ConnContext callback of the http3.Server,
+// making the QUIC connection available to handlers via [ProxyRequest.QUICConn].
+func QUICConnContext(ctx context.Context, conn *quic.Conn) context.Context {
+	return context.WithValue(ctx, quicConnContextKey{}, conn)
+}
+
+// ProxyRequestParseError is returned from ParseProxyRequest if parsing the request fails.
 // It is recommended that the request is rejected with the corresponding HTTP status code.
 type ProxyRequestParseError struct {
 	HTTPStatus int
@@ -31,8 +133,10 @@ type ProxyRequestParseError struct {
 func (e *ProxyRequestParseError) Error() string { return e.Err.Error() }
 func (e *ProxyRequestParseError) Unwrap() error { return e.Err }
 
-// ParseProxyRequest parses a CONNECT-UDP request.
-// The template is the URI template that clients will use to configure this UDP proxy.
+// ParseProxyRequest parses a CONNECT-UDP, a CONNECT-TCP or a CONNECT-ETHERNET request.
+// The template is the URI template that clients will use to configure this proxy.
+// The same template can be used for CONNECT-UDP and CONNECT-TCP.
+// CONNECT-ETHERNET templates don't need to contain the target_host and target_port variables.
 func ParseProxyRequest(r *http.Request, template *uritemplate.Template) (*ProxyRequest, error) {
 	u, err := url.Parse(template.Raw())
 	if err != nil {
@@ -48,7 +152,7 @@ func ParseProxyRequest(r *http.Request, template *uritemplate.Template) (*ProxyR
 			Err:        fmt.Errorf("expected CONNECT request, got %s", r.Method),
 		}
 	}
-	if r.Proto != requestProtocol {
+	if r.Proto != ProtocolConnectUDP && r.Proto != ProtocolConnectTCP && r.Proto != ProtocolConnectEthernet {
 		return nil, &ProxyRequestParseError{
 			HTTPStatus: http.StatusNotImplemented,
 			Err:        fmt.Errorf("unexpected protocol: %s", r.Proto),
@@ -63,6 +167,13 @@ func ParseProxyRequest(r *http.Request, template *uritemplate.Template) (*ProxyR
 	// The capsule protocol header is optional, but if it's present,
 	// we need to validate its value.
 	capsuleHeaderValues, ok := r.Header[http3.CapsuleProtocolHeader]
+	if ok && r.Proto == ProtocolConnectTCP {
+		// The byte stream is sent in DATA frames, DATA capsules are not supported.
+		return nil, &ProxyRequestParseError{
+			HTTPStatus: http.StatusNotImplemented,
+			Err:        fmt.Errorf("capsule protocol not supported for %s", r.Proto),
+		}
+	}
 	if ok {
 		item, err := httpsfv.UnmarshalItem(capsuleHeaderValues)
 		if err != nil {
@@ -85,6 +196,21 @@ func ParseProxyRequest(r *http.Request, template *uritemplate.Template) (*ProxyR
 	}
 
 	match := template.Match(r.URL.String())
+	if r.Proto == ProtocolConnectEthernet {
+		if match == nil {
+			return nil, &ProxyRequestParseError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("request doesn't match the template"),
+			}
+		}
+		return &ProxyRequest{
+			Host:     r.Host,
+			Vars:     templateVars(template, match),
+			Template: template,
+			Protocol: r.Proto,
+			req:      r,
+		}, nil
+	}
 	targetHost := match.Get(uriTemplateTargetHost).String()
 	targetPortStr := match.Get(uriTemplateTargetPort).String()
 	if targetHost == "" || targetPortStr == "" {
@@ -93,10 +219,6 @@ func ParseProxyRequest(r *http.Request, template *uritemplate.Template) (*ProxyR
 			Err:        fmt.Errorf("expected target_host and target_port"),
 		}
 	}
-	// IPv6 addresses need to be enclosed in [], otherwise resolving the address will fail.
-	if strings.Contains(targetHost, ":") {
-		targetHost = "[" + targetHost + "]"
-	}
 	targetPort, err := strconv.Atoi(targetPortStr)
 	if err != nil {
 		return nil, &ProxyRequestParseError{
@@ -104,8 +226,32 @@ func ParseProxyRequest(r *http.Request, template *uritemplate.Template) (*ProxyR
 			Err:        fmt.Errorf("failed to decode target_port: %w", err),
 		}
 	}
+	// The zero value is returned for DNS names.
+	targetIP, _ := netip.ParseAddr(targetHost)
 	return &ProxyRequest{
-		Target: fmt.Sprintf("%s:%d", targetHost, targetPort),
-		Host:   r.Host,
+		Target:     net.JoinHostPort(targetHost, strconv.Itoa(targetPort)),
+		Host:       r.Host,
+		TargetHost: targetHost,
+		TargetIP:   targetIP.Unmap(),
+		TargetPort: targetPort,
+		Vars:       templateVars(template, match),
+		Template:   template,
+		Protocol:   r.Proto,
+		req:        r,
 	}, nil
 }
+
+// templateVars returns the values of all template variables other than target_host and target_port.
+func templateVars(template *uritemplate.Template, match uritemplate.Values) map[string]string {
+	var vars map[string]string
+	for _, name := range template.Varnames() {
+		if name == uriTemplateTargetHost || name == uriTemplateTargetPort {
+			continue
+		}
+		if vars == nil {
+			vars = make(map[string]string)
+		}
+		vars[name] = match.Get(name).String()
+	}
+	return vars
+}
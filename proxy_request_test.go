@@ -3,6 +3,7 @@ package masque_test
 import (
 	"fmt"
 	"net/http"
+	"net/netip"
 	"strings"
 	"testing"
 
@@ -22,6 +23,12 @@ func TestProxyRequestParsing(t *testing.T) {
 		r, err := masque.ParseProxyRequest(req, template)
 		require.NoError(t, err)
 		require.Equal(t, r.Target, "localhost:1337")
+		require.Equal(t, "localhost", r.TargetHost)
+		require.Equal(t, 1337, r.TargetPort)
+		require.False(t, r.TargetIsIP())
+		require.Same(t, req, r.Request())
+		require.Empty(t, r.Vars)
+		require.Equal(t, masque.ProtocolConnectUDP, r.Protocol)
 	})
 
 	t.Run("valid request for an IPv4 address", func(t *testing.T) {
@@ -29,6 +36,9 @@ func TestProxyRequestParsing(t *testing.T) {
 		r, err := masque.ParseProxyRequest(req, template)
 		require.NoError(t, err)
 		require.Equal(t, r.Target, "1.2.3.4:9999")
+		require.True(t, r.TargetIsIP())
+		require.Equal(t, netip.MustParseAddr("1.2.3.4"), r.TargetIP)
+		require.Equal(t, 9999, r.TargetPort)
 	})
 
 	t.Run("valid request for an IPv6 address", func(t *testing.T) {
@@ -39,6 +49,17 @@ func TestProxyRequestParsing(t *testing.T) {
 		r, err := masque.ParseProxyRequest(req, template)
 		require.NoError(t, err)
 		require.Equal(t, r.Target, "[::1]:1234")
+		require.Equal(t, "::1", r.TargetHost)
+		require.Equal(t, netip.IPv6Loopback(), r.TargetIP)
+	})
+
+	t.Run("additional template variables", func(t *testing.T) {
+		template := uritemplate.MustNew("https://localhost:1234/{tenant}/masque?h={target_host}&p={target_port}")
+		req := newRequest("https://localhost:1234/acme/masque?h=localhost&p=1337")
+		r, err := masque.ParseProxyRequest(req, template)
+		require.NoError(t, err)
+		require.Equal(t, "localhost:1337", r.Target)
+		require.Equal(t, map[string]string{"tenant": "acme"}, r.Vars)
 	})
 
 	t.Run("valid request, without the Capsule-Protocol header", func(t *testing.T) {
@@ -48,6 +69,41 @@ func TestProxyRequestParsing(t *testing.T) {
 		require.NoError(t, err)
 	})
 
+	t.Run("valid CONNECT-TCP request", func(t *testing.T) {
+		req := newRequest("https://localhost:1234/masque?h=localhost&p=1337")
+		req.Proto = masque.ProtocolConnectTCP
+		req.Header.Del(http3.CapsuleProtocolHeader)
+		r, err := masque.ParseProxyRequest(req, template)
+		require.NoError(t, err)
+		require.Equal(t, masque.ProtocolConnectTCP, r.Protocol)
+		require.Equal(t, "localhost:1337", r.Target)
+	})
+
+	t.Run("CONNECT-TCP request using the capsule protocol", func(t *testing.T) {
+		req := newRequest("https://localhost:1234/masque?h=localhost&p=1337")
+		req.Proto = masque.ProtocolConnectTCP
+		_, err := masque.ParseProxyRequest(req, template)
+		require.EqualError(t, err, "capsule protocol not supported for connect-tcp")
+		require.Equal(t, http.StatusNotImplemented, err.(*masque.ProxyRequestParseError).HTTPStatus)
+	})
+
+	t.Run("valid CONNECT-ETHERNET request", func(t *testing.T) {
+		template := uritemplate.MustNew("https://localhost:1234/ethernet/{segment}")
+		req := newRequest("https://localhost:1234/ethernet/lab")
+		req.Proto = masque.ProtocolConnectEthernet
+		r, err := masque.ParseProxyRequest(req, template)
+		require.NoError(t, err)
+		require.Equal(t, masque.ProtocolConnectEthernet, r.Protocol)
+		require.Empty(t, r.Target)
+		require.Equal(t, map[string]string{"segment": "lab"}, r.Vars)
+
+		req = newRequest("https://localhost:1234/foobar")
+		req.Proto = masque.ProtocolConnectEthernet
+		_, err = masque.ParseProxyRequest(req, template)
+		require.EqualError(t, err, "request doesn't match the template")
+		require.Equal(t, http.StatusBadRequest, err.(*masque.ProxyRequestParseError).HTTPStatus)
+	})
+
 	t.Run("wrong request method", func(t *testing.T) {
 		req := newRequest("https://localhost:1234/masque")
 		req.Method = http.MethodHead
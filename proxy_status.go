@@ -0,0 +1,227 @@
+package masque
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/dunglas/httpsfv"
+)
+
+// Proxy error types, as defined in RFC 9209, Section 2.3.
+const (
+	ProxyErrorDNSTimeout              = "dns_timeout"
+	ProxyErrorDNSError                = "dns_error"
+	ProxyErrorDestinationNotFound     = "destination_not_found"
+	ProxyErrorDestinationUnavailable  = "destination_unavailable"
+	ProxyErrorDestinationIPProhibited = "destination_ip_prohibited"
+	ProxyErrorDestinationIPUnroutable = "destination_ip_unroutable"
+	ProxyErrorConnectionRefused       = "connection_refused"
+	ProxyErrorConnectionTerminated    = "connection_terminated"
+	ProxyErrorConnectionTimeout       = "connection_timeout"
+	ProxyErrorConnectionReadTimeout   = "connection_read_timeout"
+	ProxyErrorConnectionWriteTimeout  = "connection_write_timeout"
+	ProxyErrorConnectionLimitReached  = "connection_limit_reached"
+	ProxyErrorHTTPRequestError        = "http_request_error"
+	ProxyErrorHTTPRequestDenied       = "http_request_denied"
+	ProxyErrorProxyInternalError      = "proxy_internal_error"
+	ProxyErrorProxyConfigurationError = "proxy_configuration_error"
+	ProxyErrorProxyLoopDetected       = "proxy_loop_detected"
+)
+
+// ProxyStatus is a member of the Proxy-Status header field (RFC 9209).
+// Every intermediary that handled the request adds one member.
+type ProxyStatus struct {
+	// Proxy identifies the intermediary.
+	Proxy string
+	// Error is the proxy error type (e.g. "dns_error"), if any.
+	Error string
+	// Details contains additional, implementation-specific information about the error.
+	Details string
+	// NextHop is the next hop that the intermediary connected to (or tried to connect to).
+	NextHop string
+	// NextProtocol is the ALPN protocol identifier used to connect to the next hop.
+	NextProtocol string
+	// ReceivedStatus is the HTTP status code received from the next hop, or 0 if not present.
+	ReceivedStatus int
+	// RCode is the DNS response code, only used for dns_error.
+	RCode string
+	// InfoCode is the Extended DNS Error code (RFC 8914), only used for dns_error.
+	// It is -1 if not present.
+	InfoCode int
+}
+
+// ParseProxyStatus parses the Proxy-Status header field.
+// The first member represents the intermediary closest to the target,
+// the last member the intermediary closest to the client.
+func ParseProxyStatus(h http.Header) ([]ProxyStatus, error) {
+	vals := h.Values("Proxy-Status")
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	list, err := httpsfv.UnmarshalList(vals)
+	if err != nil {
+		return nil, fmt.Errorf("masque: invalid Proxy-Status: %w", err)
+	}
+	statuses := make([]ProxyStatus, 0, len(list))
+	for _, member := range list {
+		item, ok := member.(httpsfv.Item)
+		if !ok {
+			return nil, fmt.Errorf("masque: invalid Proxy-Status: unexpected inner list")
+		}
+		proxy, ok := sfvString(item.Value)
+		if !ok {
+			return nil, fmt.Errorf("masque: invalid Proxy-Status: unexpected type %T", item.Value)
+		}
+		status := ProxyStatus{Proxy: proxy, InfoCode: -1}
+		for _, name := range item.Params.Names() {
+			v, _ := item.Params.Get(name)
+			switch name {
+			case "error":
+				status.Error, _ = sfvString(v)
+			case "details":
+				status.Details, _ = sfvString(v)
+			case "next-hop":
+				status.NextHop, _ = sfvString(v)
+			case "next-protocol":
+				switch v := v.(type) {
+				case []byte:
+					status.NextProtocol = string(v)
+				default:
+					status.NextProtocol, _ = sfvString(v)
+				}
+			case "rcode":
+				status.RCode, _ = sfvString(v)
+			case "received-status":
+				if i, ok := v.(int64); ok {
+					status.ReceivedStatus = int(i)
+				}
+			case "info-code":
+				if i, ok := v.(int64); ok {
+					status.InfoCode = int(i)
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Strings and tokens are both used in practice.
+func sfvString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case httpsfv.Token:
+		return string(v), true
+	default:
+		return "", false
+	}
+}
+
+// A ProxyError is returned when the proxy rejects a CONNECT-UDP request.
+type ProxyError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// ProxyStatus is the parsed Proxy-Status header field of the response.
+	ProxyStatus []ProxyStatus
+}
+
+// ErrorType returns the proxy error type (e.g. "dns_error") reported by the intermediary closest to the target.
+// It returns an empty string if no intermediary reported an error.
+func (e *ProxyError) ErrorType() string {
+	if s := e.status(); s != nil {
+		return s.Error
+	}
+	return ""
+}
+
+// status returns the first intermediary that reported an error.
+func (e *ProxyError) status() *ProxyStatus {
+	for i := range e.ProxyStatus {
+		if e.ProxyStatus[i].Error != "" {
+			return &e.ProxyStatus[i]
+		}
+	}
+	return nil
+}
+
+// IsDNSError says if the proxy failed to resolve the target.
+func (e *ProxyError) IsDNSError() bool {
+	switch e.ErrorType() {
+	case ProxyErrorDNSError, ProxyErrorDNSTimeout, ProxyErrorDestinationNotFound:
+		return true
+	}
+	return false
+}
+
+// IsDenied says if the proxy refused to connect to the target due to its policy.
+func (e *ProxyError) IsDenied() bool {
+	switch e.ErrorType() {
+	case ProxyErrorDestinationIPProhibited, ProxyErrorHTTPRequestDenied:
+		return true
+	}
+	return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusProxyAuthRequired
+}
+
+// Timeout says if the request failed due to a timeout.
+func (e *ProxyError) Timeout() bool {
+	switch e.ErrorType() {
+	case ProxyErrorDNSTimeout, ProxyErrorConnectionTimeout,
+		ProxyErrorConnectionReadTimeout, ProxyErrorConnectionWriteTimeout:
+		return true
+	}
+	return e.StatusCode == http.StatusGatewayTimeout
+}
+
+// Retryable says if retrying the request later might succeed.
+// This is the case for timeouts and for temporary conditions on the proxy,
+// but not if the proxy denied the request, or if the target doesn't exist.
+func (e *ProxyError) Retryable() bool {
+	if e.Timeout() {
+		return true
+	}
+	switch e.ErrorType() {
+	case ProxyErrorDestinationUnavailable, ProxyErrorConnectionLimitReached, ProxyErrorConnectionRefused:
+		return true
+	}
+	return slices.Contains([]int{http.StatusTooManyRequests, http.StatusServiceUnavailable}, e.StatusCode)
+}
+
+func (e *ProxyError) Error() string {
+	msg := fmt.Sprintf("masque: server responded with %d", e.StatusCode)
+	s := e.status()
+	if s == nil {
+		return msg
+	}
+	details := []string{s.Error}
+	if s.RCode != "" {
+		details = append(details, "rcode: "+s.RCode)
+	}
+	if s.Details != "" {
+		details = append(details, s.Details)
+	}
+	return fmt.Sprintf("%s (%s)", msg, strings.Join(details, ", "))
+}
+
+// isProxyFailure says if the error was caused by the proxy itself (e.g. because it is overloaded),
+// and not by the target or the request.
+// Another proxy might be able to handle the request.
+func (e *ProxyError) isProxyFailure() bool {
+	if e.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if e.StatusCode < 500 {
+		return false
+	}
+	switch e.ErrorType() {
+	case ProxyErrorDNSTimeout, ProxyErrorDNSError,
+		ProxyErrorDestinationNotFound, ProxyErrorDestinationUnavailable,
+		ProxyErrorDestinationIPProhibited, ProxyErrorDestinationIPUnroutable,
+		ProxyErrorConnectionRefused, ProxyErrorConnectionTerminated, ProxyErrorConnectionTimeout,
+		ProxyErrorConnectionReadTimeout, ProxyErrorConnectionWriteTimeout:
+		return false
+	}
+	return true
+}
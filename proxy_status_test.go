@@ -0,0 +1,89 @@
+package masque_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProxyStatus(t *testing.T) {
+	t.Run("no Proxy-Status", func(t *testing.T) {
+		statuses, err := masque.ParseProxyStatus(http.Header{})
+		require.NoError(t, err)
+		require.Empty(t, statuses)
+	})
+
+	t.Run("multiple intermediaries", func(t *testing.T) {
+		h := http.Header{}
+		h.Add("Proxy-Status", `masque-proxy; error=dns_error; rcode="NXDOMAIN"; info-code=3; details="no such host"`)
+		h.Add("Proxy-Status", `"cdn.example"; received-status=502; next-hop="192.0.2.1:443"; next-protocol=h3`)
+		statuses, err := masque.ParseProxyStatus(h)
+		require.NoError(t, err)
+		require.Equal(t, []masque.ProxyStatus{
+			{
+				Proxy:    "masque-proxy",
+				Error:    masque.ProxyErrorDNSError,
+				RCode:    "NXDOMAIN",
+				InfoCode: 3,
+				Details:  "no such host",
+			},
+			{
+				Proxy:          "cdn.example",
+				ReceivedStatus: 502,
+				NextHop:        "192.0.2.1:443",
+				NextProtocol:   "h3",
+				InfoCode:       -1,
+			},
+		}, statuses)
+	})
+
+	t.Run("invalid Proxy-Status", func(t *testing.T) {
+		h := http.Header{}
+		h.Add("Proxy-Status", `"proxy"; error=`)
+		_, err := masque.ParseProxyStatus(h)
+		require.ErrorContains(t, err, "invalid Proxy-Status")
+	})
+}
+
+func TestProxyError(t *testing.T) {
+	t.Run("DNS error", func(t *testing.T) {
+		err := &masque.ProxyError{
+			StatusCode:  http.StatusBadGateway,
+			ProxyStatus: []masque.ProxyStatus{{Proxy: "proxy", Error: masque.ProxyErrorDNSError, RCode: "NXDOMAIN"}},
+		}
+		require.True(t, err.IsDNSError())
+		require.False(t, err.Timeout())
+		require.False(t, err.IsDenied())
+		require.False(t, err.Retryable())
+		require.EqualError(t, err, "masque: server responded with 502 (dns_error, rcode: NXDOMAIN)")
+	})
+
+	t.Run("DNS timeout", func(t *testing.T) {
+		err := &masque.ProxyError{
+			StatusCode:  http.StatusGatewayTimeout,
+			ProxyStatus: []masque.ProxyStatus{{Proxy: "proxy", Error: masque.ProxyErrorDNSTimeout}},
+		}
+		require.True(t, err.IsDNSError())
+		require.True(t, err.Timeout())
+		require.True(t, err.Retryable())
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		err := &masque.ProxyError{
+			StatusCode:  http.StatusForbidden,
+			ProxyStatus: []masque.ProxyStatus{{Proxy: "proxy", Error: masque.ProxyErrorDestinationIPProhibited}},
+		}
+		require.True(t, err.IsDenied())
+		require.False(t, err.Retryable())
+	})
+
+	t.Run("without Proxy-Status", func(t *testing.T) {
+		err := &masque.ProxyError{StatusCode: http.StatusServiceUnavailable}
+		require.Empty(t, err.ErrorType())
+		require.True(t, err.Retryable())
+		require.EqualError(t, err, "masque: server responded with 503")
+	})
+}
@@ -0,0 +1,181 @@
+package masque
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// tcpDialTimeout is the timeout for establishing a TCP connection to a single address of the target.
+const tcpDialTimeout = 10 * time.Second
+
+type tcpProxyEntry struct {
+	str  *http3.Stream
+	conn *net.TCPConn
+
+	mx     sync.Mutex
+	closed bool
+	err    error // the first error that terminated the flow, protected by mx
+}
+
+// abort terminates both directions of the flow.
+// The error is recorded as the error that terminated the flow, unless the flow was already aborted.
+func (e *tcpProxyEntry) abort(err error) {
+	e.mx.Lock()
+	if !e.closed {
+		e.closed = true
+		e.err = err
+	}
+	e.mx.Unlock()
+	e.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeConnectError))
+	e.str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeConnectError))
+	e.conn.Close()
+}
+
+func (e *tcpProxyEntry) Close() error {
+	e.abort(nil)
+	return nil
+}
+
+// dialTCP establishes a TCP connection to the target, trying the addresses in order.
+func (s *Proxy) dialTCP(ctx context.Context, addrs []netip.AddrPort) (*net.TCPConn, netip.AddrPort, error) {
+	ctx, span := tracer(s.TracerProvider).Start(ctx, spanNameDialTarget)
+	var nextHop netip.AddrPort
+	var errs []error
+	dialer := &net.Dialer{Timeout: tcpDialTimeout}
+	for _, addr := range addrs {
+		nextHop = addr
+		conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+		if err == nil {
+			span.SetAttributes(attrNextHop.String(nextHop.String()))
+			span.End()
+			return conn.(*net.TCPConn), nextHop, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// Only the last error is reported, since it is used to determine the status code.
+	err := errs[len(errs)-1]
+	span.SetAttributes(attrNextHop.String(nextHop.String()))
+	endSpan(span, errors.Join(errs...))
+	return nil, nextHop, err
+}
+
+// tcpDialErrorToProxyStatus determines the Proxy-Status error type (RFC 9209 Section 2.3)
+// and the status code for a failed TCP connection attempt.
+func tcpDialErrorToProxyStatus(err error) (string, int) {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "connection_timeout", http.StatusGatewayTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused", http.StatusBadGateway
+	default:
+		return "destination_ip_unroutable", http.StatusBadGateway
+	}
+}
+
+// proxyTCP proxies a CONNECT-TCP request on an established TCP connection.
+// The byte stream is copied in both directions, and closing one direction is forwarded to the other side.
+func (s *Proxy) proxyTCP(ctx context.Context, w http.ResponseWriter, conn *net.TCPConn, rec *FlowRecord) error {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		rec.NextHop = addr.AddrPort()
+	}
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return rec.reject(w, http.StatusServiceUnavailable, net.ErrClosed)
+	}
+
+	str := w.(http3.HTTPStreamer).HTTPStream()
+	entry := &tcpProxyEntry{str: str, conn: conn}
+
+	if s.closers == nil {
+		s.closers = make(map[io.Closer]struct{})
+	}
+	s.closers[entry] = struct{}{}
+
+	s.refCount.Add(1)
+	defer s.refCount.Done()
+	s.mx.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	rec.Status = http.StatusOK
+	_, span := tracer(s.TracerProvider).Start(ctx, spanNameFlow)
+	defer endDataSpan(span, rec)
+
+	// The client stops reading when it closes the connection.
+	// There's no need to wait for the target to send more data in that case,
+	// but the data sent by the client is still forwarded to the target.
+	stop := context.AfterFunc(str.Context(), func() {
+		if stoppedReading(str) {
+			conn.SetReadDeadline(time.Now())
+		}
+	})
+	defer stop()
+
+	var bytesToTarget int64
+	var clientDone atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := io.Copy(conn, str)
+		bytesToTarget = n
+		clientDone.Store(true)
+		if err != nil {
+			log.Printf("proxying to %s failed: %v", conn.RemoteAddr(), err)
+			entry.abort(err)
+			return
+		}
+		conn.CloseWrite()
+	}()
+	bytesFromTarget, err := io.Copy(str, conn)
+	targetClosedFirst := err == nil && !clientDone.Load()
+	switch {
+	case err == nil:
+		str.Close()
+	case stoppedReading(str):
+	default:
+		entry.abort(err)
+	}
+	<-done
+	s.mx.Lock()
+	delete(s.closers, entry)
+	proxyClosed := s.closed
+	s.mx.Unlock()
+
+	rec.BytesToTarget = uint64(bytesToTarget)
+	rec.BytesFromTarget = uint64(bytesFromTarget)
+	entry.mx.Lock()
+	defer entry.mx.Unlock()
+	switch {
+	case proxyClosed:
+		rec.CloseReason = CloseReasonProxy
+	case entry.err != nil && !closedByClient(entry.err):
+		rec.CloseReason = entry.err.Error()
+	case entry.err != nil || !targetClosedFirst:
+		rec.CloseReason = CloseReasonClient
+	default:
+		rec.CloseReason = CloseReasonTarget
+	}
+	return nil
+}
+
+// stoppedReading says if the client stopped reading from the stream, usually because it closed the connection.
+func stoppedReading(str *http3.Stream) bool {
+	var streamErr *quic.StreamError
+	return errors.As(context.Cause(str.Context()), &streamErr) && streamErr.Remote
+}
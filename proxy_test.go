@@ -2,11 +2,14 @@ package masque_test
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
+	"runtime"
 	"testing"
 	"time"
 
@@ -126,6 +129,60 @@ func TestProxyBadPort(t *testing.T) {
 	require.NotContains(t, proxyStatus, ";error=")
 }
 
+func TestProxyUnsupportedProtocols(t *testing.T) {
+	t.Run("CONNECT-TCP", func(t *testing.T) {
+		var p masque.Proxy
+		r := newRequest("https://localhost:1234/masque?h=localhost&p=443")
+		r.Proto = masque.ProtocolConnectTCP
+		r.Header.Del("Capsule-Protocol")
+		req, err := masque.ParseProxyRequest(r, uritemplate.MustNew("https://localhost:1234/masque?h={target_host}&p={target_port}"))
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		require.EqualError(t, p.Proxy(rec, req), "masque: CONNECT-TCP not enabled")
+		require.Equal(t, http.StatusNotImplemented, rec.Code)
+	})
+
+	t.Run("CONNECT-ETHERNET", func(t *testing.T) {
+		p := masque.Proxy{AllowTCP: true}
+		r := newRequest("https://localhost:1234/ethernet/lab")
+		r.Proto = masque.ProtocolConnectEthernet
+		req, err := masque.ParseProxyRequest(r, uritemplate.MustNew("https://localhost:1234/ethernet/{segment}"))
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		require.ErrorContains(t, p.Proxy(rec, req), "proxied using ProxyEthernet")
+		require.Equal(t, http.StatusNotImplemented, rec.Code)
+	})
+}
+
+func TestProxyConnectedSocketUnsupportedProtocols(t *testing.T) {
+	for _, tc := range []struct {
+		protocol, url, template string
+	}{
+		{masque.ProtocolConnectTCP, "https://localhost:1234/masque?h=localhost&p=443", "https://localhost:1234/masque?h={target_host}&p={target_port}"},
+		{masque.ProtocolConnectEthernet, "https://localhost:1234/ethernet/lab", "https://localhost:1234/ethernet/{segment}"},
+	} {
+		t.Run(tc.protocol, func(t *testing.T) {
+			p := masque.Proxy{AllowTCP: true}
+			r := newRequest(tc.url)
+			r.Proto = tc.protocol
+			r.Header.Del("Capsule-Protocol")
+			req, err := masque.ParseProxyRequest(r, uritemplate.MustNew(tc.template))
+			require.NoError(t, err)
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+			require.NoError(t, err)
+			rec := httptest.NewRecorder()
+			require.EqualError(t,
+				p.ProxyConnectedSocket(rec, req, conn),
+				fmt.Sprintf("masque: can't proxy a %s request on a UDP socket", tc.protocol),
+			)
+			require.Equal(t, http.StatusBadRequest, rec.Code)
+			// the socket is closed
+			_, err = conn.WriteTo([]byte("foobar"), conn.LocalAddr())
+			require.ErrorIs(t, err, net.ErrClosed)
+		})
+	}
+}
+
 func TestProxyNXDOMAIN(t *testing.T) {
 	p := masque.Proxy{}
 	r := newRequest("https://localhost:1234/masque?h=nxdomain.test&p=12345") // invalid port number
@@ -167,3 +224,134 @@ func TestProxyingAfterClose(t *testing.T) {
 		require.Equal(t, http.StatusServiceUnavailable, rec.Code)
 	})
 }
+
+type fakeResolver map[string][]netip.Addr
+
+func (r fakeResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestProxyAddressSelection(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't report ICMP errors on UDP sockets")
+	}
+
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	port := remoteServerConn.LocalAddr().(*net.UDPAddr).Port
+	// Nothing is listening on [::1]:port, so this address will be unreachable.
+	resolver := fakeResolver{"quic-go.net": {netip.MustParseAddr("127.0.0.1"), netip.IPv6Loopback()}}
+
+	t.Run("failing over", func(t *testing.T) {
+		proxy := &masque.Proxy{Resolver: resolver}
+		defer proxy.Close()
+		proxiedConn, rsp := dialProxy(t, proxy, fmt.Sprintf("quic-go.net:%d", port))
+		defer proxiedConn.Close()
+		// IPv6 is preferred
+		require.Contains(t, rsp.Header.Get("Proxy-Status"), fmt.Sprintf(`next-hop="[::1]:%d"`, port))
+		require.Equal(t, fmt.Sprintf("[::1]:%d", port), proxiedConn.RemoteAddr().String())
+
+		_, err := proxiedConn.WriteTo([]byte("foobar"), nil)
+		require.NoError(t, err)
+		b := make([]byte, 1500)
+		require.NoError(t, proxiedConn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+		n, _, err := proxiedConn.ReadFrom(b)
+		require.NoError(t, err)
+		require.Equal(t, []byte("foobar"), b[:n])
+		// the proxy sends the new address in a capsule
+		require.Eventually(t, func() bool {
+			return proxiedConn.RemoteAddr().String() == fmt.Sprintf("127.0.0.1:%d", port)
+		}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+	})
+
+	t.Run("failing over, with datagrams in flight", func(t *testing.T) {
+		records := make(chan *masque.FlowRecord, 1)
+		proxy := &masque.Proxy{Resolver: resolver, AccessLog: func(rec *masque.FlowRecord) { records <- rec }}
+		defer proxy.Close()
+		proxiedConn, _ := dialProxy(t, proxy, fmt.Sprintf("quic-go.net:%d", port))
+
+		// Some of these datagrams might fail with the ICMP error when they're sent to the unreachable address.
+		// They are retransmitted to the next address, and therefore not dropped.
+		const num = 5
+		for i := range num {
+			_, err := proxiedConn.WriteTo(fmt.Appendf(nil, "foobar%d", i), nil)
+			require.NoError(t, err)
+			time.Sleep(time.Millisecond)
+		}
+		b := make([]byte, 1500)
+		require.NoError(t, proxiedConn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+		for range num {
+			_, _, err := proxiedConn.ReadFrom(b)
+			require.NoError(t, err)
+		}
+		require.NoError(t, proxiedConn.Close())
+
+		select {
+		case rec := <-records:
+			require.Zero(t, rec.DroppedToTarget)
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	})
+
+	t.Run("preferring IPv4", func(t *testing.T) {
+		proxy := &masque.Proxy{Resolver: resolver, PreferIPv4: true}
+		defer proxy.Close()
+		proxiedConn, rsp := dialProxy(t, proxy, fmt.Sprintf("quic-go.net:%d", port))
+		defer proxiedConn.Close()
+		require.Contains(t, rsp.Header.Get("Proxy-Status"), fmt.Sprintf(`next-hop="127.0.0.1:%d"`, port))
+	})
+
+	t.Run("failing over disabled", func(t *testing.T) {
+		proxy := &masque.Proxy{Resolver: resolver, FailoverTimeout: -1}
+		defer proxy.Close()
+		proxiedConn, _ := dialProxy(t, proxy, fmt.Sprintf("quic-go.net:%d", port))
+		defer proxiedConn.Close()
+
+		_, err := proxiedConn.WriteTo([]byte("foobar"), nil)
+		require.NoError(t, err)
+		require.NoError(t, proxiedConn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+		_, _, err = proxiedConn.ReadFrom(make([]byte, 1500))
+		var icmpErr *masque.ICMPError
+		require.ErrorAs(t, err, &icmpErr)
+		require.True(t, icmpErr.PortUnreachable())
+	})
+}
+
+// dialProxy runs an HTTP/3 server using the proxy, and dials a proxied connection to the target.
+func dialProxy(t *testing.T, proxy *masque.Proxy, target string) (*masque.Conn, *http.Response) {
+	t.Helper()
+
+	conn := newUDPConnLocalhost(t)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", conn.LocalAddr().(*net.UDPAddr).Port))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/masque", func(w http.ResponseWriter, r *http.Request) {
+		req, err := masque.ParseProxyRequest(r, template)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		proxy.Proxy(w, req)
+	})
+	server := &http3.Server{
+		TLSConfig:       tlsConf,
+		EnableDatagrams: true,
+		Handler:         mux,
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve(conn)
+
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+	}
+	req, err := masque.NewRequest(context.Background(), template, target)
+	require.NoError(t, err)
+	proxiedConn, rsp, err := tr.Dial(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	return proxiedConn, rsp
+}
@@ -0,0 +1,143 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// minQUICPacketSize is the smallest UDP payload that QUIC packets must fit into (RFC 9000 Section 14).
+const minQUICPacketSize = 1200
+
+// A QUICDialer dials QUIC connections to targets through the proxy,
+// tunnelling the QUIC packets over CONNECT-UDP.
+// Every connection uses its own proxied connection, which is closed when the QUIC connection is closed.
+//
+// The dial methods have the signature of the Dial callback of the http3.Transport:
+//
+//	tr := &http3.Transport{Dial: (&masque.QUICDialer{ClientConn: cc, Template: template}).DialEarly}
+//
+// The InitialPacketSize of the tunnelled connection is limited to the maximum size of UDP payloads
+// that fit into an HTTP Datagram on the connection to the proxy.
+// Larger packets, such as Path MTU Discovery probes, are dropped. If the connection to the proxy
+// might migrate to a path with a smaller MTU, disable Path MTU Discovery in the quic.Config.
+type QUICDialer struct {
+	// ClientConn is the connection to the proxy.
+	ClientConn *ClientConn
+	// Template is the URI template of the proxy.
+	Template *uritemplate.Template
+	// Resolver, if set, is used to resolve the host name of the target,
+	// for example a [DNSResolver] that sends the DNS queries through the proxy.
+	// Otherwise, the host name is sent to the proxy, which then resolves it.
+	Resolver HostResolver
+}
+
+// Dial dials a QUIC connection to addr (host:port) through the proxy.
+func (d *QUICDialer) Dial(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+	return d.dial(ctx, addr, tlsConf, conf, quic.Dial)
+}
+
+// DialEarly dials a QUIC connection to addr (host:port) through the proxy,
+// using 0-RTT if possible.
+func (d *QUICDialer) DialEarly(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+	return d.dial(ctx, addr, tlsConf, conf, quic.DialEarly)
+}
+
+// quicDialFunc is either quic.Dial or quic.DialEarly.
+type quicDialFunc func(context.Context, net.PacketConn, net.Addr, *tls.Config, *quic.Config) (*quic.Conn, error)
+
+func (d *QUICDialer) dial(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config, dialQUIC quicDialFunc) (*quic.Conn, error) {
+	target := addr
+	if d.Resolver != nil {
+		addrs, err := resolveTarget(ctx, d.Resolver, addr, false)
+		if err != nil {
+			return nil, err
+		}
+		target = addrs[0].String()
+	}
+	req, err := NewRequest(ctx, d.Template, target)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := d.ClientConn.Dial(req)
+	if err != nil {
+		return nil, err
+	}
+	return dialTunnelledQUIC(ctx, conn, tlsConf, conf, dialQUIC)
+}
+
+// dialTunnelledQUIC dials a QUIC connection over the proxied connection.
+// The proxied connection is closed when the QUIC connection is closed, or if dialing fails.
+func dialTunnelledQUIC(ctx context.Context, conn *Conn, tlsConf *tls.Config, conf *quic.Config, dialQUIC quicDialFunc) (*quic.Conn, error) {
+	maxPacketSize := conn.maxPacketSize()
+	if maxPacketSize < minQUICPacketSize {
+		conn.Close()
+		return nil, fmt.Errorf("masque: tunnel MTU too small for QUIC (%d bytes)", maxPacketSize)
+	}
+	if conf == nil {
+		conf = &quic.Config{}
+	} else {
+		conf = conf.Clone()
+	}
+	if conf.InitialPacketSize == 0 || int(conf.InitialPacketSize) > maxPacketSize {
+		conf.InitialPacketSize = uint16(maxPacketSize)
+	}
+
+	qconn, err := dialQUIC(ctx, tunnelledPacketConn{conn}, conn.RemoteAddr(), tlsConf, conf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	context.AfterFunc(qconn.Context(), func() { conn.Close() })
+	return qconn, nil
+}
+
+// maxPacketSize returns the maximum size of a UDP payload that fits into an HTTP Datagram,
+// at the initial packet size of the connection to the proxy.
+func (c *Conn) maxPacketSize() int {
+	if c.clientConn.initialMaxDatagramSize == 0 {
+		return 0
+	}
+	// the HTTP Datagram starts with the Quarter Stream ID, followed by the Context ID
+	return c.clientConn.initialMaxDatagramSize - quicvarint.Len(uint64(c.str.StreamID()/4)) - len(contextIDZero)
+}
+
+// maxDatagramSize returns the maximum size of a QUIC datagram payload that can currently be sent,
+// or 0 if datagrams are not supported.
+// quic-go doesn't expose the maximum datagram size, but reports it when sending a datagram that is too large.
+// That datagram is not sent.
+func maxDatagramSize(conn *quic.Conn) int {
+	err := conn.SendDatagram(make([]byte, 1<<16))
+	var tooLarge *quic.DatagramTooLargeError
+	if !errors.As(err, &tooLarge) {
+		return 0
+	}
+	return int(tooLarge.MaxDatagramPayloadSize)
+}
+
+// tunnelledPacketConn drops packets that don't fit into an HTTP Datagram.
+// quic-go closes the QUIC connection when writing a packet fails,
+// unless the packet was too large for the path.
+type tunnelledPacketConn struct {
+	*Conn
+}
+
+func (c tunnelledPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.Conn.WriteTo(p, addr)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return len(p), nil
+	}
+	return n, err
+}
+
+// SetReadBuffer and SetWriteBuffer prevent quic-go from logging a warning about the buffer sizes.
+// The tunnel doesn't use socket buffers.
+func (tunnelledPacketConn) SetReadBuffer(int) error  { return nil }
+func (tunnelledPacketConn) SetWriteBuffer(int) error { return nil }
@@ -0,0 +1,116 @@
+//go:build linux
+
+package masque_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+)
+
+// smallMTUConn drops packets larger than maxSize, as a path with a small MTU would.
+// Unlike a wrapped net.PacketConn, it can be used by quic-go for Path MTU Discovery.
+type smallMTUConn struct {
+	*net.UDPConn
+	maxSize int
+}
+
+func (c *smallMTUConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (int, int, error) {
+	if len(b) > c.maxSize {
+		return len(b), len(oob), nil
+	}
+	return c.UDPConn.WriteMsgUDP(b, oob, addr)
+}
+
+// The connection to the proxy discovers a larger path MTU after the ClientConn was created,
+// and then falls back to its initial packet size when it is migrated to a new path.
+// Packets of the tunnelled connection must still fit into HTTP Datagrams.
+// quic-go doesn't reduce the packet size of a connection, so the tunnelled connection
+// is dialed with Path MTU Discovery disabled.
+func TestQUICDialerPathMTUDecrease(t *testing.T) {
+	// With GSO, multiple packets are passed to WriteMsgUDP at once.
+	t.Setenv("QUIC_GO_DISABLE_GSO", "true")
+	const initialPacketSize = 1350
+	const uploadSize = 200 << 10
+	targetConn := newUDPConnLocalhost(t)
+	target := &http3.Server{
+		TLSConfig:  tlsConf,
+		QUICConfig: &quic.Config{DisablePathMTUDiscovery: true},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := io.Copy(io.Discard, r.Body)
+			fmt.Fprintf(w, "%d", n)
+		}),
+	}
+	defer target.Close()
+	go target.Serve(targetConn)
+
+	template := runHandler(t, &masque.Handler{})
+	tr1 := &quic.Transport{Conn: newUDPConnLocalhost(t)}
+	defer tr1.Close()
+	// The new path only supports the initial packet size.
+	tr2 := &quic.Transport{Conn: &smallMTUConn{UDPConn: newUDPConnLocalhost(t), maxSize: initialPacketSize}}
+	defer tr2.Close()
+	qconn, err := tr1.Dial(
+		context.Background(),
+		proxyAddr(t, template),
+		&tls.Config{ServerName: "localhost", RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true, InitialPacketSize: initialPacketSize},
+	)
+	require.NoError(t, err)
+	defer qconn.CloseWithError(0, "")
+	cconn, err := (&masque.Transport{}).NewClientConn(qconn)
+	require.NoError(t, err)
+
+	maxDatagramSize := func() int64 {
+		var tooLarge *quic.DatagramTooLargeError
+		require.ErrorAs(t, qconn.SendDatagram(make([]byte, 1<<16)), &tooLarge)
+		return tooLarge.MaxDatagramPayloadSize
+	}
+	initialSize := maxDatagramSize()
+	// MTU probes are only sent while there's traffic on the connection.
+	// Send datagrams for a stream that is never opened, the proxy drops them.
+	require.Eventually(t, func() bool {
+		require.NoError(t, qconn.SendDatagram([]byte{0x3f}))
+		return maxDatagramSize() > initialSize+50
+	}, scaleDuration(5*time.Second), scaleDuration(10*time.Millisecond))
+
+	dialer := &masque.QUICDialer{ClientConn: cconn, Template: template}
+	h3 := &http3.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "localhost", RootCAs: certPool},
+		QUICConfig:      &quic.Config{DisablePathMTUDiscovery: true},
+		Dial:            dialer.DialEarly,
+	}
+	defer h3.Close()
+	client := &http.Client{Transport: h3, Timeout: scaleDuration(5 * time.Second)}
+	upload := func() {
+		t.Helper()
+		rsp, err := client.Post("https://"+targetConn.LocalAddr().String(), "application/octet-stream", bytes.NewReader(make([]byte, uploadSize)))
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		body, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(uploadSize), string(body))
+	}
+	upload()
+
+	// After migrating, the connection to the proxy uses its initial packet size again.
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(time.Second))
+	defer cancel()
+	_, err = cconn.Migrate(ctx, tr2)
+	require.NoError(t, err)
+	upload()
+}
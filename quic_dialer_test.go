@@ -0,0 +1,89 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQUICDialer(t *testing.T) {
+	targetConn := newUDPConnLocalhost(t)
+	target := &http3.Server{
+		TLSConfig: tlsConf,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte("hello through the tunnel"))
+		}),
+	}
+	defer target.Close()
+	go target.Serve(targetConn)
+
+	records := make(chan *masque.FlowRecord, 1)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+	})
+	dialProxy := func(initialPacketSize uint16) *masque.ClientConn {
+		qconn, err := quic.DialAddr(
+			context.Background(),
+			proxyAddr(t, template).String(),
+			&tls.Config{ServerName: "localhost", RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+			&quic.Config{EnableDatagrams: true, InitialPacketSize: initialPacketSize, DisablePathMTUDiscovery: true},
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { qconn.CloseWithError(0, "") })
+		cconn, err := (&masque.Transport{}).NewClientConn(qconn)
+		require.NoError(t, err)
+		return cconn
+	}
+
+	t.Run("HTTP/3 through the tunnel", func(t *testing.T) {
+		dialer := &masque.QUICDialer{ClientConn: dialProxy(1350), Template: template}
+		tr := &http3.Transport{
+			TLSClientConfig: &tls.Config{ServerName: "localhost", RootCAs: certPool},
+			Dial:            dialer.DialEarly,
+		}
+		defer tr.Close()
+		rsp, err := (&http.Client{Transport: tr}).Get("https://" + targetConn.LocalAddr().String())
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		body, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "hello through the tunnel", string(body))
+
+		// closing the QUIC connection closes the proxied connection
+		require.NoError(t, tr.Close())
+		select {
+		case rec := <-records:
+			require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+			require.NotZero(t, rec.DatagramsToTarget)
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	})
+
+	t.Run("tunnel MTU too small", func(t *testing.T) {
+		dialer := &masque.QUICDialer{ClientConn: dialProxy(1200), Template: template}
+		_, err := dialer.Dial(
+			context.Background(),
+			targetConn.LocalAddr().String(),
+			&tls.Config{RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+			nil,
+		)
+		require.ErrorContains(t, err, "masque: tunnel MTU too small for QUIC")
+		select {
+		case rec := <-records:
+			require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	})
+}
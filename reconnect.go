@@ -0,0 +1,439 @@
+package masque
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+const (
+	defaultMinReconnectBackoff = 100 * time.Millisecond
+	defaultMaxReconnectBackoff = 10 * time.Second
+)
+
+// ReconnectEventType is the type of a [ReconnectEvent].
+type ReconnectEventType int
+
+const (
+	// ReconnectEventDisconnected is reported when the proxied connection failed.
+	ReconnectEventDisconnected ReconnectEventType = iota
+	// ReconnectEventAttemptFailed is reported when a reconnection attempt failed.
+	ReconnectEventAttemptFailed
+	// ReconnectEventReconnected is reported when the proxied connection was re-established.
+	ReconnectEventReconnected
+	// ReconnectEventGaveUp is reported when the maximum number of reconnection attempts was reached.
+	// The ReconnectingConn is unusable afterwards.
+	ReconnectEventGaveUp
+)
+
+func (t ReconnectEventType) String() string {
+	switch t {
+	case ReconnectEventDisconnected:
+		return "disconnected"
+	case ReconnectEventAttemptFailed:
+		return "attempt failed"
+	case ReconnectEventReconnected:
+		return "reconnected"
+	case ReconnectEventGaveUp:
+		return "gave up"
+	default:
+		return fmt.Sprintf("unknown reconnect event (%d)", int(t))
+	}
+}
+
+// A ReconnectEvent reports a change in the state of a [ReconnectingConn].
+type ReconnectEvent struct {
+	Type ReconnectEventType
+	// Template is the URI template of the proxy that the event refers to.
+	Template *uritemplate.Template
+	// Attempt is the number of the reconnection attempt, starting at 1.
+	// It is 0 for ReconnectEventDisconnected.
+	Attempt int
+	// Err is the error that caused the event, if any.
+	Err error
+}
+
+// A ReconnectingDialer dials proxied connections that survive the loss of the connection to the proxy.
+type ReconnectingDialer struct {
+	// Transport is used to dial the QUIC connections to the proxies.
+	// If nil, a zero Transport is used.
+	Transport *Transport
+	// Templates are the URI templates of the proxies.
+	// When a connection fails, the next proxy in the list is tried first.
+	Templates []*uritemplate.Template
+
+	// MinBackoff is the delay before the first reconnection attempt to a proxy that was already tried.
+	// The delay is doubled after every failed round through all proxies, up to MaxBackoff.
+	// If zero, 100ms is used.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum delay between reconnection attempts.
+	// If zero, 10s is used.
+	MaxBackoff time.Duration
+	// MaxAttempts is the maximum number of consecutive reconnection attempts.
+	// If zero, there is no limit.
+	MaxAttempts int
+
+	// MaxBufferedWrites is the number of datagrams buffered while reconnecting.
+	// Buffered datagrams are sent once the connection is re-established.
+	// If zero, datagrams written while reconnecting are dropped.
+	MaxBufferedWrites int
+
+	// OnEvent, if set, is called for every reconnection event.
+	// It must not block.
+	OnEvent func(ReconnectEvent)
+}
+
+// Dial dials a proxied connection to target, trying all proxies in order.
+func (d *ReconnectingDialer) Dial(ctx context.Context, target string) (*ReconnectingConn, error) {
+	if len(d.Templates) == 0 {
+		return nil, errors.New("masque: no proxy templates")
+	}
+	c := &ReconnectingConn{
+		dialer:          d,
+		target:          target,
+		ready:           make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	var errs []error
+	for i := range d.Templates {
+		conn, err := d.dial(ctx, d.Templates[i], target)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.templateIdx = i
+		c.setConn(conn)
+		return c, nil
+	}
+	c.cancel()
+	return nil, errors.Join(errs...)
+}
+
+func (d *ReconnectingDialer) dial(ctx context.Context, template *uritemplate.Template, target string) (*Conn, error) {
+	req, err := NewRequest(ctx, template, target)
+	if err != nil {
+		return nil, err
+	}
+	tr := d.Transport
+	if tr == nil {
+		tr = &Transport{}
+	}
+	conn, _, err := tr.Dial(req)
+	return conn, err
+}
+
+func (d *ReconnectingDialer) backoff(round int) time.Duration {
+	minBackoff := d.MinBackoff
+	if minBackoff == 0 {
+		minBackoff = defaultMinReconnectBackoff
+	}
+	maxBackoff := d.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxReconnectBackoff
+	}
+	backoff := minBackoff
+	for range round {
+		backoff *= 2
+		if backoff >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return min(backoff, maxBackoff)
+}
+
+func (d *ReconnectingDialer) event(e ReconnectEvent) {
+	if d.OnEvent != nil {
+		d.OnEvent(e)
+	}
+}
+
+// A ReconnectingConn is a proxied connection that is re-established
+// (possibly via a different proxy) when the proxied connection or the connection to the proxy fails.
+// Reads block while reconnecting. Writes are buffered or dropped, see [ReconnectingDialer.MaxBufferedWrites].
+type ReconnectingConn struct {
+	dialer *ReconnectingDialer
+	target string
+
+	ctx    context.Context // cancelled when Close is called
+	cancel context.CancelFunc
+
+	mx              sync.Mutex
+	conn            *Conn         // nil while reconnecting
+	ready           chan struct{} // closed when conn is set
+	templateIdx     int
+	localAddr       net.Addr
+	remoteAddr      net.Addr
+	readDeadline    time.Time
+	deadlineChanged chan struct{} // closed when the read deadline is changed
+	buffered        [][]byte
+	err             error // set when the connection can't be used anymore
+}
+
+var _ net.PacketConn = &ReconnectingConn{}
+
+// setConn must be called with mx held (or before the ReconnectingConn is shared).
+func (c *ReconnectingConn) setConn(conn *Conn) {
+	c.conn = conn
+	c.localAddr = conn.LocalAddr()
+	c.remoteAddr = conn.RemoteAddr()
+	if !c.readDeadline.IsZero() {
+		conn.SetReadDeadline(c.readDeadline)
+	}
+	close(c.ready)
+	go c.monitor(conn)
+}
+
+// monitor detects when the proxy closes the stream, or the QUIC connection fails,
+// even if the application isn't currently reading.
+func (c *ReconnectingConn) monitor(conn *Conn) {
+	select {
+	case <-conn.readDone:
+		c.fail(conn, errors.New("masque: proxied connection closed"))
+	case <-c.ctx.Done():
+	}
+}
+
+// fail starts reconnecting, unless conn was already replaced.
+func (c *ReconnectingConn) fail(conn *Conn, err error) {
+	c.mx.Lock()
+	if c.conn != conn || c.ctx.Err() != nil {
+		c.mx.Unlock()
+		return
+	}
+	c.conn = nil
+	c.ready = make(chan struct{})
+	template := c.dialer.Templates[c.templateIdx]
+	c.mx.Unlock()
+
+	go conn.Close()
+	c.dialer.event(ReconnectEvent{Type: ReconnectEventDisconnected, Template: template, Err: err})
+	go c.reconnect()
+}
+
+func (c *ReconnectingConn) reconnect() {
+	templates := c.dialer.Templates
+	c.mx.Lock()
+	idx := c.templateIdx
+	c.mx.Unlock()
+
+	var lastErr error
+	for attempt := 1; c.dialer.MaxAttempts == 0 || attempt <= c.dialer.MaxAttempts; attempt++ {
+		// Every proxy is tried once without delay, starting with the one after the proxy that failed.
+		// After that, back off exponentially.
+		if round := (attempt - 1) / len(templates); round > 0 {
+			timer := time.NewTimer(c.dialer.backoff(round - 1))
+			select {
+			case <-timer.C:
+			case <-c.ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		idx = (idx + 1) % len(templates)
+		conn, err := c.dialer.dial(c.ctx, templates[idx], c.target)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			lastErr = err
+			c.dialer.event(ReconnectEvent{Type: ReconnectEventAttemptFailed, Template: templates[idx], Attempt: attempt, Err: err})
+			continue
+		}
+
+		c.mx.Lock()
+		if c.ctx.Err() != nil {
+			c.mx.Unlock()
+			conn.Close()
+			return
+		}
+		c.templateIdx = idx
+		buffered := c.buffered
+		c.buffered = nil
+		c.setConn(conn)
+		c.mx.Unlock()
+
+		for _, b := range buffered {
+			if _, err := conn.WriteTo(b, nil); err != nil {
+				break
+			}
+		}
+		c.dialer.event(ReconnectEvent{Type: ReconnectEventReconnected, Template: templates[idx], Attempt: attempt})
+		return
+	}
+
+	c.mx.Lock()
+	c.err = fmt.Errorf("masque: reconnecting failed: %w", lastErr)
+	c.buffered = nil
+	close(c.ready)
+	c.mx.Unlock()
+	c.dialer.event(ReconnectEvent{Type: ReconnectEventGaveUp, Template: templates[idx], Attempt: c.dialer.MaxAttempts, Err: lastErr})
+}
+
+// ReadFrom reads a UDP datagram from the target.
+// While reconnecting, it blocks until the connection is re-established or the read deadline expires.
+func (c *ReconnectingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		conn, err := c.waitForConn()
+		if err != nil {
+			return 0, nil, err
+		}
+		n, addr, err := conn.ReadFrom(b)
+		if err == nil {
+			return n, addr, nil
+		}
+		var icmpErr *ICMPError
+		if errors.As(err, &icmpErr) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, addr, err
+		}
+		c.fail(conn, err)
+	}
+}
+
+func (c *ReconnectingConn) waitForConn() (*Conn, error) {
+	for {
+		c.mx.Lock()
+		conn, ready, deadline, deadlineChanged, err := c.conn, c.ready, c.readDeadline, c.deadlineChanged, c.err
+		c.mx.Unlock()
+		if c.ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+		if err != nil {
+			return nil, err
+		}
+		if conn != nil {
+			return conn, nil
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case <-ready:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-deadlineChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-timeout:
+		case <-c.ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// WriteTo sends a UDP datagram to the target.
+// The net.Addr parameter is ignored.
+// While reconnecting, the datagram is buffered or dropped.
+func (c *ReconnectingConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	c.mx.Lock()
+	conn, err := c.conn, c.err
+	if c.ctx.Err() != nil {
+		err = net.ErrClosed
+	}
+	if err != nil {
+		c.mx.Unlock()
+		return 0, err
+	}
+	if conn == nil {
+		c.bufferLocked(p)
+		c.mx.Unlock()
+		return len(p), nil
+	}
+	c.mx.Unlock()
+
+	if _, err := conn.WriteTo(p, nil); err != nil {
+		var tooLarge *quic.DatagramTooLargeError
+		if errors.As(err, &tooLarge) {
+			return 0, err
+		}
+		c.fail(conn, err)
+		c.mx.Lock()
+		if c.conn == nil && c.err == nil {
+			c.bufferLocked(p)
+		}
+		c.mx.Unlock()
+	}
+	return len(p), nil
+}
+
+func (c *ReconnectingConn) bufferLocked(p []byte) {
+	if len(c.buffered) >= c.dialer.MaxBufferedWrites {
+		return
+	}
+	c.buffered = append(c.buffered, append([]byte(nil), p...))
+}
+
+// Close closes the proxied connection and stops reconnecting.
+func (c *ReconnectingConn) Close() error {
+	c.mx.Lock()
+	if c.ctx.Err() != nil {
+		c.mx.Unlock()
+		return nil
+	}
+	c.cancel()
+	conn := c.conn
+	c.conn = nil
+	c.buffered = nil
+	c.mx.Unlock()
+
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the current (or last) proxied connection.
+func (c *ReconnectingConn) LocalAddr() net.Addr {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.localAddr
+}
+
+// RemoteAddr returns the remote address of the current (or last) proxied connection.
+// It might change when reconnecting, if the proxy connects to a different address of the target.
+func (c *ReconnectingConn) RemoteAddr() net.Addr {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.remoteAddr
+}
+
+func (c *ReconnectingConn) SetDeadline(t time.Time) error {
+	_ = c.SetWriteDeadline(t)
+	return c.SetReadDeadline(t)
+}
+
+func (c *ReconnectingConn) SetReadDeadline(t time.Time) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *ReconnectingConn) SetWriteDeadline(time.Time) error {
+	// Writes never block, see Conn.SetWriteDeadline.
+	return nil
+}
@@ -0,0 +1,202 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// runProxy runs a proxy and returns it, together with its template.
+// The QUIC connection of every proxied request is sent on the returned channel.
+// If block is not nil, the proxy waits for it to be closed before proxying.
+func runProxy(t *testing.T, block <-chan struct{}) (*masque.Proxy, *uritemplate.Template, <-chan *quic.Conn) {
+	t.Helper()
+	conn := newUDPConnLocalhost(t)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", conn.LocalAddr().(*net.UDPAddr).Port))
+	proxy := &masque.Proxy{}
+	t.Cleanup(func() { proxy.Close() })
+	connChan := make(chan *quic.Conn, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/masque", func(w http.ResponseWriter, r *http.Request) {
+		req, err := masque.ParseProxyRequest(r, template)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		connChan <- req.QUICConn()
+		if block != nil {
+			<-block
+		}
+		proxy.Proxy(w, req)
+	})
+	server := &http3.Server{
+		TLSConfig:       tlsConf,
+		EnableDatagrams: true,
+		Handler:         mux,
+		ConnContext:     masque.QUICConnContext,
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve(conn)
+	return proxy, template, connChan
+}
+
+func TestReconnectingConn(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	unblock := make(chan struct{})
+	var unblockOnce sync.Once
+	// make sure the second proxy doesn't block forever if the test fails early
+	defer unblockOnce.Do(func() { close(unblock) })
+	_, template1, connChan1 := runProxy(t, nil)
+	_, template2, connChan2 := runProxy(t, unblock)
+
+	events := make(chan masque.ReconnectEvent, 10)
+	dialer := &masque.ReconnectingDialer{
+		Transport: &masque.Transport{
+			TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		},
+		Templates:         []*uritemplate.Template{template1, template2},
+		MaxBufferedWrites: 1,
+		OnEvent:           func(e masque.ReconnectEvent) { events <- e },
+	}
+	conn, err := dialer.Dial(context.Background(), remoteServerConn.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo := func(msg string) {
+		t.Helper()
+		_, err := conn.WriteTo([]byte(msg), nil)
+		require.NoError(t, err)
+		b := make([]byte, 1500)
+		conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second)))
+		n, _, err := conn.ReadFrom(b)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b[:n]))
+	}
+	echo("foo")
+
+	// kill the connection to the first proxy
+	select {
+	case c := <-connChan1:
+		c.CloseWithError(0, "shutting down")
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case e := <-events:
+		require.Equal(t, masque.ReconnectEventDisconnected, e.Type)
+		require.Equal(t, template1, e.Template)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	// The second proxy accepted the connection, but didn't complete the CONNECT-UDP request yet.
+	select {
+	case <-connChan2:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	// Only the first datagram is buffered, the second one is dropped.
+	_, err = conn.WriteTo([]byte("buffered"), nil)
+	require.NoError(t, err)
+	_, err = conn.WriteTo([]byte("dropped"), nil)
+	require.NoError(t, err)
+	// reads block while reconnecting
+	conn.SetReadDeadline(time.Now().Add(scaleDuration(50 * time.Millisecond)))
+	_, _, err = conn.ReadFrom(make([]byte, 1500))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	// setting a deadline unblocks a read that is waiting for the reconnect
+	conn.SetReadDeadline(time.Time{})
+	errChan := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFrom(make([]byte, 1500))
+		errChan <- err
+	}()
+	select {
+	case err := <-errChan:
+		t.Fatalf("ReadFrom returned unexpectedly: %v", err)
+	case <-time.After(scaleDuration(20 * time.Millisecond)):
+	}
+	conn.SetReadDeadline(time.Now().Add(scaleDuration(10 * time.Millisecond)))
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	unblockOnce.Do(func() { close(unblock) })
+	select {
+	case e := <-events:
+		require.Equal(t, masque.ReconnectEventReconnected, e.Type)
+		require.Equal(t, template2, e.Template)
+		require.Equal(t, 1, e.Attempt)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	b := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second)))
+	n, _, err := conn.ReadFrom(b)
+	require.NoError(t, err)
+	require.Equal(t, "buffered", string(b[:n]))
+	echo("bar")
+}
+
+func TestReconnectingConnGivesUp(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	proxy, template, _ := runProxy(t, nil)
+
+	events := make(chan masque.ReconnectEvent, 10)
+	dialer := &masque.ReconnectingDialer{
+		Transport: &masque.Transport{
+			TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		},
+		Templates:   []*uritemplate.Template{template},
+		MinBackoff:  scaleDuration(10 * time.Millisecond),
+		MaxAttempts: 2,
+		OnEvent:     func(e masque.ReconnectEvent) { events <- e },
+	}
+	conn, err := dialer.Dial(context.Background(), remoteServerConn.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Closing the proxy closes the proxied connection, and all subsequent requests are rejected.
+	require.NoError(t, proxy.Close())
+
+	var types []masque.ReconnectEventType
+	for len(types) < 4 {
+		select {
+		case e := <-events:
+			types = append(types, e.Type)
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	require.Equal(t, []masque.ReconnectEventType{
+		masque.ReconnectEventDisconnected,
+		masque.ReconnectEventAttemptFailed,
+		masque.ReconnectEventAttemptFailed,
+		masque.ReconnectEventGaveUp,
+	}, types)
+
+	_, _, err = conn.ReadFrom(make([]byte, 1500))
+	require.Error(t, err)
+	_, err = conn.WriteTo([]byte("foo"), nil)
+	require.Error(t, err)
+}
@@ -17,6 +17,16 @@ const (
 	uriTemplateTargetPort = "target_port"
 )
 
+// The protocols supported by this package, sent in the :protocol pseudo-header field of the Extended CONNECT request.
+const (
+	// ProtocolConnectUDP is used for proxying UDP (RFC 9298).
+	ProtocolConnectUDP = requestProtocol
+	// ProtocolConnectTCP is used for template-driven TCP proxying (draft-ietf-httpbis-connect-tcp).
+	ProtocolConnectTCP = "connect-tcp"
+	// ProtocolConnectEthernet is used for proxying Ethernet frames (RFC 9729).
+	ProtocolConnectEthernet = "connect-ethernet"
+)
+
 var capsuleProtocolHeaderValue string
 
 func init() {
@@ -27,24 +37,98 @@ func init() {
 	capsuleProtocolHeaderValue = v
 }
 
-// Request is a CONNECT-UDP request created by NewRequest.
+// Request is a CONNECT-UDP request created by NewRequest,
+// a CONNECT-TCP request created by NewTCPRequest,
+// or a CONNECT-ETHERNET request created by NewEthernetRequest.
 // The zero value is not valid.
 type Request struct {
 	req    *http.Request
-	target string
+	target string // empty for CONNECT-ETHERNET requests
+	vars   map[string]string
+
+	capsuleHandlers capsuleHandlers
 }
 
 // NewRequest creates a CONNECT-UDP request for the given target.
 // The target must be given as a host:port.
 func NewRequest(ctx context.Context, proxyTemplate *uritemplate.Template, target string) (*Request, error) {
+	return NewRequestWithVars(ctx, proxyTemplate, target, nil)
+}
+
+// NewRequestWithVars creates a CONNECT-UDP request for the given target.
+// The target must be given as a host:port.
+// vars contains the values of template variables other than target_host and target_port,
+// for example a tenant identifier.
+func NewRequestWithVars(ctx context.Context, proxyTemplate *uritemplate.Template, target string, vars map[string]string) (*Request, error) {
+	req, err := newRequest(ctx, proxyTemplate, target, vars)
+	if err != nil {
+		return nil, err
+	}
+	req.req.Header.Set(http3.CapsuleProtocolHeader, capsuleProtocolHeaderValue)
+	return req, nil
+}
+
+// NewTCPRequest creates a CONNECT-TCP request for the given target.
+// The target must be given as a host:port.
+// The URI template uses the same target_host and target_port variables as for CONNECT-UDP.
+func NewTCPRequest(ctx context.Context, proxyTemplate *uritemplate.Template, target string) (*Request, error) {
+	return NewTCPRequestWithVars(ctx, proxyTemplate, target, nil)
+}
+
+// NewTCPRequestWithVars creates a CONNECT-TCP request for the given target.
+// See [NewRequestWithVars] for the handling of template variables.
+func NewTCPRequestWithVars(ctx context.Context, proxyTemplate *uritemplate.Template, target string, vars map[string]string) (*Request, error) {
+	req, err := newRequest(ctx, proxyTemplate, target, vars)
+	if err != nil {
+		return nil, err
+	}
+	req.req.Proto = ProtocolConnectTCP
+	return req, nil
+}
+
+// NewEthernetRequest creates a CONNECT-ETHERNET request (RFC 9729).
+// RFC 9729 doesn't define any template variables, but the template may contain other variables,
+// for example to select a network segment. Their values are passed in vars.
+func NewEthernetRequest(ctx context.Context, proxyTemplate *uritemplate.Template, vars map[string]string) (*Request, error) {
+	values := uritemplate.Values{}
+	for name, val := range vars {
+		values.Set(name, uritemplate.String(val))
+	}
+	req, err := expandRequest(ctx, proxyTemplate, values)
+	if err != nil {
+		return nil, err
+	}
+	req.Proto = ProtocolConnectEthernet
+	req.Header.Set(http3.CapsuleProtocolHeader, capsuleProtocolHeaderValue)
+	return &Request{req: req, vars: vars}, nil
+}
+
+func newRequest(ctx context.Context, proxyTemplate *uritemplate.Template, target string, vars map[string]string) (*Request, error) {
 	host, port, err := net.SplitHostPort(target)
 	if err != nil {
 		return nil, fmt.Errorf("masque: failed to parse target: %w", err)
 	}
-	str, err := proxyTemplate.Expand(uritemplate.Values{
+	values := uritemplate.Values{
 		uriTemplateTargetHost: uritemplate.String(host),
 		uriTemplateTargetPort: uritemplate.String(port),
-	})
+	}
+	for name, val := range vars {
+		if name == uriTemplateTargetHost || name == uriTemplateTargetPort {
+			return nil, fmt.Errorf("masque: invalid template variable: %s", name)
+		}
+		values.Set(name, uritemplate.String(val))
+	}
+	req, err := expandRequest(ctx, proxyTemplate, values)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{req: req, target: target, vars: vars}, nil
+}
+
+// expandRequest expands the template, and creates an Extended CONNECT request for the resulting URL.
+// The :protocol is set to connect-udp.
+func expandRequest(ctx context.Context, proxyTemplate *uritemplate.Template, values uritemplate.Values) (*http.Request, error) {
+	str, err := proxyTemplate.Expand(values)
 	if err != nil {
 		return nil, fmt.Errorf("masque: failed to expand Template: %w", err)
 	}
@@ -54,10 +138,38 @@ func NewRequest(ctx context.Context, proxyTemplate *uritemplate.Template, target
 	}
 	req.Proto = requestProtocol
 	req.Host = req.URL.Host
-	req.Header.Set(http3.CapsuleProtocolHeader, capsuleProtocolHeaderValue)
-	return &Request{req: req, target: target}, nil
+	return req, nil
+}
+
+// withTemplate creates a copy of the request for a different proxy.
+// Header fields added by the caller are preserved.
+func (r *Request) withTemplate(proxyTemplate *uritemplate.Template) (*Request, error) {
+	req, err := newRequest(r.req.Context(), proxyTemplate, r.target, r.vars)
+	if err != nil {
+		return nil, err
+	}
+	req.req.Proto = r.req.Proto
+	req.req.Header = r.req.Header.Clone()
+	req.capsuleHandlers = r.capsuleHandlers.clone()
+	return req, nil
 }
 
-// Header returns the HTTP header fields sent with the CONNECT-UDP request.
+// Header returns the HTTP header fields sent with the request.
 // Callers may add custom headers before dialing.
 func (r *Request) Header() http.Header { return r.req.Header }
+
+// HandleCapsule registers the handler for capsules of the given type,
+// received on the request stream of the connection dialed using this request.
+// It must be called before dialing.
+// The capsule used by the proxy to relay ICMP errors is handled by the Conn, and can't be registered.
+// CONNECT-TCP doesn't use capsules.
+func (r *Request) HandleCapsule(ct http3.CapsuleType, handler CapsuleHandler) {
+	r.capsuleHandlers.handle(ct, handler)
+}
+
+// HandleUnknownCapsules registers the handler for capsules of all types that no handler was registered for.
+// By default, these capsules are skipped. See [ErrUnknownCapsule].
+// It must be called before dialing.
+func (r *Request) HandleUnknownCapsules(handler CapsuleHandler) {
+	r.capsuleHandlers.unknown = handler
+}
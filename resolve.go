@@ -0,0 +1,76 @@
+package masque
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+// A HostResolver resolves host names to IP addresses.
+// It is implemented by [net.Resolver].
+type HostResolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+var _ HostResolver = &net.Resolver{}
+
+// resolveTarget resolves a target given as host:port to all its addresses.
+// The addresses are sorted in the order in which connections should be attempted.
+func resolveTarget(ctx context.Context, resolver HostResolver, target string, preferIPv4 bool) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.AddrPort{netip.AddrPortFrom(ip.Unmap(), uint16(port))}, nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}
+	}
+	addrs := make([]netip.AddrPort, 0, len(ips))
+	for _, ip := range sortAddrs(ips, preferIPv4) {
+		addrs = append(addrs, netip.AddrPortFrom(ip, uint16(port)))
+	}
+	return addrs, nil
+}
+
+// sortAddrs orders the addresses as described in RFC 8305, Section 4:
+// Addresses from the preferred address family and the other address family are interleaved,
+// starting with the preferred address family.
+// The order of addresses within each address family (as returned by the resolver) is preserved.
+func sortAddrs(ips []netip.Addr, preferIPv4 bool) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	preferred, other := v6, v4
+	if preferIPv4 {
+		preferred, other = v4, v6
+	}
+	sorted := make([]netip.Addr, 0, len(ips))
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			sorted = append(sorted, preferred[i])
+		}
+		if i < len(other) {
+			sorted = append(sorted, other[i])
+		}
+	}
+	return sorted
+}
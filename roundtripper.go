@@ -0,0 +1,359 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+const (
+	// defaultIdleConnTimeout is the default value for RoundTripper.IdleConnTimeout.
+	defaultIdleConnTimeout = 30 * time.Second
+	// originDialTimeout is the timeout for dialing the connection to an origin,
+	// including the request to the proxy and the QUIC handshake.
+	originDialTimeout = 30 * time.Second
+)
+
+// A RoundTripper is an http.RoundTripper that sends requests through a MASQUE proxy.
+// For every origin, it dials a proxied connection using CONNECT-UDP,
+// and sends the requests using HTTP/3, over a QUIC connection tunnelled through the proxy (see [QUICDialer]).
+// The connection is reused for all requests to the origin, until it was idle for IdleConnTimeout.
+// The connection is dialed independently of the request that triggered it:
+// Cancelling a request only stops that request from waiting for the connection.
+// Every origin uses its own QUIC connection to the proxy, which is dialed using the Transport.
+// If the Transport uses a ProxySelector, the proxy is selected per origin.
+//
+// Only https URLs can be requested using HTTP/3.
+// If FallbackToTCP is set, http URLs, and origins that can't be reached using HTTP/3,
+// are requested using HTTP/2 or HTTP/1.1 over CONNECT-TCP.
+type RoundTripper struct {
+	// Transport dials the proxied connections.
+	// If nil, a zero Transport is used.
+	Transport *Transport
+	// Template is the URI template of the proxy.
+	Template *uritemplate.Template
+
+	// TLSClientConfig is the TLS config used for the connections to the origins.
+	TLSClientConfig *tls.Config
+	// QUICConfig is the QUIC config used for the tunnelled QUIC connections.
+	QUICConfig *quic.Config
+	// IdleConnTimeout is the duration after which connections to origins are closed
+	// if no request was in flight.
+	// If zero, 30s is used.
+	IdleConnTimeout time.Duration
+
+	// FallbackToTCP enables falling back to CONNECT-TCP if the HTTP/3 connection to an origin can't be established,
+	// for example because the origin doesn't support HTTP/3.
+	// Dialing the QUIC connection fails after the HandshakeIdleTimeout of the QUICConfig.
+	// The origin is then requested using CONNECT-TCP, until IdleConnTimeout has passed.
+	FallbackToTCP bool
+
+	mx      sync.Mutex
+	closed  bool
+	origins map[string]*originConn // by host:port
+	tcp     *http.Transport
+}
+
+var _ http.RoundTripper = &RoundTripper{}
+
+type originConn struct {
+	ready chan struct{} // closed once dialing finished
+
+	// set before ready is closed
+	conn   *quic.Conn
+	cc     *http3.ClientConn
+	useTCP bool // the origin is requested using CONNECT-TCP
+	err    error
+
+	// protected by RoundTripper.mx
+	requests  int       // requests using (or waiting for) the connection
+	lastUsed  time.Time // when the last request finished
+	idleTimer *time.Timer
+}
+
+// originBody is the body of a response received from an origin.
+// The request is finished once the body was read completely or closed.
+type originBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *originBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *originBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+// RoundTrip sends the request through the proxy.
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.URL.Scheme {
+	case "https":
+	case "http":
+		if rt.FallbackToTCP {
+			return rt.tcpTransport().RoundTrip(req)
+		}
+		fallthrough
+	default:
+		closeRequestBody(req)
+		return nil, fmt.Errorf("masque: unsupported scheme: %q", req.URL.Scheme)
+	}
+
+	origin := req.URL.Host
+	if req.URL.Port() == "" {
+		origin = net.JoinHostPort(req.URL.Hostname(), "443")
+	}
+	oc, err := rt.getOrigin(req.Context(), origin)
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+	if oc.useTCP {
+		rt.finishRequest(oc)
+		return rt.tcpTransport().RoundTrip(req)
+	}
+	rsp, err := oc.cc.RoundTrip(req)
+	if err != nil {
+		rt.finishRequest(oc)
+		return nil, err
+	}
+	rsp.Body = &originBody{ReadCloser: rsp.Body, done: func() { rt.finishRequest(oc) }}
+	return rsp, nil
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// getOrigin returns the connection to the origin, dialing it if necessary.
+// Concurrent requests to the same origin wait for the same dial,
+// until the connection was dialed or their context is cancelled.
+// The request is counted as in flight until finishRequest is called,
+// which is only necessary if no error is returned.
+func (rt *RoundTripper) getOrigin(ctx context.Context, origin string) (*originConn, error) {
+	rt.mx.Lock()
+	if rt.closed {
+		rt.mx.Unlock()
+		return nil, net.ErrClosed
+	}
+	oc, ok := rt.origins[origin]
+	if !ok {
+		oc = &originConn{ready: make(chan struct{})}
+		if rt.origins == nil {
+			rt.origins = make(map[string]*originConn)
+		}
+		rt.origins[origin] = oc
+		// The dial is not cancelled when the request is cancelled,
+		// since other requests might be waiting for it.
+		go rt.dialOrigin(context.WithoutCancel(ctx), origin, oc)
+	}
+	oc.requests++
+	rt.mx.Unlock()
+
+	select {
+	case <-oc.ready:
+		if oc.err != nil {
+			rt.finishRequest(oc)
+			return nil, oc.err
+		}
+		return oc, nil
+	case <-ctx.Done():
+		rt.finishRequest(oc)
+		return nil, context.Cause(ctx)
+	}
+}
+
+// finishRequest is called when a request using the connection to the origin finished.
+func (rt *RoundTripper) finishRequest(oc *originConn) {
+	rt.mx.Lock()
+	defer rt.mx.Unlock()
+	oc.requests--
+	oc.lastUsed = time.Now()
+}
+
+func (rt *RoundTripper) dialOrigin(ctx context.Context, origin string, oc *originConn) {
+	ctx, cancel := context.WithTimeout(ctx, originDialTimeout)
+	defer cancel()
+	conn, err := rt.dialHTTP3(ctx, origin)
+	if err != nil {
+		if !rt.FallbackToTCP || ctx.Err() != nil {
+			oc.err = err
+			rt.removeOrigin(origin, oc)
+		} else {
+			oc.useTCP = true
+			time.AfterFunc(rt.idleConnTimeout(), func() { rt.removeOrigin(origin, oc) })
+		}
+		close(oc.ready)
+		return
+	}
+
+	// Close only closes connections that finished dialing.
+	rt.mx.Lock()
+	defer rt.mx.Unlock()
+	defer close(oc.ready)
+	if rt.closed {
+		conn.CloseWithError(0, "")
+		oc.err = net.ErrClosed
+		return
+	}
+	oc.conn = conn
+	oc.cc = (&http3.Transport{}).NewClientConn(conn)
+	oc.lastUsed = time.Now()
+	oc.idleTimer = time.AfterFunc(rt.idleConnTimeout(), func() { rt.checkIdle(origin, oc) })
+	context.AfterFunc(conn.Context(), func() {
+		oc.idleTimer.Stop()
+		rt.removeOrigin(origin, oc)
+	})
+}
+
+// checkIdle closes the connection to the origin if no request was in flight for the idle timeout.
+func (rt *RoundTripper) checkIdle(origin string, oc *originConn) {
+	timeout := rt.idleConnTimeout()
+	rt.mx.Lock()
+	// already closed
+	if rt.origins[origin] != oc {
+		rt.mx.Unlock()
+		return
+	}
+	if oc.requests > 0 {
+		oc.idleTimer.Reset(timeout)
+		rt.mx.Unlock()
+		return
+	}
+	if idle := time.Since(oc.lastUsed); idle < timeout {
+		oc.idleTimer.Reset(timeout - idle)
+		rt.mx.Unlock()
+		return
+	}
+	// new requests dial a new connection
+	delete(rt.origins, origin)
+	rt.mx.Unlock()
+	oc.conn.CloseWithError(0, "")
+}
+
+func (rt *RoundTripper) dialHTTP3(ctx context.Context, origin string) (*quic.Conn, error) {
+	req, err := NewRequest(ctx, rt.Template, origin)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := rt.transport().Dial(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConf *tls.Config
+	if rt.TLSClientConfig == nil {
+		tlsConf = &tls.Config{}
+	} else {
+		tlsConf = rt.TLSClientConfig.Clone()
+	}
+	if tlsConf.ServerName == "" {
+		host, _, err := net.SplitHostPort(origin)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConf.ServerName = host
+	}
+	tlsConf.NextProtos = []string{http3.NextProtoH3}
+	var quicConf *quic.Config
+	if rt.QUICConfig == nil {
+		quicConf = &quic.Config{}
+	} else {
+		quicConf = rt.QUICConfig.Clone()
+	}
+	return dialTunnelledQUIC(ctx, conn, tlsConf, quicConf, quic.DialEarly)
+}
+
+func (rt *RoundTripper) removeOrigin(origin string, oc *originConn) {
+	rt.mx.Lock()
+	defer rt.mx.Unlock()
+	if rt.origins[origin] == oc {
+		delete(rt.origins, origin)
+	}
+}
+
+func (rt *RoundTripper) transport() *Transport {
+	if rt.Transport == nil {
+		return &Transport{}
+	}
+	return rt.Transport
+}
+
+func (rt *RoundTripper) idleConnTimeout() time.Duration {
+	if rt.IdleConnTimeout == 0 {
+		return defaultIdleConnTimeout
+	}
+	return rt.IdleConnTimeout
+}
+
+// tcpTransport returns the http.Transport used for requests over CONNECT-TCP.
+// It pools the connections itself.
+func (rt *RoundTripper) tcpTransport() *http.Transport {
+	rt.mx.Lock()
+	defer rt.mx.Unlock()
+	if rt.tcp == nil {
+		rt.tcp = &http.Transport{
+			DialContext:       rt.dialTCP,
+			TLSClientConfig:   rt.TLSClientConfig,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   rt.idleConnTimeout(),
+		}
+	}
+	return rt.tcp
+}
+
+func (rt *RoundTripper) dialTCP(ctx context.Context, _, addr string) (net.Conn, error) {
+	req, err := NewTCPRequest(ctx, rt.Template, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := rt.transport().DialTCP(req)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Close closes all connections to origins.
+// Requests sent after Close was called fail.
+func (rt *RoundTripper) Close() error {
+	rt.mx.Lock()
+	rt.closed = true
+	origins := rt.origins
+	rt.origins = nil
+	tcp := rt.tcp
+	rt.mx.Unlock()
+
+	for _, oc := range origins {
+		select {
+		case <-oc.ready:
+			if oc.conn != nil {
+				oc.conn.CloseWithError(0, "")
+			}
+		default: // still dialing, the connection is closed once dialing finished
+		}
+	}
+	if tcp != nil {
+		tcp.CloseIdleConnections()
+	}
+	return nil
+}
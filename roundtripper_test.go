@@ -0,0 +1,247 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getBody(t *testing.T, rt http.RoundTripper, url string) string {
+	t.Helper()
+	rsp, err := (&http.Client{Transport: rt}).Get(url)
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestRoundTripper(t *testing.T) {
+	targetConn := newUDPConnLocalhost(t)
+	target := &http3.Server{
+		TLSConfig: tlsConf,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello " + r.URL.Path))
+		}),
+	}
+	defer target.Close()
+	go target.Serve(targetConn)
+
+	var flows atomic.Int32
+	records := make(chan *masque.FlowRecord, 1)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+		Authorize: func(http.ResponseWriter, *masque.ProxyRequest) bool {
+			flows.Add(1)
+			return true
+		},
+	})
+	rt := &masque.RoundTripper{
+		Transport: &masque.Transport{
+			TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		},
+		Template:        template,
+		TLSClientConfig: &tls.Config{ServerName: "localhost", RootCAs: certPool},
+	}
+	defer rt.Close()
+
+	url := "https://" + targetConn.LocalAddr().String()
+	require.Equal(t, "hello /foo", getBody(t, rt, url+"/foo"))
+	require.Equal(t, "hello /bar", getBody(t, rt, url+"/bar"))
+	// the connection to the origin is reused
+	require.Equal(t, int32(1), flows.Load())
+
+	_, err := (&http.Client{Transport: rt}).Get("http://" + targetConn.LocalAddr().String())
+	require.ErrorContains(t, err, `masque: unsupported scheme: "http"`)
+
+	require.NoError(t, rt.Close())
+	select {
+	case rec := <-records:
+		require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+	_, err = (&http.Client{Transport: rt}).Get(url)
+	require.Error(t, err)
+}
+
+func TestRoundTripperFallbackToTCP(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello over " + r.Proto))
+	})
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.TLS = tlsConf.Clone()
+	tlsServer.TLS.NextProtos = nil
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	template := runHandler(t, &masque.Handler{Proxy: &masque.Proxy{AllowTCP: true}})
+	rt := &masque.RoundTripper{
+		Transport: &masque.Transport{
+			TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		},
+		Template:        template,
+		TLSClientConfig: &tls.Config{ServerName: "localhost", RootCAs: certPool},
+		// the origin doesn't support HTTP/3, so dialing the QUIC connection times out
+		QUICConfig:    &quic.Config{HandshakeIdleTimeout: scaleDuration(100 * time.Millisecond)},
+		FallbackToTCP: true,
+	}
+	defer rt.Close()
+
+	require.Equal(t, "hello over HTTP/2.0", getBody(t, rt, tlsServer.URL))
+	require.Equal(t, "hello over HTTP/1.1", getBody(t, rt, server.URL))
+}
+
+func TestRoundTripperCancelDial(t *testing.T) {
+	targetConn := newUDPConnLocalhost(t)
+	target := &http3.Server{
+		TLSConfig: tlsConf,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		}),
+	}
+	defer target.Close()
+	go target.Serve(targetConn)
+
+	authorized := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	var unblockOnce sync.Once
+	// make sure the proxy doesn't block forever if the test fails early
+	defer unblockOnce.Do(func() { close(unblock) })
+	template := runHandler(t, &masque.Handler{
+		Authorize: func(http.ResponseWriter, *masque.ProxyRequest) bool {
+			authorized <- struct{}{}
+			<-unblock
+			return true
+		},
+	})
+	rt := &masque.RoundTripper{
+		Transport: &masque.Transport{
+			TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		},
+		Template:        template,
+		TLSClientConfig: &tls.Config{ServerName: "localhost", RootCAs: certPool},
+	}
+	defer rt.Close()
+	url := "https://" + targetConn.LocalAddr().String()
+
+	// The first request starts dialing the connection to the origin.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := rt.RoundTrip(req)
+		errChan <- err
+	}()
+	select {
+	case <-authorized:
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+	rspChan := make(chan *http.Response, 1)
+	go func() {
+		rsp, err := (&http.Client{Transport: rt}).Get(url)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		rspChan <- rsp
+	}()
+
+	// Cancelling the first request doesn't cancel the dial the second request is waiting for.
+	cancel()
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+	unblockOnce.Do(func() { close(unblock) })
+	select {
+	case rsp := <-rspChan:
+		defer rsp.Body.Close()
+		body, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(body))
+	case err := <-errChan:
+		t.Fatalf("request failed: %v", err)
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout")
+	}
+	select {
+	case <-authorized:
+		t.Fatal("the connection to the origin was dialed twice")
+	default:
+	}
+}
+
+func TestRoundTripperIdleConnTimeout(t *testing.T) {
+	const idleTimeout = 100 * time.Millisecond
+
+	targetConn := newUDPConnLocalhost(t)
+	target := &http3.Server{
+		TLSConfig: tlsConf,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(scaleDuration(3 * idleTimeout))
+			}
+			w.Write([]byte("hello " + r.URL.Path))
+		}),
+	}
+	defer target.Close()
+	go target.Serve(targetConn)
+
+	var flows atomic.Int32
+	records := make(chan *masque.FlowRecord, 2)
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{AccessLog: func(rec *masque.FlowRecord) { records <- rec }},
+		Authorize: func(http.ResponseWriter, *masque.ProxyRequest) bool {
+			flows.Add(1)
+			return true
+		},
+	})
+	quicConf := &quic.Config{MaxIdleTimeout: time.Minute}
+	rt := &masque.RoundTripper{
+		Transport: &masque.Transport{
+			TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		},
+		Template:        template,
+		TLSClientConfig: &tls.Config{ServerName: "localhost", RootCAs: certPool},
+		QUICConfig:      quicConf,
+		IdleConnTimeout: scaleDuration(idleTimeout),
+	}
+	defer rt.Close()
+	url := "https://" + targetConn.LocalAddr().String()
+
+	// the connection isn't closed while a request is in flight
+	require.Equal(t, "hello /slow", getBody(t, rt, url+"/slow"))
+	require.Equal(t, int32(1), flows.Load())
+	require.Equal(t, time.Minute, quicConf.MaxIdleTimeout)
+
+	// the idle connection is closed, even though the QUIC idle timeout is a lot longer
+	select {
+	case rec := <-records:
+		require.Equal(t, masque.CloseReasonClient, rec.CloseReason)
+	case <-time.After(scaleDuration(10 * idleTimeout)):
+		t.Fatal("timeout")
+	}
+	require.Equal(t, "hello /foo", getBody(t, rt, url+"/foo"))
+	require.Equal(t, int32(2), flows.Load())
+}
@@ -0,0 +1,84 @@
+package masque
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/yosida95/uritemplate/v3"
+)
+
+type routerEntry struct {
+	template *uritemplate.Template
+	host     string
+}
+
+// A TemplateRouter matches CONNECT-UDP requests against a set of URI templates.
+// This allows a single proxy to serve multiple URI templates, for example
+// a path-based template like https://proxy.example/udp/{target_host}/{target_port}/
+// and a query-based template like https://proxy.example/masque?h={target_host}&p={target_port}.
+// Templates may use additional variables, which are reported in [ProxyRequest.Vars].
+type TemplateRouter struct {
+	entries []routerEntry
+}
+
+// NewTemplateRouter creates a new TemplateRouter.
+// Templates are matched in the order they are passed.
+// Every template must contain the target_host and target_port variables.
+func NewTemplateRouter(templates ...*uritemplate.Template) (*TemplateRouter, error) {
+	if len(templates) == 0 {
+		return nil, errors.New("masque: no templates")
+	}
+	r := &TemplateRouter{entries: make([]routerEntry, 0, len(templates))}
+	for _, t := range templates {
+		u, err := url.Parse(t.Raw())
+		if err != nil {
+			return nil, fmt.Errorf("masque: failed to parse template %s: %w", t.Raw(), err)
+		}
+		var hasHost, hasPort bool
+		for _, name := range t.Varnames() {
+			switch name {
+			case uriTemplateTargetHost:
+				hasHost = true
+			case uriTemplateTargetPort:
+				hasPort = true
+			}
+		}
+		if !hasHost || !hasPort {
+			return nil, fmt.Errorf("masque: template %s needs to contain target_host and target_port", t.Raw())
+		}
+		r.entries = append(r.entries, routerEntry{template: t, host: u.Host})
+	}
+	return r, nil
+}
+
+// Match returns the first template that matches the request, or nil if no template matches.
+// It only considers the :authority and the :path of the request,
+// and doesn't validate any other parts of the CONNECT-UDP request.
+func (r *TemplateRouter) Match(req *http.Request) *uritemplate.Template {
+	u := req.URL.String()
+	for _, e := range r.entries {
+		if e.host != req.Host {
+			continue
+		}
+		if e.template.Match(u) != nil {
+			return e.template
+		}
+	}
+	return nil
+}
+
+// ParseProxyRequest parses a CONNECT-UDP request using the first template that matches the request.
+// The matched template is reported in [ProxyRequest.Template].
+// If no template matches, a [ProxyRequestParseError] with a 404 status code is returned.
+func (r *TemplateRouter) ParseProxyRequest(req *http.Request) (*ProxyRequest, error) {
+	t := r.Match(req)
+	if t == nil {
+		return nil, &ProxyRequestParseError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no template matches %s", req.URL),
+		}
+	}
+	return ParseProxyRequest(req, t)
+}
@@ -0,0 +1,73 @@
+package masque_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/quic-go/masque-go"
+	"github.com/yosida95/uritemplate/v3"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplateRouter(t *testing.T) {
+	pathTemplate := uritemplate.MustNew("https://localhost:1234/udp/{target_host}/{target_port}/")
+	queryTemplate := uritemplate.MustNew("https://localhost:1234/masque?h={target_host}&p={target_port}")
+	tenantTemplate := uritemplate.MustNew("https://localhost:1234/tenants/{tenant}/udp/{target_host}/{target_port}/")
+	router, err := masque.NewTemplateRouter(pathTemplate, queryTemplate, tenantTemplate)
+	require.NoError(t, err)
+
+	t.Run("path-based template", func(t *testing.T) {
+		req := newRequest("https://localhost:1234/udp/quic-go.net/443/")
+		require.Equal(t, pathTemplate, router.Match(req))
+		r, err := router.ParseProxyRequest(req)
+		require.NoError(t, err)
+		require.Equal(t, pathTemplate, r.Template)
+		require.Equal(t, "quic-go.net:443", r.Target)
+		require.Empty(t, r.Vars)
+	})
+
+	t.Run("query-based template", func(t *testing.T) {
+		r, err := router.ParseProxyRequest(newRequest("https://localhost:1234/masque?h=1.2.3.4&p=1337"))
+		require.NoError(t, err)
+		require.Equal(t, queryTemplate, r.Template)
+		require.Equal(t, "1.2.3.4:1337", r.Target)
+	})
+
+	t.Run("template with additional variables", func(t *testing.T) {
+		r, err := router.ParseProxyRequest(newRequest("https://localhost:1234/tenants/acme/udp/quic-go.net/443/"))
+		require.NoError(t, err)
+		require.Equal(t, tenantTemplate, r.Template)
+		require.Equal(t, "quic-go.net:443", r.Target)
+		require.Equal(t, map[string]string{"tenant": "acme"}, r.Vars)
+	})
+
+	t.Run("no matching template", func(t *testing.T) {
+		req := newRequest("https://localhost:1234/foobar")
+		require.Nil(t, router.Match(req))
+		_, err := router.ParseProxyRequest(req)
+		require.ErrorContains(t, err, "no template matches")
+		require.Equal(t, http.StatusNotFound, err.(*masque.ProxyRequestParseError).HTTPStatus)
+	})
+
+	t.Run("wrong :authority", func(t *testing.T) {
+		_, err := router.ParseProxyRequest(newRequest("https://quic-go.net:1234/udp/quic-go.net/443/"))
+		require.Equal(t, http.StatusNotFound, err.(*masque.ProxyRequestParseError).HTTPStatus)
+	})
+
+	t.Run("invalid request for a matching template", func(t *testing.T) {
+		req := newRequest("https://localhost:1234/udp/quic-go.net/443/")
+		req.Proto = "connect-ip"
+		_, err := router.ParseProxyRequest(req)
+		require.EqualError(t, err, "unexpected protocol: connect-ip")
+		require.Equal(t, http.StatusNotImplemented, err.(*masque.ProxyRequestParseError).HTTPStatus)
+	})
+}
+
+func TestTemplateRouterInvalidTemplates(t *testing.T) {
+	_, err := masque.NewTemplateRouter()
+	require.EqualError(t, err, "masque: no templates")
+
+	_, err = masque.NewTemplateRouter(uritemplate.MustNew("https://localhost:1234/masque?h={target_host}"))
+	require.ErrorContains(t, err, "needs to contain target_host and target_port")
+}
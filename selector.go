@@ -0,0 +1,217 @@
+package masque
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/yosida95/uritemplate/v3"
+)
+
+const (
+	defaultMaxProxyFailures     = 3
+	defaultProxyFailureCooldown = 30 * time.Second
+)
+
+// ProxySelectionStrategy determines the order in which a [ProxySelector] tries the proxies.
+type ProxySelectionStrategy int
+
+const (
+	// SelectFailover tries the proxies in the order they are configured.
+	SelectFailover ProxySelectionStrategy = iota
+	// SelectRoundRobin starts with the next proxy on every dial.
+	SelectRoundRobin
+	// SelectLowestRTT prefers the proxy with the lowest smoothed RTT.
+	// Proxies that haven't been dialed yet are tried first, so that their RTT can be measured.
+	SelectLowestRTT
+	// SelectConsistentHash picks the proxy based on a hash of the target (rendezvous hashing),
+	// such that all flows to the same target use the same proxy, as long as that proxy is healthy.
+	SelectConsistentHash
+)
+
+func (s ProxySelectionStrategy) String() string {
+	switch s {
+	case SelectFailover:
+		return "failover"
+	case SelectRoundRobin:
+		return "round-robin"
+	case SelectLowestRTT:
+		return "lowest-rtt"
+	case SelectConsistentHash:
+		return "consistent-hash"
+	default:
+		return fmt.Sprintf("unknown strategy (%d)", int(s))
+	}
+}
+
+// A ProxySelector selects among multiple proxies for every [Transport.Dial].
+// It tracks the health of the proxies: Proxies that repeatedly failed are only tried
+// after all healthy proxies, until the cooldown period has passed.
+type ProxySelector struct {
+	// Templates are the URI templates of the proxies.
+	Templates []*uritemplate.Template
+	// Strategy is the selection strategy.
+	Strategy ProxySelectionStrategy
+	// MaxFailures is the number of consecutive failures after which a proxy is considered unhealthy.
+	// If zero, 3 is used.
+	MaxFailures int
+	// FailureCooldown is the duration after the last failure, after which an unhealthy proxy is tried again.
+	// If zero, 30s is used.
+	FailureCooldown time.Duration
+
+	mx     sync.Mutex
+	health map[string]*proxyHealth // by template
+	next   int                     // for round-robin
+}
+
+type proxyHealth struct {
+	consecutiveFailures int
+	lastFailure         time.Time
+	failedHandshakes    int
+	rejectedRequests    int
+	smoothedRTT         time.Duration
+}
+
+// ProxyHealth is a snapshot of the health of a proxy.
+type ProxyHealth struct {
+	Template *uritemplate.Template
+	// Healthy says if the proxy is currently considered healthy.
+	Healthy bool
+	// ConsecutiveFailures is the number of failures since the last successful dial.
+	ConsecutiveFailures int
+	// FailedHandshakes is the total number of failed QUIC handshakes.
+	FailedHandshakes int
+	// RejectedRequests is the total number of requests rejected by the proxy.
+	RejectedRequests int
+	// SmoothedRTT is the smoothed RTT of the last connection to the proxy.
+	// It is 0 if the proxy wasn't dialed successfully yet.
+	SmoothedRTT time.Duration
+}
+
+// Health returns the health of all proxies, in the order of Templates.
+func (s *ProxySelector) Health() []ProxyHealth {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+	health := make([]ProxyHealth, 0, len(s.Templates))
+	for _, t := range s.Templates {
+		h := s.getHealth(t)
+		health = append(health, ProxyHealth{
+			Template:            t,
+			Healthy:             s.isHealthy(h, now),
+			ConsecutiveFailures: h.consecutiveFailures,
+			FailedHandshakes:    h.failedHandshakes,
+			RejectedRequests:    h.rejectedRequests,
+			SmoothedRTT:         h.smoothedRTT,
+		})
+	}
+	return health
+}
+
+// order returns the templates in the order in which they should be tried for the target.
+func (s *ProxySelector) order(target string) []*uritemplate.Template {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	templates := slices.Clone(s.Templates)
+	if len(templates) == 0 {
+		return nil
+	}
+	switch s.Strategy {
+	case SelectRoundRobin:
+		start := s.next % len(templates)
+		s.next++
+		templates = append(templates[start:], templates[:start]...)
+	case SelectLowestRTT:
+		slices.SortStableFunc(templates, func(a, b *uritemplate.Template) int {
+			return cmp.Compare(s.getHealth(a).smoothedRTT, s.getHealth(b).smoothedRTT)
+		})
+	case SelectConsistentHash:
+		scores := make(map[*uritemplate.Template]uint64, len(templates))
+		for _, t := range templates {
+			h := fnv.New64a()
+			h.Write([]byte(t.Raw()))
+			h.Write([]byte{0})
+			h.Write([]byte(target))
+			scores[t] = h.Sum64()
+		}
+		slices.SortStableFunc(templates, func(a, b *uritemplate.Template) int {
+			return cmp.Compare(scores[b], scores[a])
+		})
+	}
+	// Unhealthy proxies are only used as a last resort.
+	now := time.Now()
+	healthy := make(map[*uritemplate.Template]bool, len(templates))
+	for _, t := range templates {
+		healthy[t] = s.isHealthy(s.getHealth(t), now)
+	}
+	slices.SortStableFunc(templates, func(a, b *uritemplate.Template) int {
+		switch {
+		case healthy[a] == healthy[b]:
+			return 0
+		case healthy[a]:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return templates
+}
+
+func (s *ProxySelector) getHealth(t *uritemplate.Template) *proxyHealth {
+	if s.health == nil {
+		s.health = make(map[string]*proxyHealth)
+	}
+	h, ok := s.health[t.Raw()]
+	if !ok {
+		h = &proxyHealth{}
+		s.health[t.Raw()] = h
+	}
+	return h
+}
+
+func (s *ProxySelector) isHealthy(h *proxyHealth, now time.Time) bool {
+	maxFailures := s.MaxFailures
+	if maxFailures == 0 {
+		maxFailures = defaultMaxProxyFailures
+	}
+	cooldown := s.FailureCooldown
+	if cooldown == 0 {
+		cooldown = defaultProxyFailureCooldown
+	}
+	return h.consecutiveFailures < maxFailures || now.Sub(h.lastFailure) >= cooldown
+}
+
+func (s *ProxySelector) handshakeFailed(t *uritemplate.Template) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	h := s.getHealth(t)
+	h.failedHandshakes++
+	h.consecutiveFailures++
+	h.lastFailure = time.Now()
+}
+
+func (s *ProxySelector) requestRejected(t *uritemplate.Template) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	h := s.getHealth(t)
+	h.rejectedRequests++
+	h.consecutiveFailures++
+	h.lastFailure = time.Now()
+}
+
+func (s *ProxySelector) handshakeSucceeded(t *uritemplate.Template, rtt time.Duration) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.getHealth(t).smoothedRTT = rtt
+}
+
+func (s *ProxySelector) requestSucceeded(t *uritemplate.Template) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.getHealth(t).consecutiveFailures = 0
+}
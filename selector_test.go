@@ -0,0 +1,203 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// dialRecorder records the proxies dialed by a Transport.
+// Dialing hosts ending in .invalid fails.
+type dialRecorder struct {
+	mx    sync.Mutex
+	hosts []string
+}
+
+func (r *dialRecorder) DialAddr(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	r.mx.Lock()
+	r.hosts = append(r.hosts, host)
+	r.mx.Unlock()
+	if net.ParseIP(host) == nil && host != "localhost" {
+		return nil, errors.New("handshake failed")
+	}
+	return quic.DialAddr(ctx, addr, tlsConf, quicConf)
+}
+
+func (r *dialRecorder) Hosts() []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	hosts := r.hosts
+	r.hosts = nil
+	return hosts
+}
+
+func TestProxySelectorFailover(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	_, working, _ := runProxy(t, nil)
+	// this proxy is overloaded
+	conn := newUDPConnLocalhost(t)
+	server := http3.Server{
+		TLSConfig:       tlsConf,
+		EnableDatagrams: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Proxy-Status", "overloaded; error=connection_limit_reached")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	}
+	defer server.Close()
+	go server.Serve(conn)
+	overloaded := uritemplate.MustNew(fmt.Sprintf("https://127.0.0.1:%d/masque?h={target_host}&p={target_port}", conn.LocalAddr().(*net.UDPAddr).Port))
+	unreachable := uritemplate.MustNew("https://unreachable.invalid:443/masque?h={target_host}&p={target_port}")
+
+	var recorder dialRecorder
+	selector := &masque.ProxySelector{
+		Templates:   []*uritemplate.Template{unreachable, overloaded, working},
+		MaxFailures: 1,
+	}
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		DialAddr:        recorder.DialAddr,
+		ProxySelector:   selector,
+	}
+	// The template of the request is ignored.
+	req, err := masque.NewRequest(context.Background(), unreachable, remoteServerConn.LocalAddr().String())
+	require.NoError(t, err)
+	pconn, rsp, err := tr.Dial(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	require.Equal(t, []string{"unreachable.invalid", "127.0.0.1", "localhost"}, recorder.Hosts())
+	_, err = pconn.WriteTo([]byte("foo"), nil)
+	require.NoError(t, err)
+	b := make([]byte, 1500)
+	n, _, err := pconn.ReadFrom(b)
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(b[:n]))
+	require.NoError(t, pconn.Close())
+
+	health := selector.Health()
+	require.Len(t, health, 3)
+	require.False(t, health[0].Healthy)
+	require.Equal(t, 1, health[0].FailedHandshakes)
+	require.False(t, health[1].Healthy)
+	require.Equal(t, 1, health[1].RejectedRequests)
+	require.True(t, health[2].Healthy)
+	require.Zero(t, health[2].ConsecutiveFailures)
+	require.NotZero(t, health[2].SmoothedRTT)
+
+	// unhealthy proxies are tried last
+	pconn, _, err = tr.Dial(req)
+	require.NoError(t, err)
+	require.NoError(t, pconn.Close())
+	require.Equal(t, []string{"localhost"}, recorder.Hosts())
+}
+
+func TestProxySelectorNoFailoverForTargetErrors(t *testing.T) {
+	_, working, _ := runProxy(t, nil)
+	other := uritemplate.MustNew("https://other.invalid:443/masque?h={target_host}&p={target_port}")
+
+	var recorder dialRecorder
+	selector := &masque.ProxySelector{Templates: []*uritemplate.Template{working, other}}
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		DialAddr:        recorder.DialAddr,
+		ProxySelector:   selector,
+	}
+	req, err := masque.NewRequest(context.Background(), working, "nxdomain.test:1234")
+	require.NoError(t, err)
+	_, _, err = tr.Dial(req)
+	var proxyErr *masque.ProxyError
+	require.ErrorAs(t, err, &proxyErr)
+	require.True(t, proxyErr.IsDNSError())
+	require.Equal(t, []string{"localhost"}, recorder.Hosts())
+	require.True(t, selector.Health()[0].Healthy)
+	require.Zero(t, selector.Health()[0].RejectedRequests)
+}
+
+func TestProxySelectorStrategies(t *testing.T) {
+	var templates []*uritemplate.Template
+	for _, host := range []string{"a.invalid", "b.invalid", "c.invalid", "d.invalid"} {
+		templates = append(templates, uritemplate.MustNew("https://"+host+":443/masque?h={target_host}&p={target_port}"))
+	}
+	dialOrder := func(t *testing.T, tr *masque.Transport, recorder *dialRecorder, target string) []string {
+		t.Helper()
+		req, err := masque.NewRequest(context.Background(), templates[0], target)
+		require.NoError(t, err)
+		_, _, err = tr.Dial(req)
+		require.ErrorContains(t, err, "handshake failed")
+		return recorder.Hosts()
+	}
+
+	t.Run("failover", func(t *testing.T) {
+		var recorder dialRecorder
+		tr := &masque.Transport{
+			DialAddr:      recorder.DialAddr,
+			ProxySelector: &masque.ProxySelector{Templates: templates, MaxFailures: 100},
+		}
+		for range 2 {
+			require.Equal(t, []string{"a.invalid", "b.invalid", "c.invalid", "d.invalid"}, dialOrder(t, tr, &recorder, "example.com:443"))
+		}
+	})
+
+	t.Run("round-robin", func(t *testing.T) {
+		var recorder dialRecorder
+		tr := &masque.Transport{
+			DialAddr:      recorder.DialAddr,
+			ProxySelector: &masque.ProxySelector{Templates: templates, Strategy: masque.SelectRoundRobin, MaxFailures: 100},
+		}
+		require.Equal(t, []string{"a.invalid", "b.invalid", "c.invalid", "d.invalid"}, dialOrder(t, tr, &recorder, "example.com:443"))
+		require.Equal(t, []string{"b.invalid", "c.invalid", "d.invalid", "a.invalid"}, dialOrder(t, tr, &recorder, "example.com:443"))
+		require.Equal(t, []string{"c.invalid", "d.invalid", "a.invalid", "b.invalid"}, dialOrder(t, tr, &recorder, "example.com:443"))
+	})
+
+	t.Run("consistent hashing", func(t *testing.T) {
+		var recorder dialRecorder
+		tr := &masque.Transport{
+			DialAddr:      recorder.DialAddr,
+			ProxySelector: &masque.ProxySelector{Templates: templates, Strategy: masque.SelectConsistentHash, MaxFailures: 100},
+		}
+		firstProxies := make(map[string]struct{})
+		for i := range 20 {
+			target := fmt.Sprintf("target%d.example:443", i)
+			order := dialOrder(t, tr, &recorder, target)
+			require.Len(t, order, 4)
+			require.Equal(t, order, dialOrder(t, tr, &recorder, target))
+			firstProxies[order[0]] = struct{}{}
+		}
+		// targets are distributed across the proxies
+		require.Greater(t, len(firstProxies), 1)
+	})
+
+	t.Run("unhealthy proxies", func(t *testing.T) {
+		var recorder dialRecorder
+		tr := &masque.Transport{
+			DialAddr:      recorder.DialAddr,
+			ProxySelector: &masque.ProxySelector{Templates: templates, MaxFailures: 1},
+		}
+		require.Equal(t, []string{"a.invalid", "b.invalid", "c.invalid", "d.invalid"}, dialOrder(t, tr, &recorder, "example.com:443"))
+		// all proxies are unhealthy now, the order is preserved
+		require.Equal(t, []string{"a.invalid", "b.invalid", "c.invalid", "d.invalid"}, dialOrder(t, tr, &recorder, "example.com:443"))
+		for _, h := range tr.ProxySelector.Health() {
+			require.False(t, h.Healthy)
+			require.Equal(t, 2, h.FailedHandshakes)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package masque
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// ConnStats are statistics about proxied connections.
+type ConnStats struct {
+	// DatagramsSent and BytesSent count the UDP payloads sent to the proxy.
+	DatagramsSent uint64
+	BytesSent     uint64
+	// DatagramsReceived and BytesReceived count the UDP payloads received from the proxy.
+	// Datagrams that were dropped are not counted.
+	DatagramsReceived uint64
+	BytesReceived     uint64
+	// DroppedUnknownContextID is the number of datagrams dropped because they used a context ID other than 0.
+	DroppedUnknownContextID uint64
+	// Truncated is the number of datagrams that were truncated in ReadFrom,
+	// because the buffer was too small.
+	Truncated uint64
+	// ICMPErrors is the number of ICMP errors relayed by the proxy.
+	ICMPErrors uint64
+
+	// QUIC are the statistics of the QUIC connection to the proxy, including the RTT.
+	// Note that the QUIC connection might be shared with other proxied connections.
+	QUIC quic.ConnectionStats
+	// CongestionWindow is the congestion window of the QUIC connection to the proxy, in bytes.
+	// MTU is the maximum size of QUIC packets sent to the proxy, as determined by Path MTU Discovery.
+	// Both are only available if the QUIC connection was dialed using a quic.Config that uses [StatsTracer],
+	// and are zero until the first update.
+	CongestionWindow int
+	MTU              int
+}
+
+type connCounters struct {
+	datagramsSent, bytesSent         atomic.Uint64
+	datagramsReceived, bytesReceived atomic.Uint64
+	droppedUnknownContextID          atomic.Uint64
+	truncated                        atomic.Uint64
+	icmpErrors                       atomic.Uint64
+}
+
+func (c *connCounters) stats() ConnStats {
+	return ConnStats{
+		DatagramsSent:           c.datagramsSent.Load(),
+		BytesSent:               c.bytesSent.Load(),
+		DatagramsReceived:       c.datagramsReceived.Load(),
+		BytesReceived:           c.bytesReceived.Load(),
+		DroppedUnknownContextID: c.droppedUnknownContextID.Load(),
+		Truncated:               c.truncated.Load(),
+		ICMPErrors:              c.icmpErrors.Load(),
+	}
+}
+
+// The count functions update the counters of both the Conn and the ClientConn.
+
+func (c *Conn) countSent(n int) {
+	c.counters.datagramsSent.Add(1)
+	c.counters.bytesSent.Add(uint64(n))
+	c.clientConn.counters.datagramsSent.Add(1)
+	c.clientConn.counters.bytesSent.Add(uint64(n))
+}
+
+func (c *Conn) countReceived(n int) {
+	c.counters.datagramsReceived.Add(1)
+	c.counters.bytesReceived.Add(uint64(n))
+	c.clientConn.counters.datagramsReceived.Add(1)
+	c.clientConn.counters.bytesReceived.Add(uint64(n))
+}
+
+func (c *Conn) countDroppedUnknownContextID() {
+	c.counters.droppedUnknownContextID.Add(1)
+	c.clientConn.counters.droppedUnknownContextID.Add(1)
+}
+
+func (c *Conn) countTruncated() {
+	c.counters.truncated.Add(1)
+	c.clientConn.counters.truncated.Add(1)
+}
+
+func (c *Conn) countICMPError() {
+	c.counters.icmpErrors.Add(1)
+	c.clientConn.counters.icmpErrors.Add(1)
+}
+
+// StatsTracer wraps the Tracer of a quic.Config,
+// such that [Conn.Stats] and [ClientConn.Stats] report the congestion window and the MTU.
+// tracer may be nil. Note that using a Tracer adds some overhead to every packet sent and received.
+//
+//	quicConf.Tracer = masque.StatsTracer(quicConf.Tracer)
+func StatsTracer(
+	tracer func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace,
+) func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace {
+	return func(ctx context.Context, isClient bool, connID quic.ConnectionID) qlogwriter.Trace {
+		t := &statsTrace{}
+		if tracer != nil {
+			t.next = tracer(ctx, isClient, connID)
+		}
+		return t
+	}
+}
+
+type statsTrace struct {
+	next qlogwriter.Trace // might be nil
+
+	mx               sync.Mutex
+	congestionWindow int
+	mtu              int
+}
+
+var _ qlogwriter.Trace = &statsTrace{}
+
+func (t *statsTrace) AddProducer() qlogwriter.Recorder {
+	r := &statsRecorder{trace: t}
+	if t.next != nil {
+		r.next = t.next.AddProducer()
+	}
+	return r
+}
+
+func (t *statsTrace) SupportsSchemas(schema string) bool {
+	return t.next != nil && t.next.SupportsSchemas(schema)
+}
+
+func (t *statsTrace) values() (congestionWindow, mtu int) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.congestionWindow, t.mtu
+}
+
+type statsRecorder struct {
+	trace *statsTrace
+	next  qlogwriter.Recorder // might be nil
+}
+
+func (r *statsRecorder) RecordEvent(ev qlogwriter.Event) {
+	switch ev := ev.(type) {
+	case qlog.MetricsUpdated:
+		// Only values that changed are set.
+		if ev.CongestionWindow != 0 {
+			r.trace.mx.Lock()
+			r.trace.congestionWindow = ev.CongestionWindow
+			r.trace.mx.Unlock()
+		}
+	case qlog.MTUUpdated:
+		r.trace.mx.Lock()
+		r.trace.mtu = ev.Value
+		r.trace.mx.Unlock()
+	}
+	if r.next != nil {
+		r.next.RecordEvent(ev)
+	}
+}
+
+func (r *statsRecorder) Close() error {
+	if r.next != nil {
+		return r.next.Close()
+	}
+	return nil
+}
+
+// addQUICStats adds the statistics of the QUIC connection.
+func addQUICStats(s *ConnStats, conn *quic.Conn) {
+	s.QUIC = conn.ConnectionStats()
+	if t, ok := conn.QlogTrace().(*statsTrace); ok {
+		s.CongestionWindow, s.MTU = t.values()
+	}
+}
+
+// Stats returns statistics about the proxied connection.
+func (c *Conn) Stats() ConnStats {
+	s := c.counters.stats()
+	addQUICStats(&s, c.clientConn.conn)
+	return s
+}
+
+// Stats returns statistics aggregated over all proxied connections dialed on this connection,
+// including those that were already closed.
+func (c *ClientConn) Stats() ConnStats {
+	s := c.counters.stats()
+	addQUICStats(&s, c.conn)
+	return s
+}
@@ -0,0 +1,108 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnStats(t *testing.T) {
+	str, pconn := setupProxiedConn(t)
+	conn := pconn.(*masque.Conn)
+
+	require.NoError(t, str.SendDatagram(append(quicvarint.Append(nil, 1), []byte("foo")...)))
+	require.NoError(t, str.SendDatagram(append(quicvarint.Append(nil, 0), []byte("foobar")...)))
+	b := make([]byte, 3)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+	n, _, err := conn.ReadFrom(b)
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(b[:n]))
+
+	_, err = conn.WriteTo([]byte("hello"), nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(time.Second))
+	defer cancel()
+	_, err = str.ReceiveDatagram(ctx)
+	require.NoError(t, err)
+
+	stats := conn.Stats()
+	require.Equal(t, uint64(1), stats.DatagramsSent)
+	require.Equal(t, uint64(5), stats.BytesSent)
+	require.Equal(t, uint64(1), stats.DatagramsReceived)
+	require.Equal(t, uint64(6), stats.BytesReceived)
+	require.Equal(t, uint64(1), stats.DroppedUnknownContextID)
+	require.Equal(t, uint64(1), stats.Truncated)
+	require.Zero(t, stats.ICMPErrors)
+	require.NotZero(t, stats.QUIC.SmoothedRTT)
+	// the QUIC connection wasn't dialed using the StatsTracer
+	require.Zero(t, stats.CongestionWindow)
+	require.Zero(t, stats.MTU)
+}
+
+func TestClientConnStats(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+	template := runHandler(t, &masque.Handler{})
+
+	qconn, err := quic.DialAddr(
+		context.Background(),
+		proxyAddr(t, template).String(),
+		&tls.Config{ServerName: "localhost", RootCAs: certPool, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true, InitialPacketSize: 1280, Tracer: masque.StatsTracer(nil)},
+	)
+	require.NoError(t, err)
+	defer qconn.CloseWithError(0, "")
+	cconn, err := (&masque.Transport{}).NewClientConn(qconn)
+	require.NoError(t, err)
+
+	echo := func(conn *masque.Conn, msg string) {
+		t.Helper()
+		_, err := conn.WriteTo([]byte(msg), nil)
+		require.NoError(t, err)
+		b := make([]byte, 1500)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(scaleDuration(time.Second))))
+		n, _, err := conn.ReadFrom(b)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b[:n]))
+	}
+
+	var conns []*masque.Conn
+	for _, msg := range []string{"foo", "foobar"} {
+		req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+		require.NoError(t, err)
+		conn, _, err := cconn.Dial(req)
+		require.NoError(t, err)
+		echo(conn, msg)
+		conns = append(conns, conn)
+	}
+	require.Equal(t, uint64(3), conns[0].Stats().BytesSent)
+	require.Equal(t, uint64(6), conns[1].Stats().BytesSent)
+	// closed connections are included in the aggregated statistics
+	require.NoError(t, conns[0].Close())
+	defer conns[1].Close()
+
+	stats := cconn.Stats()
+	require.Equal(t, uint64(2), stats.DatagramsSent)
+	require.Equal(t, uint64(9), stats.BytesSent)
+	require.Equal(t, uint64(2), stats.DatagramsReceived)
+	require.Equal(t, uint64(9), stats.BytesReceived)
+	require.NotZero(t, stats.QUIC.SmoothedRTT)
+	require.NotZero(t, stats.CongestionWindow)
+
+	// Path MTU Discovery increases the MTU over time.
+	require.Eventually(t, func() bool {
+		echo(conns[1], "foo")
+		return cconn.Stats().MTU > 1280
+	}, scaleDuration(2*time.Second), scaleDuration(20*time.Millisecond))
+	require.Equal(t, cconn.Stats().MTU, conns[1].Stats().MTU)
+}
@@ -0,0 +1,124 @@
+package masque
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+type masqueTCPAddr struct{ string }
+
+func (m masqueTCPAddr) Network() string { return ProtocolConnectTCP }
+func (m masqueTCPAddr) String() string  { return m.string }
+
+var _ net.Addr = masqueTCPAddr{}
+
+// A TCPConn is a TCP connection proxied using CONNECT-TCP.
+// The byte stream is carried in the body of the Extended CONNECT request and response.
+type TCPConn struct {
+	str        *http3.RequestStream
+	clientConn *ClientConn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	closeConn  func() error
+
+	closed atomic.Bool
+}
+
+var _ net.Conn = &TCPConn{}
+
+// closeConn is only used for QUIC connections dialed by [Transport.DialTCP].
+func newProxiedTCPConn(clientConn *ClientConn, str *http3.RequestStream, local, remote net.Addr, closeConn func() error) *TCPConn {
+	return &TCPConn{
+		str:        str,
+		clientConn: clientConn,
+		localAddr:  local,
+		remoteAddr: remote,
+		closeConn:  closeConn,
+	}
+}
+
+// DialTCP dials a proxied TCP connection to a target server over the proxy connection.
+// The request must be created using [NewTCPRequest].
+func (c *ClientConn) DialTCP(req *Request) (*TCPConn, *http.Response, error) {
+	return c.dialTCP(req, nil)
+}
+
+func (c *ClientConn) dialTCP(req *Request, closeConn func() error) (*TCPConn, *http.Response, error) {
+	if req.req.Proto != ProtocolConnectTCP {
+		return nil, nil, errors.New("masque: not a CONNECT-TCP request")
+	}
+	rstr, rsp, err := c.connect(req)
+	if err != nil {
+		return nil, rsp, err
+	}
+	var raddr net.Addr
+	if udpAddr := nextHopAddr(rsp); udpAddr != nil {
+		raddr = &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port}
+	} else {
+		raddr = masqueTCPAddr{req.target}
+	}
+	return newProxiedTCPConn(c, rstr, masqueTCPAddr{c.conn.LocalAddr().String()}, raddr, closeConn), rsp, nil
+}
+
+// Read reads data sent by the target.
+// It returns io.EOF once the target closed its side of the connection.
+func (c *TCPConn) Read(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	return c.str.Read(b)
+}
+
+// Write sends data to the target.
+func (c *TCPConn) Write(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	return c.str.Write(b)
+}
+
+// CloseWrite shuts down the sending side of the connection.
+// The proxy then closes the sending side of its TCP connection to the target.
+func (c *TCPConn) CloseWrite() error {
+	return c.str.Close()
+}
+
+// Close closes the connection.
+func (c *TCPConn) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+	c.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	err := c.str.Close()
+	c.clientConn.removeFlow(c.str.StreamID())
+	if c.closeConn != nil {
+		return errors.Join(err, c.closeConn())
+	}
+	return err
+}
+
+func (c *TCPConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *TCPConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	return c.str.SetDeadline(t)
+}
+
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	return c.str.SetReadDeadline(t)
+}
+
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	return c.str.SetWriteDeadline(t)
+}
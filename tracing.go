@@ -0,0 +1,86 @@
+package masque
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/quic-go/masque-go"
+
+// Span names.
+const (
+	spanNameDial            = "masque.Dial"
+	spanNameWaitForSettings = "masque.WaitForSettings"
+	spanNameOpenStream      = "masque.OpenStream"
+	spanNameSendRequest     = "masque.SendRequest"
+	spanNameReadResponse    = "masque.ReadResponse"
+	spanNameGetCredentials  = "masque.GetCredentials"
+	spanNameProxy           = "masque.Proxy"
+	spanNameResolve         = "masque.Resolve"
+	spanNameDialTarget      = "masque.DialTarget"
+	spanNameFlow            = "masque.Flow"
+)
+
+const (
+	attrTarget              = attribute.Key("masque.target")
+	attrNextHop             = attribute.Key("masque.next_hop")
+	attrResolvedAddrs       = attribute.Key("masque.resolved_addresses")
+	attrCloseReason         = attribute.Key("masque.close_reason")
+	attrBytesToTarget       = attribute.Key("masque.bytes_to_target")
+	attrBytesFromTarget     = attribute.Key("masque.bytes_from_target")
+	attrDatagramsToTarget   = attribute.Key("masque.datagrams_to_target")
+	attrDatagramsFromTarget = attribute.Key("masque.datagrams_from_target")
+	attrURL                 = attribute.Key("url.full")
+	attrServerAddress       = attribute.Key("server.address")
+	attrStatusCode          = attribute.Key("http.response.status_code")
+)
+
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+func propagator(p propagation.TextMapPropagator) propagation.TextMapPropagator {
+	if p == nil {
+		return otel.GetTextMapPropagator()
+	}
+	return p
+}
+
+// endSpan ends the span, recording the error (if any).
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endDataSpan ends the span covering the lifetime of a flow, recording the counters of the flow.
+func endDataSpan(span trace.Span, rec *FlowRecord) {
+	span.SetAttributes(
+		attrCloseReason.String(rec.CloseReason),
+		attrBytesToTarget.Int64(int64(rec.BytesToTarget)),
+		attrBytesFromTarget.Int64(int64(rec.BytesFromTarget)),
+		attrDatagramsToTarget.Int64(int64(rec.DatagramsToTarget)),
+		attrDatagramsFromTarget.Int64(int64(rec.DatagramsFromTarget)),
+	)
+	span.End()
+}
+
+// endFlowSpan ends the span of a flow on the proxy, using the accounting record of the flow.
+func endFlowSpan(span trace.Span, rec *FlowRecord) {
+	span.SetAttributes(attrStatusCode.Int(rec.Status))
+	if rec.NextHop.IsValid() {
+		span.SetAttributes(attrNextHop.String(rec.NextHop.String()))
+	}
+	if rec.Status < 200 || rec.Status > 299 {
+		span.SetStatus(codes.Error, rec.CloseReason)
+	}
+	span.End()
+}
@@ -0,0 +1,166 @@
+package masque_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanByName(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("span %s not found", name)
+	return tracetest.SpanStub{}
+}
+
+func TestTracing(t *testing.T) {
+	remoteServerConn := runEchoServer(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer remoteServerConn.Close()
+
+	clientExporter := tracetest.NewInMemoryExporter()
+	clientTP := sdktrace.NewTracerProvider(sdktrace.WithSyncer(clientExporter))
+	defer clientTP.Shutdown(context.Background())
+	proxyExporter := tracetest.NewInMemoryExporter()
+	proxyTP := sdktrace.NewTracerProvider(sdktrace.WithSyncer(proxyExporter))
+	defer proxyTP.Shutdown(context.Background())
+
+	template := runHandler(t, &masque.Handler{
+		Proxy: &masque.Proxy{
+			Resolver:       fakeResolver{},
+			TracerProvider: proxyTP,
+			Propagator:     propagation.TraceContext{},
+		},
+	})
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		TracerProvider:  clientTP,
+		Propagator:      propagation.TraceContext{},
+	}
+
+	t.Run("proxied flow", func(t *testing.T) {
+		clientExporter.Reset()
+		proxyExporter.Reset()
+
+		req, err := masque.NewRequest(context.Background(), template, remoteServerConn.LocalAddr().String())
+		require.NoError(t, err)
+		conn, _, err := tr.Dial(req)
+		require.NoError(t, err)
+		checkEcho(t, conn, "foo")
+		require.NoError(t, conn.Close())
+		// The request sent by the application is not modified.
+		require.Empty(t, req.Header().Get("Traceparent"))
+
+		clientSpans := clientExporter.GetSpans()
+		require.Len(t, clientSpans, 5)
+		dialSpan := spanByName(t, clientSpans, "masque.Dial")
+		for _, name := range []string{"masque.WaitForSettings", "masque.OpenStream", "masque.SendRequest", "masque.ReadResponse"} {
+			require.Equal(t, dialSpan.SpanContext.SpanID(), spanByName(t, clientSpans, name).Parent.SpanID(), name)
+		}
+		require.Equal(t, codes.Unset, dialSpan.Status.Code)
+
+		var proxySpans tracetest.SpanStubs
+		require.Eventually(t, func() bool {
+			proxySpans = proxyExporter.GetSpans()
+			return len(proxySpans) == 4
+		}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+		proxySpan := spanByName(t, proxySpans, "masque.Proxy")
+		// The trace context was propagated from the client.
+		require.True(t, proxySpan.Parent.IsRemote())
+		require.Equal(t, dialSpan.SpanContext.TraceID(), proxySpan.SpanContext.TraceID())
+		require.Equal(t, dialSpan.SpanContext.SpanID(), proxySpan.Parent.SpanID())
+		for _, name := range []string{"masque.Resolve", "masque.DialTarget", "masque.Flow"} {
+			require.Equal(t, proxySpan.SpanContext.SpanID(), spanByName(t, proxySpans, name).Parent.SpanID(), name)
+		}
+		attrs := make(map[string]any)
+		for _, kv := range spanByName(t, proxySpans, "masque.Flow").Attributes {
+			attrs[string(kv.Key)] = kv.Value.AsInterface()
+		}
+		require.Equal(t, int64(len("foo")), attrs["masque.bytes_to_target"])
+		require.Equal(t, masque.CloseReasonClient, attrs["masque.close_reason"])
+	})
+
+	t.Run("rejected request", func(t *testing.T) {
+		clientExporter.Reset()
+		proxyExporter.Reset()
+
+		req, err := masque.NewRequest(context.Background(), template, "quic-go.net:1234")
+		require.NoError(t, err)
+		_, _, err = tr.Dial(req)
+		require.Error(t, err)
+
+		dialSpan := spanByName(t, clientExporter.GetSpans(), "masque.Dial")
+		require.Equal(t, codes.Error, dialSpan.Status.Code)
+
+		var proxySpans tracetest.SpanStubs
+		require.Eventually(t, func() bool {
+			proxySpans = proxyExporter.GetSpans()
+			return len(proxySpans) == 2
+		}, scaleDuration(time.Second), scaleDuration(10*time.Millisecond))
+		require.Equal(t, codes.Error, spanByName(t, proxySpans, "masque.Resolve").Status.Code)
+		proxySpan := spanByName(t, proxySpans, "masque.Proxy")
+		require.Equal(t, codes.Error, proxySpan.Status.Code)
+		require.Equal(t, dialSpan.SpanContext.TraceID(), proxySpan.SpanContext.TraceID())
+	})
+}
+
+func TestTracingParentSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	defer ln.Close()
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", ln.LocalAddr().(*net.UDPAddr).Port))
+	server := &http3.Server{
+		TLSConfig:       tlsConf,
+		EnableDatagrams: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}),
+	}
+	defer server.Close()
+	go server.Serve(ln)
+
+	// the dial span is a child of the span in the request context
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	req, err := masque.NewRequest(ctx, template, "localhost:1234")
+	require.NoError(t, err)
+	tr := masque.Transport{
+		TLSClientConfig: &tls.Config{ClientCAs: certPool, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true},
+		TracerProvider:  tp,
+	}
+	_, rsp, err := tr.Dial(req)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, rsp.StatusCode)
+	parent.End()
+
+	dialSpan := spanByName(t, exporter.GetSpans(), "masque.Dial")
+	require.Equal(t, parent.SpanContext().SpanID(), dialSpan.Parent.SpanID())
+	var status any
+	for _, kv := range dialSpan.Attributes {
+		if kv.Key == "http.response.status_code" {
+			status = kv.Value.AsInterface()
+		}
+	}
+	require.Equal(t, int64(http.StatusForbidden), status)
+}
@@ -9,6 +9,9 @@ import (
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/yosida95/uritemplate/v3"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // defaultInitialPacketSize is an increased packet size used for the connection to the proxy.
@@ -27,16 +30,96 @@ type Transport struct {
 	// DialAddr dials the QUIC connection to the proxy.
 	// If unset, quic.DialAddr is used.
 	DialAddr func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error)
+
+	// ProxySelector, if set, selects the proxy for every call to Dial.
+	// The proxy template of the request is then ignored, and the request is expanded using the selected template.
+	// If dialing the proxy fails, or the proxy itself fails (as opposed to the target), the next proxy is tried.
+	ProxySelector *ProxySelector
+
+	// TracerProvider is used to create OpenTelemetry spans when dialing proxied connections.
+	// If nil, the global TracerProvider is used.
+	TracerProvider trace.TracerProvider
+	// Propagator is used to propagate the trace context to the proxy,
+	// using the header fields of the Extended CONNECT request.
+	// If nil, the global TextMapPropagator is used.
+	Propagator propagation.TextMapPropagator
+
+	// CredentialsProvider, if set, provides the credentials when the proxy responds with 407 (Proxy Authentication Required).
+	// The request is then sent again with the credentials.
+	// Reusable credentials are cached per proxy, and sent with subsequent requests, such that these are pre-authorized.
+	CredentialsProvider CredentialsProvider
+
+	authCache authCache
 }
 
 // Dial is a shortcut that opens a QUIC connection to the proxy and then dials a proxied connection.
 // Closing the returned Conn also closes the QUIC connection to the proxy.
 // More advanced use cases, including multiple proxied connections via one proxy connection,
 // should dial a new QUIC connection and use [Transport.NewClientConn].
+// If a ProxySelector is set, Dial tries the proxies in the order determined by the ProxySelector.
 func (t *Transport) Dial(req *Request) (*Conn, *http.Response, error) {
+	return dialProxied(t, req, (*ClientConn).dial)
+}
+
+// DialTCP is a shortcut that opens a QUIC connection to the proxy and then dials a proxied TCP connection.
+// The request must be created using [NewTCPRequest].
+// Closing the returned TCPConn also closes the QUIC connection to the proxy.
+// Like Dial, it uses the ProxySelector (if set).
+func (t *Transport) DialTCP(req *Request) (*TCPConn, *http.Response, error) {
+	return dialProxied(t, req, (*ClientConn).dialTCP)
+}
+
+// DialEthernet is a shortcut that opens a QUIC connection to the proxy and then establishes a Layer 2 tunnel.
+// The request must be created using [NewEthernetRequest].
+// Closing the returned EthernetConn also closes the QUIC connection to the proxy.
+// The ProxySelector is not used, since CONNECT-ETHERNET templates don't contain a target.
+func (t *Transport) DialEthernet(req *Request) (*EthernetConn, *http.Response, error) {
+	return dial(t, req, nil, (*ClientConn).dialEthernet)
+}
+
+// dialFunc dials a proxied connection on a ClientConn.
+type dialFunc[T any] func(c *ClientConn, req *Request, closeConn func() error) (T, *http.Response, error)
+
+// dialProxied implements Dial and DialTCP, trying the proxies in the order determined by the ProxySelector.
+func dialProxied[T any](t *Transport, req *Request, dialConn dialFunc[T]) (T, *http.Response, error) {
+	var zero T
+	if t.ProxySelector == nil {
+		return dial(t, req, nil, dialConn)
+	}
+	templates := t.ProxySelector.order(req.target)
+	if len(templates) == 0 {
+		return zero, nil, errors.New("masque: ProxySelector has no templates")
+	}
+	var errs []error
+	var rsp *http.Response
+	for _, template := range templates {
+		r, err := req.withTemplate(template)
+		if err != nil {
+			return zero, nil, err
+		}
+		var conn T
+		conn, rsp, err = dial(t, r, template, dialConn)
+		if err == nil {
+			return conn, rsp, nil
+		}
+		errs = append(errs, err)
+		if req.req.Context().Err() != nil {
+			break
+		}
+		var proxyErr *ProxyError
+		if errors.As(err, &proxyErr) && !proxyErr.isProxyFailure() {
+			break
+		}
+	}
+	return zero, rsp, errors.Join(errs...)
+}
+
+// dial dials the proxy. If template is not nil, the result is reported to the ProxySelector.
+func dial[T any](t *Transport, req *Request, template *uritemplate.Template, dialConn dialFunc[T]) (T, *http.Response, error) {
+	var zero T
 	httpReq := req.req
 	if httpReq.URL == nil || httpReq.URL.Host == "" {
-		return nil, nil, errors.New("masque: request URL needs a host")
+		return zero, nil, errors.New("masque: request URL needs a host")
 	}
 
 	quicConf := t.QUICConfig
@@ -47,43 +130,58 @@ func (t *Transport) Dial(req *Request) (*Conn, *http.Response, error) {
 		}
 	}
 	if !quicConf.EnableDatagrams {
-		return nil, nil, errors.New("masque: QUICConfig needs to enable Datagrams")
+		return zero, nil, errors.New("masque: QUICConfig needs to enable Datagrams")
 	}
 	tlsConf := t.TLSClientConfig
 	if tlsConf == nil {
 		tlsConf = &tls.Config{NextProtos: []string{http3.NextProtoH3}}
 	}
-	dial := t.DialAddr
-	if dial == nil {
-		dial = quic.DialAddr
+	dialAddr := t.DialAddr
+	if dialAddr == nil {
+		dialAddr = quic.DialAddr
 	}
-	conn, err := dial(httpReq.Context(), httpReq.URL.Host, tlsConf, quicConf)
+	conn, err := dialAddr(httpReq.Context(), httpReq.URL.Host, tlsConf, quicConf)
 	if err != nil {
-		return nil, nil, fmt.Errorf("masque: dialing QUIC connection failed: %w", err)
+		if template != nil && httpReq.Context().Err() == nil {
+			t.ProxySelector.handshakeFailed(template)
+		}
+		return zero, nil, fmt.Errorf("masque: dialing QUIC connection failed: %w", err)
+	}
+	if template != nil {
+		t.ProxySelector.handshakeSucceeded(template, conn.ConnectionStats().SmoothedRTT)
 	}
 	c, err := t.NewClientConn(conn)
 	if err != nil {
 		conn.CloseWithError(0, "")
-		return nil, nil, err
+		return zero, nil, err
 	}
-	pconn, rsp, err := c.dial(req, func() error { return conn.CloseWithError(0, "") })
+	pconn, rsp, err := dialConn(c, req, func() error { return conn.CloseWithError(0, "") })
 	if err != nil {
 		conn.CloseWithError(0, "")
-		return nil, rsp, err
+		if template != nil {
+			var proxyErr *ProxyError
+			if errors.As(err, &proxyErr) && proxyErr.isProxyFailure() {
+				t.ProxySelector.requestRejected(template)
+			}
+		}
+		return zero, rsp, err
+	}
+	if template != nil {
+		t.ProxySelector.requestSucceeded(template)
 	}
 	return pconn, rsp, nil
 }
 
 // NewClientConn creates a client connection for an already established QUIC connection.
 // It returns an error if the QUIC connection didn't negotiate datagram support.
-// The caller owns the QUIC connection and closes it when done.
+// The QUIC connection is closed by [ClientConn.Close] and [ClientConn.Shutdown].
 func (t *Transport) NewClientConn(conn *quic.Conn) (*ClientConn, error) {
 	if datagrams := conn.ConnectionState().SupportsDatagrams; !datagrams.Local || !datagrams.Remote {
 		return nil, errors.New("masque: QUIC connection needs Datagram support")
 	}
 	tr := &http3.Transport{EnableDatagrams: true}
-	return &ClientConn{
-		conn:       conn,
-		clientConn: tr.NewClientConn(conn),
-	}, nil
+	c := newClientConn(conn, tr.NewClientConn(conn), tracer(t.TracerProvider), propagator(t.Propagator))
+	c.credentials = t.CredentialsProvider
+	c.authCache = &t.authCache
+	return c, nil
 }
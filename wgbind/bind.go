@@ -0,0 +1,268 @@
+// Package wgbind implements wireguard-go's conn.Bind on top of a MASQUE proxy,
+// such that the UDP traffic of a userspace WireGuard device is sent through the proxy using CONNECT-UDP.
+package wgbind
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/quic-go/masque-go"
+
+	"github.com/quic-go/quic-go"
+	"github.com/yosida95/uritemplate/v3"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// maxQueuedPackets is the number of received packets queued until they are read by WireGuard.
+const maxQueuedPackets = 1024
+
+// A Bind is a conn.Bind that sends the WireGuard packets through a MASQUE proxy.
+// Every peer endpoint uses its own proxied connection, which is dialed when the first packet is sent to the peer.
+// If the proxied connection fails, it is dialed again for the next packet sent to the peer.
+//
+// Since all packets are received from the proxy, WireGuard can't learn new peer endpoints from received packets.
+// Peers need to be configured with an endpoint.
+type Bind struct {
+	clientConn *masque.ClientConn
+	template   *uritemplate.Template
+
+	mx       sync.Mutex
+	ctx      context.Context // cancelled when the Bind is closed, nil if not open
+	cancel   context.CancelFunc
+	flows    map[netip.AddrPort]*flow
+	received chan receivedPacket
+}
+
+var _ conn.Bind = &Bind{}
+
+type receivedPacket struct {
+	data []byte
+	ep   Endpoint
+}
+
+type flow struct {
+	ready chan struct{} // closed once dialing finished
+
+	// set before ready is closed
+	conn *masque.Conn
+	err  error
+}
+
+// New creates a new Bind, using the connection to the proxy.
+// The template is the URI template of the proxy.
+func New(clientConn *masque.ClientConn, template *uritemplate.Template) *Bind {
+	return &Bind{clientConn: clientConn, template: template}
+}
+
+// Open opens the Bind. The port is reported back to WireGuard, but it is not used,
+// since packets are sent from (and received on) the UDP sockets of the proxy.
+func (b *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.ctx != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.flows = make(map[netip.AddrPort]*flow)
+	b.received = make(chan receivedPacket, maxQueuedPackets)
+	return []conn.ReceiveFunc{b.makeReceiveFunc(b.ctx, b.received)}, port, nil
+}
+
+func (b *Bind) makeReceiveFunc(ctx context.Context, received <-chan receivedPacket) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		var p receivedPacket
+		select {
+		case <-ctx.Done():
+			return 0, net.ErrClosed
+		case p = <-received:
+		}
+		var n int
+		for {
+			sizes[n] = copy(packets[n], p.data)
+			eps[n] = p.ep
+			n++
+			if n == len(packets) {
+				return n, nil
+			}
+			select {
+			case p = <-received:
+			default:
+				return n, nil
+			}
+		}
+	}
+}
+
+// Close closes all proxied connections.
+func (b *Bind) Close() error {
+	b.mx.Lock()
+	if b.ctx == nil {
+		b.mx.Unlock()
+		return nil
+	}
+	b.cancel()
+	b.ctx = nil
+	flows := b.flows
+	b.flows = nil
+	b.mx.Unlock()
+
+	for _, f := range flows {
+		<-f.ready
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}
+	return nil
+}
+
+// SetMark is a no-op. There are no local sockets that the mark could be applied to.
+func (b *Bind) SetMark(uint32) error { return nil }
+
+// BatchSize returns the maximum number of packets handled per call to Send and to the receive function.
+func (b *Bind) BatchSize() int { return conn.IdealBatchSize }
+
+// ParseEndpoint parses an endpoint (ip:port).
+// Host names are not supported, WireGuard resolves them before creating the endpoint.
+func (b *Bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return Endpoint{AddrPort: addr}, nil
+}
+
+// Send sends the packets to the endpoint, dialing a proxied connection if necessary.
+func (b *Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	e, ok := ep.(Endpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	f, err := b.getFlow(e.AddrPort)
+	if err != nil {
+		return err
+	}
+	for _, buf := range bufs {
+		if _, err := f.conn.WriteTo(buf, nil); err != nil {
+			// Packets that don't fit into a QUIC packet are dropped, as they would be on the network.
+			var tooLarge *quic.DatagramTooLargeError
+			if errors.As(err, &tooLarge) {
+				continue
+			}
+			b.removeFlow(e.AddrPort, f)
+			return err
+		}
+	}
+	return nil
+}
+
+// getFlow returns the proxied connection to the endpoint, dialing it if necessary.
+func (b *Bind) getFlow(addr netip.AddrPort) (*flow, error) {
+	b.mx.Lock()
+	if b.ctx == nil {
+		b.mx.Unlock()
+		return nil, net.ErrClosed
+	}
+	ctx := b.ctx
+	f, ok := b.flows[addr]
+	if !ok {
+		f = &flow{ready: make(chan struct{})}
+		b.flows[addr] = f
+		b.mx.Unlock()
+		b.dial(ctx, addr, f)
+	} else {
+		b.mx.Unlock()
+	}
+	<-f.ready
+	return f, f.err
+}
+
+func (b *Bind) dial(ctx context.Context, addr netip.AddrPort, f *flow) {
+	defer close(f.ready)
+	req, err := masque.NewRequest(ctx, b.template, addr.String())
+	if err != nil {
+		f.err = err
+		b.removeFlow(addr, f)
+		return
+	}
+	pconn, _, err := b.clientConn.Dial(req)
+	if err != nil {
+		f.err = err
+		b.removeFlow(addr, f)
+		return
+	}
+	f.conn = pconn
+	go b.receive(ctx, addr, f)
+}
+
+// receive reads the packets received from the endpoint, until the proxied connection fails.
+func (b *Bind) receive(ctx context.Context, addr netip.AddrPort, f *flow) {
+	b.mx.Lock()
+	received := b.received
+	b.mx.Unlock()
+	ep := Endpoint{AddrPort: addr}
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			// ICMP errors relayed by the proxy don't terminate the flow.
+			var icmpErr *masque.ICMPError
+			if errors.As(err, &icmpErr) {
+				continue
+			}
+			if ctx.Err() == nil {
+				log.Printf("proxied connection to %s failed: %v", addr, err)
+				b.removeFlow(addr, f)
+			}
+			return
+		}
+		select {
+		case received <- receivedPacket{data: append([]byte(nil), buf[:n]...), ep: ep}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// removeFlow removes a failed proxied connection, such that the next packet dials a new one.
+func (b *Bind) removeFlow(addr netip.AddrPort, f *flow) {
+	b.mx.Lock()
+	if b.flows[addr] == f {
+		delete(b.flows, addr)
+	}
+	b.mx.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+// An Endpoint is the address of a WireGuard peer.
+type Endpoint struct {
+	netip.AddrPort
+}
+
+var _ conn.Endpoint = Endpoint{}
+
+// ClearSrc is a no-op, since packets are always sent from the proxy.
+func (Endpoint) ClearSrc() {}
+
+// SrcToString returns an empty string, since the source address is chosen by the proxy.
+func (Endpoint) SrcToString() string { return "" }
+
+// SrcIP returns the zero address, since the source address is chosen by the proxy.
+func (Endpoint) SrcIP() netip.Addr { return netip.Addr{} }
+
+// DstToString returns the address of the peer.
+func (e Endpoint) DstToString() string { return e.AddrPort.String() }
+
+// DstIP returns the IP address of the peer.
+func (e Endpoint) DstIP() netip.Addr { return e.Addr() }
+
+// DstToBytes returns the address of the peer, used for WireGuard's cookie calculations.
+func (e Endpoint) DstToBytes() []byte {
+	b, _ := e.AddrPort.MarshalBinary()
+	return b
+}
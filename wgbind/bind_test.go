@@ -0,0 +1,178 @@
+package wgbind_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/masque-go"
+	"github.com/quic-go/masque-go/wgbind"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+	"go.uber.org/goleak"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func serverTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certTempl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, certTempl, certTempl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+		NextProtos:   []string{http3.NextProtoH3},
+	}
+}
+
+// runProxy runs a proxy, using the Proxy stored in proxy for every request.
+func runProxy(t *testing.T, proxy *atomic.Pointer[masque.Proxy]) (*net.UDPAddr, *uritemplate.Template) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	template := uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/masque?h={target_host}&p={target_port}", addr.Port))
+	server := &http3.Server{
+		TLSConfig:       serverTLSConfig(t),
+		EnableDatagrams: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req, err := masque.ParseProxyRequest(r, template)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			proxy.Load().Proxy(w, req)
+		}),
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve(conn)
+	return addr, template
+}
+
+type wgDevice struct {
+	tun       *tuntest.ChannelTUN
+	dev       *device.Device
+	ip        netip.Addr
+	publicKey string
+}
+
+func newWGDevice(t *testing.T, bind conn.Bind, ip netip.Addr) *wgDevice {
+	t.Helper()
+	var privateKey [32]byte
+	_, err := rand.Read(privateKey[:])
+	require.NoError(t, err)
+	publicKey, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	require.NoError(t, err)
+	tun := tuntest.NewChannelTUN()
+	dev := device.NewDevice(tun.TUN(), bind, device.NewLogger(device.LogLevelError, ip.String()+": "))
+	t.Cleanup(dev.Close)
+	require.NoError(t, dev.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=0\n", hex.EncodeToString(privateKey[:]))))
+	require.NoError(t, dev.Up())
+	return &wgDevice{tun: tun, dev: dev, ip: ip, publicKey: hex.EncodeToString(publicKey)}
+}
+
+func (d *wgDevice) addPeer(t *testing.T, peer *wgDevice, endpoint string) {
+	t.Helper()
+	cfg := fmt.Sprintf("public_key=%s\nallowed_ip=%s/32\n", peer.publicKey, peer.ip)
+	if endpoint != "" {
+		cfg += fmt.Sprintf("endpoint=%s\n", endpoint)
+	}
+	require.NoError(t, d.dev.IpcSet(cfg))
+}
+
+func (d *wgDevice) listenPort(t *testing.T) string {
+	t.Helper()
+	cfg, err := d.dev.IpcGet()
+	require.NoError(t, err)
+	m := regexp.MustCompile(`listen_port=(\d+)`).FindStringSubmatch(cfg)
+	require.NotNil(t, m)
+	return m[1]
+}
+
+// ping sends pings from one device to the other, until a ping is received.
+func ping(t *testing.T, from, to *wgDevice) {
+	t.Helper()
+	msg := tuntest.Ping(to.ip, from.ip)
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case from.tun.Outbound <- msg:
+		case <-deadline:
+			t.Fatalf("ping from %s to %s timed out", from.ip, to.ip)
+		}
+		select {
+		case received := <-to.tun.Inbound:
+			require.True(t, bytes.Equal(msg, received))
+			return
+		case <-time.After(100 * time.Millisecond): // retry
+		case <-deadline:
+			t.Fatalf("ping from %s to %s timed out", from.ip, to.ip)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	var proxy atomic.Pointer[masque.Proxy]
+	proxy.Store(&masque.Proxy{})
+	defer func() { proxy.Load().Close() }()
+	proxyAddr, template := runProxy(t, &proxy)
+
+	qconn, err := quic.DialAddr(
+		context.Background(),
+		proxyAddr.String(),
+		&tls.Config{ServerName: "localhost", InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true, InitialPacketSize: 1350},
+	)
+	require.NoError(t, err)
+	defer qconn.CloseWithError(0, "")
+	cconn, err := (&masque.Transport{}).NewClientConn(qconn)
+	require.NoError(t, err)
+
+	// The client sends its WireGuard traffic through the proxy,
+	// the server uses a UDP socket.
+	client := newWGDevice(t, wgbind.New(cconn, template), netip.MustParseAddr("10.0.0.1"))
+	server := newWGDevice(t, conn.NewDefaultBind(), netip.MustParseAddr("10.0.0.2"))
+	client.addPeer(t, server, "127.0.0.1:"+server.listenPort(t))
+	server.addPeer(t, client, "")
+
+	ping(t, client, server)
+	ping(t, server, client)
+
+	// The proxied connection is terminated, and then dialed again.
+	oldProxy := proxy.Swap(&masque.Proxy{})
+	require.NoError(t, oldProxy.Close())
+	ping(t, client, server)
+	ping(t, server, client)
+}